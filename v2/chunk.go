@@ -0,0 +1,399 @@
+package toolkit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ChunkStatus reports the progress of a file uploaded in chunks. Received is the number of bytes
+// received so far, from the start of the file, and Total the size of the whole file, or -1 if the
+// client has not said. Complete is true once every byte of a file of known size has been received
+type ChunkStatus struct {
+	UploadID string
+	Received int64
+	Total    int64
+	Complete bool
+}
+
+// The errors returned by UploadChunk and CompleteChunkedUpload wrap one of these, so that they can be
+// told apart with errors.Is. A handler might answer both with 409 Conflict, and the status of the
+// upload, so that the client can carry on from where it left off
+var (
+	ErrChunkOutOfOrder  = errors.New("the chunk does not follow on from those already received")
+	ErrUploadIncomplete = errors.New("the chunked upload is not complete")
+)
+
+// validUploadID matches the IDs accepted for chunked uploads, which become part of a file name
+var validUploadID = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// chunkFilePrefix begins the names of the files in which chunked uploads are assembled
+const chunkFilePrefix = ".chunked-"
+
+// defaultChunkExpiry is how long a chunked upload is kept without receiving a chunk if ChunkExpiry
+// is not set
+const defaultChunkExpiry = 24 * time.Hour
+
+// chunkLocks is locked for each chunked upload while a chunk is written or the upload completed, so
+// that two requests for the same upload can't interleave
+var chunkLocks keyedMutex
+
+// chunkState is what is remembered about a chunked upload between chunks, besides the bytes received
+type chunkState struct {
+	Total     int64
+	UploadDir string
+}
+
+// UploadChunk saves a chunk of a file which is being uploaded in pieces, so that an upload which fails
+// part of the way through can carry on from where it stopped. The body of r is the chunk itself. The
+// upload is named by the uploadID query parameter, of up to 64 letters, digits, "-" and "_", and the
+// position of the chunk in the file is given by a Content-Range header, such as "bytes 0-1023/4096",
+// or else by the offset query parameter. A chunk which has already been received, in part or in full,
+// is written again in place, so a chunk may safely be retried, but one which would leave a gap is
+// rejected with ErrChunkOutOfOrder. The chunks are assembled in ChunkDir, and once every one has been
+// received the file is saved in uploadDir, which must be the same for every chunk, with
+// CompleteChunkedUpload
+func (t *Tools) UploadChunk(r *http.Request, uploadDir string) (*ChunkStatus, error) {
+	uploadID := r.URL.Query().Get("uploadID")
+	if !validUploadID.MatchString(uploadID) {
+		return nil, fmt.Errorf("invalid upload ID %q", uploadID)
+	}
+
+	offset, end, total, err := chunkRange(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if total > t.maxFileSize() {
+		return nil, fmt.Errorf("the uploaded file is too big; no more than %d bytes permitted", t.maxFileSize())
+	}
+
+	chunkDir, err := t.chunkDir()
+	if err != nil {
+		return nil, err
+	}
+	t.removeExpiredChunks(chunkDir)
+
+	chunkFile := filepath.Join(chunkDir, chunkFilePrefix+uploadID)
+	unlock := chunkLocks.lock(chunkFile)
+	defer unlock()
+
+	state, err := readChunkState(chunkFile)
+	if err != nil {
+		return nil, err
+	}
+	if state.UploadDir != "" && state.UploadDir != uploadDir {
+		return nil, fmt.Errorf("upload %s is being saved in %s, not %s", uploadID, state.UploadDir, uploadDir)
+	}
+	state.UploadDir = uploadDir
+	if total >= 0 {
+		if state.Total >= 0 && state.Total != total {
+			return nil, fmt.Errorf("the size of upload %s has changed from %d to %d bytes", uploadID, state.Total, total)
+		}
+		state.Total = total
+	}
+
+	f, err := openChunkFile(chunkFile, os.O_RDWR|os.O_CREATE)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if offset > info.Size() {
+		return nil, fmt.Errorf("%w: upload %s has %d bytes, but the chunk starts at %d", ErrChunkOutOfOrder, uploadID, info.Size(), offset)
+	}
+
+	// the file may grow to no more than MaxFileSize, or the size the client gave, and the chunk no
+	// further than the end of its range
+	remaining := t.maxFileSize() - offset
+	if state.Total >= 0 {
+		remaining = state.Total - offset
+	}
+	if end >= 0 && end-offset+1 < remaining {
+		remaining = end - offset + 1
+	}
+	body := &contextReader{ctx: r.Context(), r: r.Body}
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	n, err := io.Copy(f, io.LimitReader(body, remaining))
+	if err != nil {
+		return nil, err
+	}
+
+	// nothing beyond the end of the file is written
+	if extra, _ := io.ReadFull(body, make([]byte, 1)); extra > 0 {
+		return nil, fmt.Errorf("the chunk runs beyond the end of its range, or of upload %s", uploadID)
+	}
+	if end >= 0 && n != end-offset+1 {
+		return nil, fmt.Errorf("the chunk of upload %s should have %d bytes, but has %d", uploadID, end-offset+1, n)
+	}
+
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	if err := writeChunkState(chunkFile, state); err != nil {
+		return nil, err
+	}
+
+	received := info.Size()
+	if offset+n > received {
+		received = offset + n
+	}
+
+	return &ChunkStatus{
+		UploadID: uploadID,
+		Received: received,
+		Total:    state.Total,
+		Complete: state.Total >= 0 && received == state.Total,
+	}, nil
+}
+
+// chunkRange returns the offset of the first byte of the chunk in r, and of its last byte and the
+// size of the whole file, which are -1 if they are not known
+func chunkRange(r *http.Request) (int64, int64, int64, error) {
+	contentRange := r.Header.Get("Content-Range")
+	if contentRange == "" {
+		offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+		if err != nil || offset < 0 {
+			return 0, 0, 0, errors.New("a chunk must have a Content-Range header or an offset")
+		}
+		return offset, -1, -1, nil
+	}
+
+	// bytes first-last/total, where total may be *
+	invalid := fmt.Errorf("invalid Content-Range %q", contentRange)
+
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, 0, 0, invalid
+	}
+	span, size, ok := strings.Cut(strings.TrimPrefix(contentRange, "bytes "), "/")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+	first, last, ok := strings.Cut(span, "-")
+	if !ok {
+		return 0, 0, 0, invalid
+	}
+
+	offset, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, 0, 0, invalid
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < offset {
+		return 0, 0, 0, invalid
+	}
+
+	total := int64(-1)
+	if size != "*" {
+		total, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || total <= end {
+			return 0, 0, 0, invalid
+		}
+	}
+
+	return offset, end, total, nil
+}
+
+// readChunkState returns the state saved alongside chunkFile, if there is any
+func readChunkState(chunkFile string) (chunkState, error) {
+	state := chunkState{Total: -1}
+
+	f, err := openChunkFile(chunkFile+".json", os.O_RDONLY)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&state)
+	return state, err
+}
+
+// writeChunkState saves state alongside chunkFile
+func writeChunkState(chunkFile string, state chunkState) error {
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	f, err := openChunkFile(chunkFile+".json", os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// openChunkFile opens name, one of the files in which a chunked upload is assembled, and is created
+// with mode 0600 if flag includes os.O_CREATE. Unlike os.OpenFile, it does not follow a symbolic link,
+// or open anything but a regular file, so that a link planted in the chunk directory can't redirect
+// the chunks into another file
+func openChunkFile(name string, flag int) (*os.File, error) {
+	info, err := os.Lstat(name)
+	if os.IsNotExist(err) && flag&os.O_CREATE != 0 {
+		// O_EXCL fails if anything, even a symbolic link, has appeared in the meantime
+		return os.OpenFile(name, flag|os.O_EXCL, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", name)
+	}
+
+	f, err := os.OpenFile(name, flag&^os.O_CREATE, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	// the file opened must be the one checked, and not a link which replaced it
+	opened, err := f.Stat()
+	if err != nil || !os.SameFile(info, opened) {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s was replaced while it was being opened", name)
+	}
+	return f, nil
+}
+
+// defaultChunkDir is the directory, in TempDir or the system's temporary directory, in which chunked
+// uploads are assembled if ChunkDir is not set
+const defaultChunkDir = "toolkit-chunks"
+
+// chunkDir returns the directory in which chunked uploads are assembled, creating it if need be. The
+// default directory may be in one shared with other users, so it must be a directory, not a symbolic
+// link, which belongs to the current user and which no one else can use
+func (t *Tools) chunkDir() (string, error) {
+	if t.ChunkDir != "" {
+		return t.ChunkDir, t.CreateDirIfNotExist(t.ChunkDir, 0700)
+	}
+
+	dir := filepath.Join(t.tempDir(), defaultChunkDir)
+	if err := os.Mkdir(dir, 0700); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+	if err := checkPrivateDir(info); err != nil {
+		return "", fmt.Errorf("unable to assemble chunked uploads in %s: %w", dir, err)
+	}
+	return dir, nil
+}
+
+// removeExpiredChunks removes the chunked uploads in chunkDir which have received no chunk for
+// ChunkExpiry. Errors are ignored, as the uploads will be removed by a later call
+func (t *Tools) removeExpiredChunks(chunkDir string) {
+	expiry := t.ChunkExpiry
+	if expiry <= 0 {
+		expiry = defaultChunkExpiry
+	}
+
+	entries, err := os.ReadDir(chunkDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), chunkFilePrefix) || strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		chunkFile := filepath.Join(chunkDir, entry.Name())
+
+		unlock := chunkLocks.lock(chunkFile)
+		// the state is written after every chunk, and so shows when the last one arrived, even for an
+		// upload whose chunks have all been written before
+		info, err := os.Stat(chunkFile + ".json")
+		if err != nil {
+			info, err = entry.Info()
+		}
+		if err == nil && time.Since(info.ModTime()) > expiry {
+			_ = os.Remove(chunkFile)
+			_ = os.Remove(chunkFile + ".json")
+		}
+		unlock()
+	}
+}
+
+// CompleteChunkedUpload saves the file assembled by UploadChunk from the chunks of the upload uploadID
+// in the upload directory given to UploadChunk, under the name finalName. The file is checked in the
+// same way as a file uploaded with UploadFiles, and is not renamed, but an existing file called
+// finalName is never replaced. An upload whose size is known, but which has not yet received every
+// byte, is rejected with ErrUploadIncomplete. The chunks are removed once the file is saved
+func (t *Tools) CompleteChunkedUpload(uploadID, finalName string) (*UploadedFile, error) {
+	if !validUploadID.MatchString(uploadID) {
+		return nil, fmt.Errorf("invalid upload ID %q", uploadID)
+	}
+	chunkDir, err := t.chunkDir()
+	if err != nil {
+		return nil, err
+	}
+	chunkFile := filepath.Join(chunkDir, chunkFilePrefix+uploadID)
+	unlock := chunkLocks.lock(chunkFile)
+	defer unlock()
+
+	state, err := readChunkState(chunkFile)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := openChunkFile(chunkFile, os.O_RDONLY)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("there is no chunked upload %s", uploadID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if state.Total >= 0 && info.Size() != state.Total {
+		return nil, fmt.Errorf("%w: upload %s has %d of %d bytes", ErrUploadIncomplete, uploadID, info.Size(), state.Total)
+	}
+
+	target, err := t.uploadTarget(state.UploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	file := uploadSource{r: f, fileName: finalName, size: info.Size(), mustNotExist: true}
+	uploadedFile, err := t.uploadFile(context.Background(), file, target, false)
+	if err != nil {
+		return nil, err
+	}
+
+	_ = f.Close()
+	_ = os.Remove(chunkFile)
+	_ = os.Remove(chunkFile + ".json")
+
+	return uploadedFile, nil
+}
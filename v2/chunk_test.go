@@ -0,0 +1,348 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newChunkRequest builds a request carrying the bytes of content from first to last as a chunk of
+// the upload uploadID
+func newChunkRequest(uploadID string, content []byte, first, last int) *http.Request {
+	req := httptest.NewRequest("PUT", "/?uploadID="+uploadID, bytes.NewReader(content[first:last+1]))
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(content)))
+	return req
+}
+
+func TestTools_UploadChunk(t *testing.T) {
+	uploadDir := filepath.Join("testdata", "uploads", "chunks")
+	defer os.RemoveAll(uploadDir)
+
+	content := newTestPNG(t, 200, 200)
+	third := len(content) / 3
+
+	testTools := Tools{ChunkDir: t.TempDir()}
+
+	var chunkTests = []struct {
+		name          string
+		first, last   int
+		received      int64
+		complete      bool
+		errorExpected bool
+		outOfOrder    bool
+	}{
+		{name: "first", first: 0, last: third - 1, received: int64(third)},
+		{name: "out of order", first: 2 * third, last: len(content) - 1, errorExpected: true, outOfOrder: true},
+		{name: "second", first: third, last: 2*third - 1, received: int64(2 * third)},
+		{name: "second retried", first: third, last: 2*third - 1, received: int64(2 * third)},
+		{name: "third", first: 2 * third, last: len(content) - 1, received: int64(len(content)), complete: true},
+	}
+
+	for _, e := range chunkTests {
+		status, err := testTools.UploadChunk(newChunkRequest("abc-123", content, e.first, e.last), uploadDir)
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", e.name)
+			} else if errors.Is(err, ErrChunkOutOfOrder) != e.outOfOrder {
+				t.Errorf("%s: expected errors.Is(err, ErrChunkOutOfOrder) to be %v, but got %v", e.name, e.outOfOrder, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		if status.Received != e.received || status.Total != int64(len(content)) || status.Complete != e.complete {
+			t.Errorf("%s: unexpected status %+v", e.name, status)
+		}
+	}
+
+	uploadedFile, err := testTools.CompleteChunkedUpload("abc-123", "image.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFile.NewFileName != "image.png" || uploadedFile.FileType != "image/png" || uploadedFile.FileSize != int64(len(content)) {
+		t.Errorf("unexpected uploaded file %+v", uploadedFile)
+	}
+
+	saved, err := os.ReadFile(filepath.Join(uploadDir, "image.png"))
+	if err != nil || !bytes.Equal(saved, content) {
+		t.Errorf("the saved file does not match the one uploaded: %v", err)
+	}
+
+	// the completed file is saved alone, and the chunks are removed
+	entries, _ := os.ReadDir(uploadDir)
+	if len(entries) != 1 {
+		t.Errorf("expected only image.png in the upload directory, but found %d files", len(entries))
+	}
+	entries, _ = os.ReadDir(testTools.ChunkDir)
+	if len(entries) != 0 {
+		t.Errorf("expected the chunks to be removed, but found %d files", len(entries))
+	}
+}
+
+func TestTools_CompleteChunkedUpload_Exists(t *testing.T) {
+	uploadDir := t.TempDir()
+	testTools := Tools{ChunkDir: t.TempDir()}
+
+	if err := os.WriteFile(filepath.Join(uploadDir, "hello.txt"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("hello, world")
+	if _, err := testTools.UploadChunk(newChunkRequest("a", content, 0, len(content)-1), uploadDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := testTools.CompleteChunkedUpload("a", "hello.txt"); err == nil {
+		t.Error("expected an error for a file which already exists, but none received")
+	}
+
+	saved, _ := os.ReadFile(filepath.Join(uploadDir, "hello.txt"))
+	if string(saved) != "original" {
+		t.Errorf("the existing file was replaced with %q", saved)
+	}
+
+	// the chunks are kept, so that the upload can be completed under another name
+	if _, err := testTools.CompleteChunkedUpload("a", "hello2.txt"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestTools_UploadChunk_Expiry(t *testing.T) {
+	uploadDir := t.TempDir()
+	testTools := Tools{ChunkDir: t.TempDir(), ChunkExpiry: time.Hour}
+
+	content := []byte("hello, world")
+	for _, uploadID := range []string{"old", "new"} {
+		if _, err := testTools.UploadChunk(newChunkRequest(uploadID, content, 0, 4), uploadDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the old upload last received a chunk two hours ago
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{chunkFilePrefix + "old", chunkFilePrefix + "old.json"} {
+		if err := os.Chtimes(filepath.Join(testTools.ChunkDir, name), old, old); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := testTools.UploadChunk(newChunkRequest("new", content, 5, len(content)-1), uploadDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(testTools.ChunkDir, chunkFilePrefix+"old")); !os.IsNotExist(err) {
+		t.Errorf("expected the expired upload to be removed, but got %v", err)
+	}
+	if _, err := testTools.CompleteChunkedUpload("new", "hello.txt"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestTools_UploadChunk_Concurrent(t *testing.T) {
+	uploadDir := t.TempDir()
+	testTools := Tools{ChunkDir: t.TempDir()}
+
+	content := bytes.Repeat([]byte("0123456789"), 10000)
+	half := len(content) / 2
+
+	if _, err := testTools.UploadChunk(newChunkRequest("a", content, 0, half-1), uploadDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same chunk retried several times at once is written once after another
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := testTools.UploadChunk(newChunkRequest("a", content, half, len(content)-1), uploadDir); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, err := testTools.CompleteChunkedUpload("a", "numbers.txt"); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := os.ReadFile(filepath.Join(uploadDir, "numbers.txt"))
+	if err != nil || !bytes.Equal(saved, content) {
+		t.Errorf("the saved file does not match the one uploaded: %v", err)
+	}
+}
+
+func TestTools_UploadChunkErrors(t *testing.T) {
+	uploadDir := filepath.Join("testdata", "uploads", "chunkErrors")
+	defer os.RemoveAll(uploadDir)
+
+	content := []byte("hello, world")
+	testTools := Tools{ChunkDir: t.TempDir()}
+
+	if _, err := testTools.UploadChunk(newChunkRequest("../evil", content, 0, 4), uploadDir); err == nil {
+		t.Error("expected an error for an invalid upload ID, but none received")
+	}
+
+	req := httptest.NewRequest("PUT", "/?uploadID=a", bytes.NewReader(content))
+	if _, err := testTools.UploadChunk(req, uploadDir); err == nil {
+		t.Error("expected an error for a chunk without a position, but none received")
+	}
+
+	req = httptest.NewRequest("PUT", "/?uploadID=a", bytes.NewReader(content))
+	req.Header.Set("Content-Range", "bytes 0-3/12")
+	if _, err := testTools.UploadChunk(req, uploadDir); err == nil {
+		t.Error("expected an error for a chunk longer than its range, but none received")
+	}
+
+	// a chunk given by offset alone, leaving the size unknown
+	req = httptest.NewRequest("PUT", "/?uploadID=b&offset=0", bytes.NewReader(content[:5]))
+	status, err := testTools.UploadChunk(req, uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Received != 5 || status.Total != -1 || status.Complete {
+		t.Errorf("unexpected status %+v", status)
+	}
+
+	// an upload of known size can't be completed until every byte has arrived
+	if _, err := testTools.UploadChunk(newChunkRequest("c", content, 0, 4), uploadDir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testTools.CompleteChunkedUpload("c", "hello.txt"); !errors.Is(err, ErrUploadIncomplete) {
+		t.Errorf("expected ErrUploadIncomplete, but got %v", err)
+	}
+
+	// every chunk is saved in the same directory
+	if _, err := testTools.UploadChunk(newChunkRequest("c", content, 5, 6), t.TempDir()); err == nil {
+		t.Error("expected an error for a chunk with another upload directory, but none received")
+	}
+
+	// the assembled file is checked like any other upload
+	if _, err := testTools.UploadChunk(newChunkRequest("c", content, 5, len(content)-1), uploadDir); err != nil {
+		t.Fatal(err)
+	}
+	testTools.AllowedFileType = []string{"image/png"}
+	if _, err := testTools.CompleteChunkedUpload("c", "hello.txt"); err == nil {
+		t.Error("expected an error for a type which is not permitted, but none received")
+	}
+
+	if _, err := testTools.CompleteChunkedUpload("missing", "hello.txt"); err == nil {
+		t.Error("expected an error for an unknown upload, but none received")
+	}
+}
+
+func TestTools_UploadChunk_Symlink(t *testing.T) {
+	uploadDir := t.TempDir()
+	chunkDir := t.TempDir()
+	testTools := Tools{ChunkDir: chunkDir}
+
+	victim := filepath.Join(t.TempDir(), "victim.txt")
+	if err := os.WriteFile(victim, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	content := []byte("hello, world")
+
+	var symlinkTests = []struct {
+		name     string
+		linkName string
+	}{
+		{name: "chunk file", linkName: chunkFilePrefix + "a"},
+		{name: "state file", linkName: chunkFilePrefix + "b.json"},
+	}
+
+	for _, e := range symlinkTests {
+		if err := os.Symlink(victim, filepath.Join(chunkDir, e.linkName)); err != nil {
+			t.Skipf("unable to create a symbolic link: %s", err)
+		}
+	}
+
+	for i, e := range symlinkTests {
+		uploadID := string(rune('a' + i))
+		if _, err := testTools.UploadChunk(newChunkRequest(uploadID, content, 0, len(content)-1), uploadDir); err == nil {
+			t.Errorf("%s: expected an error for a symbolic link, but none received", e.name)
+		}
+		if _, err := testTools.CompleteChunkedUpload(uploadID, "hello.txt"); err == nil {
+			t.Errorf("%s: expected an error completing an upload through a symbolic link, but none received", e.name)
+		}
+	}
+
+	saved, _ := os.ReadFile(victim)
+	if string(saved) != "original" {
+		t.Errorf("the file linked to was written: %q", saved)
+	}
+}
+
+func TestTools_UploadChunk_DefaultChunkDir(t *testing.T) {
+	if runtime.GOOS == "windows" || runtime.GOOS == "plan9" {
+		t.Skip("the system's temporary directory is not shared with other users")
+	}
+
+	uploadDir := t.TempDir()
+	content := []byte("hello, world")
+
+	var chunkDirTests = []struct {
+		name          string
+		prepare       func(dir string) error
+		errorExpected bool
+	}{
+		{name: "created", prepare: func(dir string) error { return nil }},
+		{name: "private", prepare: func(dir string) error { return os.Mkdir(dir, 0700) }},
+		{name: "shared", prepare: func(dir string) error {
+			if err := os.Mkdir(dir, 0700); err != nil {
+				return err
+			}
+			return os.Chmod(dir, 0777)
+		}, errorExpected: true},
+		{name: "symlink", prepare: func(dir string) error { return os.Symlink(t.TempDir(), dir) }, errorExpected: true},
+	}
+
+	for _, e := range chunkDirTests {
+		tempDir := t.TempDir()
+		t.Setenv("TMPDIR", tempDir)
+		if err := e.prepare(filepath.Join(tempDir, defaultChunkDir)); err != nil {
+			t.Fatal(err)
+		}
+
+		var testTools Tools
+		_, err := testTools.UploadChunk(newChunkRequest("a", content, 0, 4), uploadDir)
+		if e.errorExpected && err == nil {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+	}
+}
+
+func TestTools_UploadChunk_TempDir(t *testing.T) {
+	// the system's temporary directory is not used at all
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+
+	uploadDir := t.TempDir()
+	testTools := Tools{TempDir: t.TempDir()}
+
+	content := []byte("hello, world")
+	if _, err := testTools.UploadChunk(newChunkRequest("a", content, 0, len(content)-1), uploadDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(testTools.TempDir, defaultChunkDir, chunkFilePrefix+"a")); err != nil {
+		t.Errorf("expected the chunks to be assembled in TempDir: %s", err)
+	}
+	if _, err := testTools.CompleteChunkedUpload("a", "hello.txt"); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
@@ -0,0 +1,671 @@
+package toolkit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"math"
+	"strings"
+)
+
+// decodableImage reports whether fileType is a type of image which the standard library can decode
+func decodableImage(fileType string) bool {
+	switch fileType {
+	case "image/gif", "image/jpeg", "image/png":
+		return true
+	default:
+		return false
+	}
+}
+
+// checkImageFormat reads just enough of the image in r to find the format it is encoded in, and returns
+// an error unless it is one of AllowedImageFormats. Images which the standard library can't decode,
+// such as WebP, are checked by their detected type alone. The returned reader yields the whole of r,
+// including the bytes already read
+func (t *Tools) checkImageFormat(r io.Reader, fileName, fileType string) (io.Reader, error) {
+	if len(t.AllowedImageFormats) == 0 || !strings.HasPrefix(fileType, "image/") {
+		return r, nil
+	}
+
+	format := imageFormatName(fileType)
+	if decodableImage(fileType) {
+		var err error
+		_, format, r, err = decodeImageConfig(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read the format of the uploaded image %s: %w", fileName, err)
+		}
+	}
+
+	for _, x := range t.AllowedImageFormats {
+		if strings.EqualFold(imageFormatName(x), format) {
+			return r, nil
+		}
+	}
+
+	return nil, fmt.Errorf("the uploaded image %s is encoded as %s, which is not permitted", fileName, format)
+}
+
+// imageFormatName returns the name image.Decode uses for format, which may be given as a content type
+// such as "image/png", or as a common alias such as "jpg"
+func imageFormatName(format string) string {
+	format = strings.TrimPrefix(strings.ToLower(format), "image/")
+	if format == "jpg" {
+		return "jpeg"
+	}
+	return format
+}
+
+// checksImageDimensions reports whether any limit has been set on the dimensions of uploaded images
+func (t *Tools) checksImageDimensions() bool {
+	return t.MinImageWidth > 0 || t.MinImageHeight > 0 || t.MaxImageWidth > 0 || t.MaxImageHeight > 0
+}
+
+// checkImageDimensions reads just enough of the image in r to find its dimensions, and returns an error
+// if they fall outside the limits set by MinImageWidth, MinImageHeight, MaxImageWidth and MaxImageHeight.
+// Only GIF, JPEG and PNG images are checked. The returned reader yields the whole of r, including the
+// bytes already read
+func (t *Tools) checkImageDimensions(r io.Reader, fileName, fileType string) (io.Reader, error) {
+	if !t.checksImageDimensions() || !decodableImage(fileType) {
+		return r, nil
+	}
+
+	config, _, r, err := decodeImageConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the dimensions of the uploaded image %s: %w", fileName, err)
+	}
+
+	var limit string
+	switch {
+	case t.MinImageWidth > 0 && config.Width < t.MinImageWidth:
+		limit = fmt.Sprintf("its width must be at least %d", t.MinImageWidth)
+	case t.MaxImageWidth > 0 && config.Width > t.MaxImageWidth:
+		limit = fmt.Sprintf("its width must be no more than %d", t.MaxImageWidth)
+	case t.MinImageHeight > 0 && config.Height < t.MinImageHeight:
+		limit = fmt.Sprintf("its height must be at least %d", t.MinImageHeight)
+	case t.MaxImageHeight > 0 && config.Height > t.MaxImageHeight:
+		limit = fmt.Sprintf("its height must be no more than %d", t.MaxImageHeight)
+	}
+
+	if limit != "" {
+		return nil, fmt.Errorf("the uploaded image %s is %dx%d pixels; %s", fileName, config.Width, config.Height, limit)
+	}
+
+	return r, nil
+}
+
+// maxImageHeaderSize is the most that is read of an image to find its format and dimensions. JPEG
+// images may have metadata, such as a colour profile, before their dimensions, but rarely so much
+const maxImageHeaderSize = 4 << 20
+
+// defaultMaxImagePixels is the largest number of pixels in an image which is decoded, if
+// MaxImagePixels is not set
+const defaultMaxImagePixels = 50 * 1000 * 1000
+
+// checkImagePixels returns an error if the image described by config has more than MaxImagePixels
+// pixels, so that it is not decoded
+func (t *Tools) checkImagePixels(config image.Config, fileName string) error {
+	limit := t.MaxImagePixels
+	if limit == 0 {
+		limit = defaultMaxImagePixels
+	}
+
+	if pixels := int64(config.Width) * int64(config.Height); limit > 0 && pixels > limit {
+		return fmt.Errorf("the uploaded image %s is %dx%d pixels; it must have no more than %d pixels", fileName, config.Width, config.Height, limit)
+	}
+	return nil
+}
+
+// decodeImageConfig reads the start of the image in r, up to maxImageHeaderSize bytes, to find its
+// format and dimensions. The returned reader yields the whole of r, including the bytes already read
+func decodeImageConfig(r io.Reader) (image.Config, string, io.Reader, error) {
+	var header bytes.Buffer
+	config, format, err := image.DecodeConfig(io.TeeReader(io.LimitReader(r, maxImageHeaderSize), &header))
+	if err != nil && header.Len() == maxImageHeaderSize {
+		err = fmt.Errorf("no dimensions found in the first %d bytes", maxImageHeaderSize)
+	}
+	return config, format, io.MultiReader(&header, r), err
+}
+
+// processImage scales the image in r down to fit within ImageMaxWidth and ImageMaxHeight, if
+// ResizeImages is set, and converts it to ConvertImagesTo, if set, recording its dimensions before
+// and after in uploadedFile. Images which need neither are passed through untouched. It returns the
+// image to be saved, and its content type
+func (t *Tools) processImage(r io.Reader, fileName, fileType string, uploadedFile *UploadedFile) (io.Reader, string, error) {
+	if !t.ResizeImages && t.ConvertImagesTo == "" {
+		return r, fileType, nil
+	}
+
+	var format string
+	switch fileType {
+	case "image/gif", "image/jpeg", "image/png":
+		format = strings.TrimPrefix(fileType, "image/")
+	default:
+		return r, fileType, nil
+	}
+
+	outputFormat := format
+	if t.ConvertImagesTo != "" {
+		switch strings.ToLower(t.ConvertImagesTo) {
+		case "png":
+			outputFormat = "png"
+		case "jpeg", "jpg":
+			outputFormat = "jpeg"
+		default:
+			return nil, "", fmt.Errorf("unable to convert images to %s; only png and jpeg are supported", t.ConvertImagesTo)
+		}
+	}
+
+	config, _, r, err := decodeImageConfig(r)
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to read the uploaded image: %w", err)
+	}
+	if err := t.checkImagePixels(config, fileName); err != nil {
+		return nil, "", err
+	}
+
+	// a JPEG image is displayed turned as its EXIF orientation says, which may swap its width and
+	// height
+	orientation := 1
+	if format == "jpeg" {
+		raw, err := io.ReadAll(r)
+		if err != nil {
+			return nil, "", err
+		}
+		orientation = jpegOrientation(raw)
+		r = bytes.NewReader(raw)
+	}
+	if orientation >= 5 {
+		config.Width, config.Height = config.Height, config.Width
+	}
+
+	uploadedFile.OriginalWidth, uploadedFile.OriginalHeight = config.Width, config.Height
+	uploadedFile.FinalWidth, uploadedFile.FinalHeight = config.Width, config.Height
+
+	width, height := config.Width, config.Height
+	if t.ResizeImages {
+		width, height = fitWithin(config.Width, config.Height, t.ImageMaxWidth, t.ImageMaxHeight)
+	}
+
+	if width == config.Width && height == config.Height && outputFormat == format {
+		return r, fileType, nil
+	}
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// only the first frame of an animated GIF would survive being resized or converted
+	if format == "gif" {
+		animation, err := gif.DecodeAll(bytes.NewReader(raw))
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to decode the uploaded gif image %s: %w", fileName, err)
+		}
+
+		if len(animation.Image) > 1 {
+			if !t.KeepAnimatedGIFs {
+				return nil, "", fmt.Errorf("the uploaded image %s is an animated gif, which can't be resized or converted without losing all but its first frame", fileName)
+			}
+			return bytes.NewReader(raw), fileType, nil
+		}
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, "", fmt.Errorf("unable to convert the uploaded %s image %s to %s: %w", format, fileName, outputFormat, err)
+	}
+
+	// the EXIF orientation is lost when the image is encoded again, so it is applied to the pixels
+	img = applyOrientation(img, orientation)
+
+	if width != config.Width || height != config.Height {
+		img = resizeBilinear(img, width, height)
+	}
+
+	var buf bytes.Buffer
+	if err := t.encodeImage(&buf, img, outputFormat); err != nil {
+		return nil, "", fmt.Errorf("unable to convert the uploaded %s image %s to %s: %w", format, fileName, outputFormat, err)
+	}
+
+	uploadedFile.FinalWidth, uploadedFile.FinalHeight = width, height
+	return &buf, "image/" + outputFormat, nil
+}
+
+// stripImageMetadata removes the metadata, such as EXIF, from the JPEG or PNG image in r, if
+// StripImageMetadata is set, without decoding it, so the pixels are unchanged. The EXIF orientation
+// of a JPEG image is kept, so that it is still displayed the right way up. Other files are passed
+// through untouched
+func (t *Tools) stripImageMetadata(r io.Reader, fileName, fileType string) (io.Reader, error) {
+	if !t.StripImageMetadata || (fileType != "image/jpeg" && fileType != "image/png") {
+		return r, nil
+	}
+
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var stripped []byte
+	if fileType == "image/jpeg" {
+		stripped, err = stripJPEGMetadata(raw)
+	} else {
+		stripped, err = stripPNGMetadata(raw)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to remove the metadata from the uploaded image %s: %w", fileName, err)
+	}
+
+	return bytes.NewReader(stripped), nil
+}
+
+var errBadImage = errors.New("the image is not valid")
+
+// stripJPEGMetadata returns the JPEG image img without its comments, or its APPn segments other than
+// JFIF (APP0), the colour profile (APP2) and Adobe colour information (APP14). If the image is not
+// the right way up, an EXIF segment holding only its orientation takes the place of the others
+func stripJPEGMetadata(img []byte) ([]byte, error) {
+	if len(img) < 2 || img[0] != 0xff || img[1] != 0xd8 {
+		return nil, errBadImage
+	}
+
+	var orientation []byte
+	if o := jpegOrientation(img); o != 1 {
+		orientation = exifOrientationSegment(o)
+	}
+
+	out := []byte{0xff, 0xd8}
+	i := 2
+	for {
+		// markers may be padded with any number of 0xff bytes
+		for i < len(img) && img[i] == 0xff && i+1 < len(img) && img[i+1] == 0xff {
+			i++
+		}
+		if i+1 >= len(img) || img[i] != 0xff {
+			return nil, errBadImage
+		}
+		marker := img[i+1]
+
+		// the orientation follows JFIF, which must come first
+		if marker != 0xe0 && orientation != nil {
+			out = append(out, orientation...)
+			orientation = nil
+		}
+
+		switch {
+		case marker == 0xda:
+			// the image data follows the start of scan, through to the end of the file
+			return append(out, img[i:]...), nil
+		case marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7):
+			// markers without a length
+			out = append(out, img[i:i+2]...)
+			i += 2
+			continue
+		}
+
+		if i+4 > len(img) {
+			return nil, errBadImage
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(img[i+2:i+4]))
+		if end > len(img) {
+			return nil, errBadImage
+		}
+
+		metadata := marker == 0xfe || (marker >= 0xe1 && marker <= 0xef && marker != 0xe2 && marker != 0xee)
+		if !metadata {
+			out = append(out, img[i:end]...)
+		}
+		i = end
+	}
+}
+
+// exifHeader begins the EXIF segment of a JPEG image, and is followed by the EXIF data, laid out as
+// a TIFF file
+const exifHeader = "Exif\x00\x00"
+
+// exifOrientationTag is the EXIF tag giving the orientation of an image
+const exifOrientationTag = 0x0112
+
+// jpegOrientation returns the EXIF orientation of the JPEG image img, from 1, which is the right way
+// up, to 8, or 1 if it has none
+func jpegOrientation(img []byte) int {
+	if len(img) < 2 || img[0] != 0xff || img[1] != 0xd8 {
+		return 1
+	}
+
+	i := 2
+	for i+4 <= len(img) && img[i] == 0xff {
+		marker := img[i+1]
+		if marker == 0xff {
+			i++
+			continue
+		}
+		// the metadata comes before the image data
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+
+		end := i + 2 + int(binary.BigEndian.Uint16(img[i+2:i+4]))
+		if end > len(img) {
+			break
+		}
+		if marker == 0xe1 && bytes.HasPrefix(img[i+4:end], []byte(exifHeader)) {
+			return tiffOrientation(img[i+4+len(exifHeader) : end])
+		}
+		i = end
+	}
+	return 1
+}
+
+// tiffOrientation returns the orientation recorded in the first directory of the TIFF data tiff, or 1
+// if there is none
+func tiffOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	// the directory is a count of entries of 12 bytes each: a tag, type, count and value
+	dir := int64(order.Uint32(tiff[4:8]))
+	if dir+2 > int64(len(tiff)) {
+		return 1
+	}
+	count := int64(order.Uint16(tiff[dir:]))
+	for entry := dir + 2; entry < dir+2+12*count && entry+12 <= int64(len(tiff)); entry += 12 {
+		if order.Uint16(tiff[entry:]) == exifOrientationTag {
+			if o := int(order.Uint16(tiff[entry+8:])); o >= 1 && o <= 8 {
+				return o
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// exifOrientationSegment returns a JPEG EXIF segment recording nothing but the orientation o
+func exifOrientationSegment(o int) []byte {
+	segment := []byte{0xff, 0xe1, 0, 0}
+	segment = append(segment, exifHeader...)
+	// a big endian TIFF header, and a directory of one entry, of one short, and no more directories
+	segment = append(segment, 'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1)
+	segment = append(segment, exifOrientationTag>>8, exifOrientationTag&0xff, 0, 3, 0, 0, 0, 1, 0, byte(o), 0, 0)
+	segment = append(segment, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(segment)-2))
+	return segment
+}
+
+// applyOrientation returns img turned the right way up, given its EXIF orientation o
+func applyOrientation(img image.Image, o int) image.Image {
+	if o < 2 || o > 8 {
+		return img
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// the orientations from 5 on swap the width and height
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if o >= 5 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+
+	db := dst.Bounds()
+	for y := 0; y < db.Dy(); y++ {
+		for x := 0; x < db.Dx(); x++ {
+			// the pixel of img which belongs at x, y
+			var sx, sy int
+			switch o {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // upside down
+				sx, sy = w-1-x, h-1-y
+			case 4: // mirrored and upside down
+				sx, sy = x, h-1-y
+			case 5: // mirrored and turned anticlockwise
+				sx, sy = y, x
+			case 6: // turned anticlockwise
+				sx, sy = y, h-1-x
+			case 7: // mirrored and turned clockwise
+				sx, sy = w-1-y, h-1-x
+			case 8: // turned clockwise
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, img.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	return dst
+}
+
+// pngSignature begins every PNG image
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// stripPNGMetadata returns the PNG image img without its text, EXIF and modification time chunks
+func stripPNGMetadata(img []byte) ([]byte, error) {
+	if !bytes.HasPrefix(img, []byte(pngSignature)) {
+		return nil, errBadImage
+	}
+
+	out := []byte(pngSignature)
+	i := len(pngSignature)
+	for i < len(img) {
+		// each chunk is its length, type, data and a checksum
+		if i+8 > len(img) {
+			return nil, errBadImage
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(img[i:i+4]))
+		if end > len(img) || end < i {
+			return nil, errBadImage
+		}
+
+		switch string(img[i+4 : i+8]) {
+		case "tEXt", "zTXt", "iTXt", "eXIf", "tIME":
+		default:
+			out = append(out, img[i:end]...)
+		}
+		i = end
+	}
+
+	return out, nil
+}
+
+// makesThumbnail reports whether a thumbnail should be saved for an uploaded file of type fileType
+func (t *Tools) makesThumbnail(fileType string) bool {
+	return t.GenerateThumbnails && decodableImage(fileType)
+}
+
+// saveThumbnail scales down the image img, which has been saved as uploadedFile, to fit within
+// ThumbnailWidth by ThumbnailHeight, and saves it to target alongside the image, unless there is
+// already a file of that name
+func (t *Tools) saveThumbnail(img []byte, target UploadTarget, uploadedFile *UploadedFile) error {
+	config, _, err := image.DecodeConfig(bytes.NewReader(img))
+	if err != nil {
+		return fmt.Errorf("unable to read the uploaded image %s to make a thumbnail: %w", uploadedFile.OriginalFileName, err)
+	}
+	if err := t.checkImagePixels(config, uploadedFile.OriginalFileName); err != nil {
+		return err
+	}
+
+	src, format, err := image.Decode(bytes.NewReader(img))
+	if err != nil {
+		return fmt.Errorf("unable to read the uploaded image %s to make a thumbnail: %w", uploadedFile.OriginalFileName, err)
+	}
+	if format == "jpeg" {
+		src = applyOrientation(src, jpegOrientation(img))
+	}
+
+	maxWidth, maxHeight := t.ThumbnailWidth, t.ThumbnailHeight
+	if maxWidth == 0 && maxHeight == 0 {
+		maxWidth, maxHeight = 150, 150
+	}
+
+	if t.ThumbnailCrop && maxWidth > 0 && maxHeight > 0 {
+		src = cropToRatio(src, maxWidth, maxHeight)
+	}
+
+	b := src.Bounds()
+	width, height := fitWithin(b.Dx(), b.Dy(), maxWidth, maxHeight)
+
+	var buf bytes.Buffer
+	if err := t.encodeImage(&buf, resizeBilinear(src, width, height), format); err != nil {
+		return err
+	}
+
+	name := t.thumbnailName(uploadedFile.NewFileName)
+	if _, err := saveNewTo(target, name, uploadedFile.FileType, &buf); err != nil {
+		return err
+	}
+
+	uploadedFile.ThumbnailFileName = name
+	return nil
+}
+
+// cropToRatio returns the largest part of img, about its centre, with the proportions of width by height
+func cropToRatio(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	crop := b
+
+	if b.Dx()*height > b.Dy()*width {
+		// too wide
+		w := int(math.Max(1, math.Round(float64(b.Dy()*width)/float64(height))))
+		crop.Min.X = b.Min.X + (b.Dx()-w)/2
+		crop.Max.X = crop.Min.X + w
+	} else {
+		// too tall
+		h := int(math.Max(1, math.Round(float64(b.Dx()*height)/float64(width))))
+		crop.Min.Y = b.Min.Y + (b.Dy()-h)/2
+		crop.Max.Y = crop.Min.Y + h
+	}
+
+	sub, ok := img.(interface {
+		SubImage(r image.Rectangle) image.Image
+	})
+	if !ok {
+		return img
+	}
+	return sub.SubImage(crop)
+}
+
+// fitWithin returns the largest dimensions no bigger than width by height, and no wider than maxWidth
+// or taller than maxHeight, which keep the proportions of width by height. A limit of zero is ignored
+func fitWithin(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && height > maxHeight {
+		scale = math.Min(scale, float64(maxHeight)/float64(height))
+	}
+
+	if scale == 1 {
+		return width, height
+	}
+
+	w := int(math.Max(1, math.Round(float64(width)*scale)))
+	h := int(math.Max(1, math.Round(float64(height)*scale)))
+	return w, h
+}
+
+// resizeBilinear scales src to width by height pixels using bilinear interpolation
+func resizeBilinear(src image.Image, width, height int) *image.RGBA {
+	dst := image.NewRGBA(image.Rect(0, 0, width, height))
+
+	b := src.Bounds()
+	xRatio := float64(b.Dx()) / float64(width)
+	yRatio := float64(b.Dy()) / float64(height)
+
+	for y := 0; y < height; y++ {
+		y0, y1, fy := sourcePixels(y, yRatio, b.Dy())
+
+		for x := 0; x < width; x++ {
+			x0, x1, fx := sourcePixels(x, xRatio, b.Dx())
+
+			r00, g00, b00, a00 := src.At(b.Min.X+x0, b.Min.Y+y0).RGBA()
+			r10, g10, b10, a10 := src.At(b.Min.X+x1, b.Min.Y+y0).RGBA()
+			r01, g01, b01, a01 := src.At(b.Min.X+x0, b.Min.Y+y1).RGBA()
+			r11, g11, b11, a11 := src.At(b.Min.X+x1, b.Min.Y+y1).RGBA()
+
+			dst.SetRGBA(x, y, color.RGBA{
+				R: interpolate(r00, r10, r01, r11, fx, fy),
+				G: interpolate(g00, g10, g01, g11, fx, fy),
+				B: interpolate(b00, b10, b01, b11, fx, fy),
+				A: interpolate(a00, a10, a01, a11, fx, fy),
+			})
+		}
+	}
+
+	return dst
+}
+
+// sourcePixels returns the two neighbouring source pixels either side of the centre of destination
+// pixel i, when the source is ratio times larger, and how far the centre lies between them
+func sourcePixels(i int, ratio float64, size int) (int, int, float64) {
+	pos := (float64(i)+0.5)*ratio - 0.5
+	if pos < 0 {
+		pos = 0
+	}
+
+	p0 := int(pos)
+	if p0 > size-1 {
+		p0 = size - 1
+	}
+	p1 := p0 + 1
+	if p1 > size-1 {
+		p1 = size - 1
+	}
+
+	return p0, p1, pos - float64(p0)
+}
+
+// interpolate blends four 16 bit colour channels, weighting them by fx horizontally and fy
+// vertically, and returns the result as an 8 bit channel
+func interpolate(c00, c10, c01, c11 uint32, fx, fy float64) uint8 {
+	top := float64(c00)*(1-fx) + float64(c10)*fx
+	bottom := float64(c01)*(1-fx) + float64(c11)*fx
+	return uint8(math.Round((top*(1-fy) + bottom*fy) / 257))
+}
+
+// imageExtension returns the file extension for images of type fileType
+func imageExtension(fileType string) string {
+	switch fileType {
+	case "image/gif":
+		return ".gif"
+	case "image/jpeg":
+		return ".jpg"
+	default:
+		return ".png"
+	}
+}
+
+// encodeImage writes img to w in format, which is one of the names returned by image.Decode. JPEG
+// images are encoded with JPEGQuality
+func (t *Tools) encodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "gif":
+		return gif.Encode(w, img, nil)
+	case "jpeg":
+		quality := t.JPEGQuality
+		if quality <= 0 {
+			quality = jpeg.DefaultQuality
+		}
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	case "png":
+		return png.Encode(w, img)
+	default:
+		return fmt.Errorf("unable to encode images in %s format", format)
+	}
+}
@@ -0,0 +1,1004 @@
+package toolkit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestPNG returns a PNG encoded image of the given size
+func newTestPNG(t testing.TB, width, height int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var imageDimensionTests = []struct {
+	name          string
+	tools         Tools
+	width, height int
+	errorExpected bool
+	errorContains string
+}{
+	{name: "no limits", tools: Tools{}, width: 50, height: 50, errorExpected: false},
+	{name: "within limits", tools: Tools{MinImageWidth: 10, MinImageHeight: 10, MaxImageWidth: 100, MaxImageHeight: 100}, width: 50, height: 50, errorExpected: false},
+	{name: "exactly at limits", tools: Tools{MinImageWidth: 50, MaxImageHeight: 60}, width: 50, height: 60, errorExpected: false},
+	{name: "too narrow", tools: Tools{MinImageWidth: 100}, width: 50, height: 50, errorExpected: true, errorContains: "width"},
+	{name: "too wide", tools: Tools{MaxImageWidth: 40}, width: 50, height: 50, errorExpected: true, errorContains: "width"},
+	{name: "too short", tools: Tools{MinImageHeight: 100}, width: 50, height: 50, errorExpected: true, errorContains: "height"},
+	{name: "too tall", tools: Tools{MaxImageHeight: 40}, width: 50, height: 50, errorExpected: true, errorContains: "height"},
+}
+
+func TestTools_UploadFiles_ImageDimensions(t *testing.T) {
+	for _, e := range imageDimensionTests {
+		content := newTestPNG(t, e.width, e.height)
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "image.png", content: content})
+
+		testTools := e.tools
+		target := &memoryTarget{}
+		uploadedFiles, err := testTools.UploadFilesTo(req, target, true)
+
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", e.name)
+			} else if !strings.Contains(err.Error(), e.errorContains) {
+				t.Errorf("%s: expected the error to mention %s, but got %q", e.name, e.errorContains, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		// the bytes read to find the dimensions must still be saved
+		if saved := target.files[uploadedFiles[0].NewFileName]; !bytes.Equal(saved, content) {
+			t.Errorf("%s: the saved image does not match the one uploaded", e.name)
+		}
+	}
+}
+
+func TestTools_UploadFiles_ImageDimensionsFormats(t *testing.T) {
+	jpegContent, err := os.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(jpegContent))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gifContent bytes.Buffer
+	if err := gif.Encode(&gifContent, image.NewPaletted(image.Rect(0, 0, 100, 100), palette.Plan9), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// an avatar must be between 200x200 and 8000x8000 pixels
+	avatar := Tools{MinImageWidth: 200, MinImageHeight: 200, MaxImageWidth: 8000, MaxImageHeight: 8000}
+
+	var formatTests = []struct {
+		name       string
+		tools      Tools
+		fileName   string
+		content    []byte
+		dimensions string
+	}{
+		{name: "png", tools: avatar, fileName: "small.png", content: newTestPNG(t, 100, 150), dimensions: "100x150"},
+		{name: "jpeg", tools: Tools{MaxImageWidth: config.Width - 1}, fileName: "pic.jpg", content: jpegContent, dimensions: fmt.Sprintf("%dx%d", config.Width, config.Height)},
+		{name: "gif", tools: avatar, fileName: "small.gif", content: gifContent.Bytes(), dimensions: "100x100"},
+	}
+
+	for _, e := range formatTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: e.content})
+
+		testTools := e.tools
+		_, err := testTools.UploadFilesTo(req, &memoryTarget{}, true)
+		if err == nil {
+			t.Errorf("%s: expected the image to be rejected, but it was not", e.name)
+			continue
+		}
+
+		// the error names the actual dimensions
+		if !strings.Contains(err.Error(), e.dimensions) {
+			t.Errorf("%s: expected the error to mention %s, but got %q", e.name, e.dimensions, err)
+		}
+	}
+
+	// an image of the right size is saved intact, including the bytes read to find its dimensions
+	content := newTestPNG(t, 300, 300)
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "avatar.png", content: content})
+
+	target := &memoryTarget{}
+
+	uploadedFiles, err := avatar.UploadFilesTo(req, target, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(target.files[uploadedFiles[0].NewFileName], content) {
+		t.Error("the saved image does not match the one uploaded")
+	}
+}
+
+// webpContent is the start of a WebP image, which is detected as image/webp, but which the standard
+// library can't decode
+var webpContent = []byte("RIFF\x24\x00\x00\x00WEBPVP8 \x18\x00\x00\x00")
+
+func TestTools_UploadFiles_ImageDimensionsNotDecodable(t *testing.T) {
+	var notDecodableTests = []struct {
+		name     string
+		fileName string
+		content  []byte
+	}{
+		{name: "not an image", fileName: "notes.txt", content: []byte("hello, world")},
+		{name: "webp", fileName: "image.webp", content: webpContent},
+		{name: "bmp", fileName: "image.bmp", content: []byte("BM\x3a\x00\x00\x00\x00\x00\x00\x00\x36\x00\x00\x00")},
+	}
+
+	testTools := Tools{MinImageWidth: 100, MinImageHeight: 100, MaxImageWidth: 8000, MaxImageHeight: 8000}
+
+	for _, e := range notDecodableTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: e.content})
+
+		if _, err := testTools.UploadFilesTo(req, &memoryTarget{}, false); err != nil {
+			t.Errorf("%s: dimension limits should apply only to GIF, JPEG and PNG images: %s", e.name, err)
+		}
+	}
+}
+
+func TestTools_UploadFiles_ImageHeaderTooLarge(t *testing.T) {
+	// a JPEG image whose dimensions come only after more than maxImageHeaderSize bytes of metadata
+	content := []byte{0xff, 0xd8}
+	segment := append([]byte{0xff, 0xe1, 0xff, 0xff}, make([]byte, 0xffff-2)...)
+	for len(content) <= maxImageHeaderSize {
+		content = append(content, segment...)
+	}
+
+	for _, testTools := range []Tools{{MaxImageWidth: 8000}, {AllowedImageFormats: []string{"jpeg"}}, {ResizeImages: true, ImageMaxWidth: 100}} {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "image.jpg", content: content})
+
+		_, err := testTools.UploadFilesTo(req, &memoryTarget{}, false)
+		if err == nil || !strings.Contains(err.Error(), "no dimensions found") {
+			t.Errorf("expected an error for an image whose header is too large, but got %v", err)
+		}
+	}
+}
+
+// newHugePNG returns a small PNG encoded image which claims to be width by height pixels
+func newHugePNG(t testing.TB, width, height uint32) []byte {
+	content := newTestPNG(t, 10, 10)
+
+	// the IHDR chunk follows the 8 byte signature, and its data starts with the dimensions
+	binary.BigEndian.PutUint32(content[16:], width)
+	binary.BigEndian.PutUint32(content[20:], height)
+	binary.BigEndian.PutUint32(content[29:], crc32.ChecksumIEEE(content[12:29]))
+	return content
+}
+
+func TestTools_UploadFiles_MaxImagePixels(t *testing.T) {
+	var pixelTests = []struct {
+		name          string
+		tools         Tools
+		content       []byte
+		errorExpected bool
+	}{
+		{name: "resize", tools: Tools{ResizeImages: true, ImageMaxWidth: 100}, content: newHugePNG(t, 50000, 50000), errorExpected: true},
+		{name: "convert", tools: Tools{ConvertImagesTo: "jpeg"}, content: newHugePNG(t, 50000, 50000), errorExpected: true},
+		{name: "thumbnail", tools: Tools{GenerateThumbnails: true, ThumbnailStrict: true}, content: newHugePNG(t, 50000, 50000), errorExpected: true},
+		{name: "limit set", tools: Tools{ResizeImages: true, ImageMaxWidth: 10, MaxImagePixels: 399}, content: newTestPNG(t, 20, 20), errorExpected: true},
+		{name: "within the limit", tools: Tools{ResizeImages: true, ImageMaxWidth: 10, MaxImagePixels: 400}, content: newTestPNG(t, 20, 20), errorExpected: false},
+		{name: "no limit", tools: Tools{ResizeImages: true, ImageMaxWidth: 10, MaxImagePixels: -1}, content: newTestPNG(t, 20, 20), errorExpected: false},
+		{name: "not decoded", tools: Tools{}, content: newHugePNG(t, 50000, 50000), errorExpected: false},
+	}
+
+	for _, e := range pixelTests {
+		testTools := e.tools
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "image.png", content: e.content})
+
+		_, err := testTools.UploadFilesTo(req, &memoryTarget{}, false)
+		if e.errorExpected {
+			if err == nil || !strings.Contains(err.Error(), "pixels") {
+				t.Errorf("%s: expected an error for too many pixels, but got %v", e.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+	}
+}
+
+func TestTools_UploadFiles_AllowedImageFormats(t *testing.T) {
+	jpegContent, err := os.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a PNG signature in front of a JPEG body is detected as image/png
+	spoofed := append([]byte("\x89PNG\r\n\x1a\n"), jpegContent...)
+
+	var formatTests = []struct {
+		name          string
+		formats       []string
+		fileName      string
+		content       []byte
+		errorExpected bool
+	}{
+		{name: "no formats", formats: nil, fileName: "pic.jpg", content: jpegContent, errorExpected: false},
+		{name: "allowed", formats: []string{"jpeg", "png"}, fileName: "pic.jpg", content: jpegContent, errorExpected: false},
+		{name: "alias", formats: []string{"JPG"}, fileName: "pic.jpg", content: jpegContent, errorExpected: false},
+		{name: "content type", formats: []string{"image/png"}, fileName: "image.png", content: newTestPNG(t, 10, 10), errorExpected: false},
+		{name: "not allowed", formats: []string{"png"}, fileName: "pic.jpg", content: jpegContent, errorExpected: true},
+		{name: "spoofed", formats: []string{"png"}, fileName: "pic.png", content: spoofed, errorExpected: true},
+		{name: "not an image", formats: []string{"png"}, fileName: "notes.txt", content: []byte("hello, world"), errorExpected: false},
+		{name: "webp allowed", formats: []string{"png", "webp"}, fileName: "image.webp", content: webpContent, errorExpected: false},
+		{name: "webp not allowed", formats: []string{"png"}, fileName: "image.webp", content: webpContent, errorExpected: true},
+	}
+
+	for _, e := range formatTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: e.content})
+
+		testTools := Tools{AllowedImageFormats: e.formats}
+		target := &memoryTarget{}
+		uploadedFiles, err := testTools.UploadFilesTo(req, target, true)
+
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", e.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		// the bytes read to find the format must still be saved
+		if saved := target.files[uploadedFiles[0].NewFileName]; !bytes.Equal(saved, e.content) {
+			t.Errorf("%s: the saved file does not match the one uploaded", e.name)
+		}
+	}
+}
+
+// withJPEGSegment returns the JPEG image img with a segment, of type marker and containing data,
+// inserted after its start of image marker
+func withJPEGSegment(img []byte, marker byte, data string) []byte {
+	segment := []byte{0xff, marker, byte((len(data) + 2) >> 8), byte(len(data) + 2)}
+	segment = append(segment, data...)
+
+	out := append([]byte{}, img[:2]...)
+	out = append(out, segment...)
+	return append(out, img[2:]...)
+}
+
+// withPNGChunk returns the PNG image img with a chunk, of type kind and containing data, inserted
+// after its header chunk
+func withPNGChunk(img []byte, kind, data string) []byte {
+	chunk := make([]byte, 4, 12+len(data))
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	chunk = append(chunk, kind...)
+	chunk = append(chunk, data...)
+	chunk = append(chunk, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(chunk[len(chunk)-4:], crc32.ChecksumIEEE(chunk[4:len(chunk)-4]))
+
+	// the signature is 8 bytes, and the header chunk 25
+	out := append([]byte{}, img[:33]...)
+	out = append(out, chunk...)
+	return append(out, img[33:]...)
+}
+
+func TestTools_UploadFiles_StripImageMetadata(t *testing.T) {
+	jpegContent, err := os.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exif := withJPEGSegment(jpegContent, 0xe1, "Exif\x00\x00MM\x00*GPSLatitude")
+	exif = withJPEGSegment(exif, 0xfe, "a comment")
+	text := withPNGChunk(newTestPNG(t, 20, 10), "tEXt", "GPSLatitude\x0051.5")
+
+	var stripTests = []struct {
+		name     string
+		fileName string
+		content  []byte
+		original []byte
+	}{
+		{name: "jpeg", fileName: "pic.jpg", content: exif, original: jpegContent},
+		{name: "png", fileName: "image.png", content: text, original: newTestPNG(t, 20, 10)},
+		{name: "not an image", fileName: "notes.txt", content: []byte("GPSLatitude 51.5"), original: []byte("GPSLatitude 51.5")},
+	}
+
+	for _, e := range stripTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: e.content})
+
+		testTools := Tools{StripImageMetadata: true}
+		target := &memoryTarget{}
+
+		uploadedFiles, err := testTools.UploadFilesTo(req, target, false)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		saved := target.files[uploadedFiles[0].NewFileName]
+
+		if e.name == "not an image" {
+			if !bytes.Equal(saved, e.content) {
+				t.Errorf("%s: expected the file to be saved untouched", e.name)
+			}
+			continue
+		}
+
+		if bytes.Contains(saved, []byte("Exif")) || bytes.Contains(saved, []byte("GPSLatitude")) || bytes.Contains(saved, []byte("a comment")) {
+			t.Errorf("%s: the saved image still contains its metadata", e.name)
+		}
+
+		// the image itself is not re-encoded
+		if !bytes.Equal(saved, e.original) {
+			t.Errorf("%s: expected only the metadata to be removed from the saved image", e.name)
+		}
+
+		if uploadedFiles[0].FileSize != int64(len(saved)) {
+			t.Errorf("%s: expected the file size to be %d, but got %d", e.name, len(saved), uploadedFiles[0].FileSize)
+		}
+	}
+}
+
+func TestStripJPEGMetadata_Invalid(t *testing.T) {
+	jpegContent, err := os.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, img := range [][]byte{nil, []byte("not a jpeg"), jpegContent[:20], withJPEGSegment(jpegContent[:2], 0xe1, "Exif")[:6]} {
+		if _, err := stripJPEGMetadata(img); err == nil {
+			t.Errorf("expected an error stripping %q, but none received", img)
+		}
+	}
+}
+
+var resizeTests = []struct {
+	name                    string
+	maxWidth, maxHeight     int
+	width, height           int
+	finalWidth, finalHeight int
+}{
+	{name: "fits", maxWidth: 100, maxHeight: 100, width: 80, height: 60, finalWidth: 80, finalHeight: 60},
+	{name: "too wide", maxWidth: 100, maxHeight: 100, width: 200, height: 50, finalWidth: 100, finalHeight: 25},
+	{name: "too tall", maxWidth: 100, maxHeight: 100, width: 50, height: 400, finalWidth: 13, finalHeight: 100},
+	{name: "too wide and tall", maxWidth: 100, maxHeight: 100, width: 300, height: 200, finalWidth: 100, finalHeight: 67},
+	{name: "width only", maxWidth: 40, width: 80, height: 200, finalWidth: 40, finalHeight: 100},
+	{name: "height only", maxHeight: 40, width: 80, height: 200, finalWidth: 16, finalHeight: 40},
+}
+
+func TestTools_UploadFiles_ResizeImages(t *testing.T) {
+	for _, e := range resizeTests {
+		content := newTestPNG(t, e.width, e.height)
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "image.png", content: content})
+
+		testTools := Tools{ResizeImages: true, ImageMaxWidth: e.maxWidth, ImageMaxHeight: e.maxHeight}
+		target := &memoryTarget{}
+
+		uploadedFiles, err := testTools.UploadFilesTo(req, target, true)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+		uploadedFile := uploadedFiles[0]
+
+		if uploadedFile.OriginalWidth != e.width || uploadedFile.OriginalHeight != e.height {
+			t.Errorf("%s: wrong original size; expected %dx%d, but got %dx%d", e.name, e.width, e.height, uploadedFile.OriginalWidth, uploadedFile.OriginalHeight)
+		}
+
+		if uploadedFile.FinalWidth != e.finalWidth || uploadedFile.FinalHeight != e.finalHeight {
+			t.Errorf("%s: wrong final size; expected %dx%d, but got %dx%d", e.name, e.finalWidth, e.finalHeight, uploadedFile.FinalWidth, uploadedFile.FinalHeight)
+		}
+
+		saved := target.files[uploadedFile.NewFileName]
+		config, format, err := image.DecodeConfig(bytes.NewReader(saved))
+		if err != nil {
+			t.Errorf("%s: the saved image could not be decoded: %s", e.name, err)
+			continue
+		}
+
+		if format != "png" || config.Width != e.finalWidth || config.Height != e.finalHeight {
+			t.Errorf("%s: expected a %dx%d png to be saved, but got a %dx%d %s", e.name, e.finalWidth, e.finalHeight, config.Width, config.Height, format)
+		}
+
+		if uploadedFile.FileSize != int64(len(saved)) {
+			t.Errorf("%s: expected the file size to be %d, but got %d", e.name, len(saved), uploadedFile.FileSize)
+		}
+	}
+}
+
+func TestTools_UploadFiles_ResizeImagesPassThrough(t *testing.T) {
+	pngContent := newTestPNG(t, 300, 200)
+
+	var passTests = []struct {
+		name     string
+		tools    Tools
+		fileName string
+		content  []byte
+	}{
+		{name: "not an image", tools: Tools{ResizeImages: true, ImageMaxWidth: 10, ImageMaxHeight: 10}, fileName: "notes.txt", content: []byte("hello, world")},
+		{name: "no limits", tools: Tools{ResizeImages: true}, fileName: "image.png", content: pngContent},
+		{name: "not enabled", tools: Tools{ImageMaxWidth: 10, ImageMaxHeight: 10}, fileName: "image.png", content: pngContent},
+	}
+
+	for _, e := range passTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: e.content})
+
+		testTools := e.tools
+		target := &memoryTarget{}
+
+		uploadedFiles, err := testTools.UploadFilesTo(req, target, true)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		if saved := target.files[uploadedFiles[0].NewFileName]; !bytes.Equal(saved, e.content) {
+			t.Errorf("%s: expected the file to be saved untouched", e.name)
+		}
+	}
+
+	// the type is checked before anything is decoded, so a disallowed image which is not even valid
+	// is rejected for its type
+	testTools := Tools{AllowedFileType: []string{"image/jpeg"}, ResizeImages: true, ImageMaxWidth: 10}
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "broken.png", content: pngContent[:40]})
+
+	_, err := testTools.UploadFilesTo(req, &memoryTarget{}, true)
+	if err == nil || !strings.Contains(err.Error(), "type is not permitted") {
+		t.Errorf("expected the upload to be rejected for its type, but got %v", err)
+	}
+}
+
+func TestTools_UploadFiles_ResizedChecksum(t *testing.T) {
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "image.png", content: newTestPNG(t, 300, 200)})
+
+	testTools := Tools{ResizeImages: true, ImageMaxWidth: 30}
+	target := &memoryTarget{}
+
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the checksum is of the bytes saved, not those uploaded, so it can be used to verify the file
+	sum := sha256.Sum256(target.files[uploadedFiles[0].NewFileName])
+	if uploadedFiles[0].Checksum != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the checksum of the resized image, %x, but got %s", sum, uploadedFiles[0].Checksum)
+	}
+}
+
+func TestTools_UploadFiles_ResizeJPEG(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTools := Tools{ResizeImages: true, ImageMaxWidth: 50, ImageMaxHeight: 50}
+	target := &memoryTarget{}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "pic.jpg", content: content})
+
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, format, err := image.DecodeConfig(bytes.NewReader(target.files[uploadedFiles[0].NewFileName]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if format != "jpeg" || config.Width > 50 || config.Height > 50 {
+		t.Errorf("expected a jpeg no larger than 50x50, but got a %dx%d %s", config.Width, config.Height, format)
+	}
+}
+
+func TestResizeBilinear(t *testing.T) {
+	// a left half black, right half white image should blend to grey in the middle
+	src := image.NewRGBA(image.Rect(0, 0, 4, 1))
+	for x := 0; x < 4; x++ {
+		c := color.RGBA{A: 255}
+		if x >= 2 {
+			c = color.RGBA{R: 255, G: 255, B: 255, A: 255}
+		}
+		src.SetRGBA(x, 0, c)
+	}
+
+	dst := resizeBilinear(src, 2, 1)
+
+	if got := dst.RGBAAt(0, 0); got.R != 0 || got.A != 255 {
+		t.Errorf("expected the left pixel to be black, but got %v", got)
+	}
+
+	if got := dst.RGBAAt(1, 0); got.R != 255 || got.A != 255 {
+		t.Errorf("expected the right pixel to be white, but got %v", got)
+	}
+
+	dst = resizeBilinear(src, 1, 1)
+	if got := dst.RGBAAt(0, 0); got.R < 100 || got.R > 155 {
+		t.Errorf("expected a single pixel to be grey, but got %v", got)
+	}
+}
+
+func TestApplyOrientation(t *testing.T) {
+	// a 3x2 image whose pixels are numbered 0 to 5, left to right and top to bottom
+	src := image.NewGray(image.Rect(0, 0, 3, 2))
+	for i := range src.Pix {
+		src.Pix[i] = uint8(i)
+	}
+
+	var orientationTests = []struct {
+		orientation int
+		expected    [][]uint8
+	}{
+		{orientation: 0, expected: [][]uint8{{0, 1, 2}, {3, 4, 5}}},
+		{orientation: 1, expected: [][]uint8{{0, 1, 2}, {3, 4, 5}}},
+		{orientation: 2, expected: [][]uint8{{2, 1, 0}, {5, 4, 3}}},
+		{orientation: 3, expected: [][]uint8{{5, 4, 3}, {2, 1, 0}}},
+		{orientation: 4, expected: [][]uint8{{3, 4, 5}, {0, 1, 2}}},
+		{orientation: 5, expected: [][]uint8{{0, 3}, {1, 4}, {2, 5}}},
+		{orientation: 6, expected: [][]uint8{{3, 0}, {4, 1}, {5, 2}}},
+		{orientation: 7, expected: [][]uint8{{5, 2}, {4, 1}, {3, 0}}},
+		{orientation: 8, expected: [][]uint8{{2, 5}, {1, 4}, {0, 3}}},
+		{orientation: 9, expected: [][]uint8{{0, 1, 2}, {3, 4, 5}}},
+	}
+
+	for _, e := range orientationTests {
+		dst := applyOrientation(src, e.orientation)
+
+		b := dst.Bounds()
+		if b.Dx() != len(e.expected[0]) || b.Dy() != len(e.expected) {
+			t.Errorf("%d: expected a %dx%d image, but got %dx%d", e.orientation, len(e.expected[0]), len(e.expected), b.Dx(), b.Dy())
+			continue
+		}
+
+		for y, row := range e.expected {
+			for x, pixel := range row {
+				if got := color.GrayModel.Convert(dst.At(x, y)).(color.Gray).Y; got != pixel {
+					t.Errorf("%d: expected pixel %d at %d,%d, but got %d", e.orientation, pixel, x, y, got)
+				}
+			}
+		}
+	}
+}
+
+// newTestJPEG returns a width by height JPEG image with the EXIF orientation, if it is not 0
+func newTestJPEG(t testing.TB, width, height, orientation int) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height)), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	img := buf.Bytes()
+	if orientation != 0 {
+		segment := exifOrientationSegment(orientation)
+		img = withJPEGSegment(img, 0xe1, string(segment[4:]))
+	}
+	return img
+}
+
+// orientationAndGPS is EXIF data, recorded little endian, giving an orientation of 6 after another
+// tag, followed by a location
+const orientationAndGPS = "Exif\x00\x00II*\x00\x08\x00\x00\x00\x02\x00" +
+	"\x0f\x01\x02\x00\x01\x00\x00\x00\x00\x00\x00\x00" +
+	"\x12\x01\x03\x00\x01\x00\x00\x00\x06\x00\x00\x00" +
+	"\x00\x00\x00\x00GPSLatitude"
+
+func TestJPEGOrientation(t *testing.T) {
+
+	var orientationTests = []struct {
+		name     string
+		img      []byte
+		expected int
+	}{
+		{name: "none", img: newTestJPEG(t, 4, 2, 0), expected: 1},
+		{name: "big endian", img: newTestJPEG(t, 4, 2, 6), expected: 6},
+		{name: "little endian", img: withJPEGSegment(newTestJPEG(t, 4, 2, 0), 0xe1, orientationAndGPS), expected: 6},
+		{name: "out of range", img: newTestJPEG(t, 4, 2, 9), expected: 1},
+		{name: "without orientation", img: withJPEGSegment(newTestJPEG(t, 4, 2, 0), 0xe1, "Exif\x00\x00MM\x00*\x00\x00\x00\x08\x00\x00"), expected: 1},
+		{name: "truncated", img: withJPEGSegment(newTestJPEG(t, 4, 2, 0), 0xe1, "Exif\x00\x00MM\x00*\x00\x00\xff\xff"), expected: 1},
+		{name: "not a jpeg", img: []byte("not a jpeg"), expected: 1},
+	}
+
+	for _, e := range orientationTests {
+		if got := jpegOrientation(e.img); got != e.expected {
+			t.Errorf("%s: expected orientation %d, but got %d", e.name, e.expected, got)
+		}
+	}
+}
+
+func TestTools_UploadFiles_ImageOrientation(t *testing.T) {
+	// a 40x20 image, which is displayed turned on its side as 20x40
+	content := newTestJPEG(t, 40, 20, 6)
+
+	var orientationTests = []struct {
+		name           string
+		tools          Tools
+		expectedWidth  int
+		expectedHeight int
+	}{
+		{name: "converted", tools: Tools{ConvertImagesTo: "png"}, expectedWidth: 20, expectedHeight: 40},
+		{name: "resized", tools: Tools{ResizeImages: true, ImageMaxWidth: 10}, expectedWidth: 10, expectedHeight: 20},
+		// resizing to fit 30x30 would not be needed if the image were not turned
+		{name: "resized once turned", tools: Tools{ResizeImages: true, ImageMaxHeight: 30}, expectedWidth: 15, expectedHeight: 30},
+	}
+
+	for _, e := range orientationTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "photo.jpg", content: content})
+		target := &memoryTarget{}
+
+		uploadedFiles, err := e.tools.UploadFilesTo(req, target, false)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		saved := target.files[uploadedFiles[0].NewFileName]
+		config, _, err := image.DecodeConfig(bytes.NewReader(saved))
+		if err != nil {
+			t.Errorf("%s: unable to decode the saved image: %s", e.name, err)
+			continue
+		}
+
+		if config.Width != e.expectedWidth || config.Height != e.expectedHeight {
+			t.Errorf("%s: expected a %dx%d image, but got %dx%d", e.name, e.expectedWidth, e.expectedHeight, config.Width, config.Height)
+		}
+
+		// the orientation has been applied, so must not be applied again
+		if o := jpegOrientation(saved); o != 1 {
+			t.Errorf("%s: expected the saved image to have no orientation, but got %d", e.name, o)
+		}
+
+		if uploadedFiles[0].OriginalWidth != 20 || uploadedFiles[0].OriginalHeight != 40 {
+			t.Errorf("%s: expected the original size to be 20x40, but got %dx%d", e.name, uploadedFiles[0].OriginalWidth, uploadedFiles[0].OriginalHeight)
+		}
+	}
+
+	// the thumbnail is turned too
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "photo.jpg", content: content})
+	target := &memoryTarget{}
+
+	testTools := Tools{GenerateThumbnails: true, ThumbnailWidth: 10, ThumbnailHeight: 10}
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := jpeg.DecodeConfig(bytes.NewReader(target.files[uploadedFiles[0].ThumbnailFileName]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Width != 5 || config.Height != 10 {
+		t.Errorf("expected a 5x10 thumbnail, but got %dx%d", config.Width, config.Height)
+	}
+
+	// stripping the metadata keeps the orientation, and only the orientation
+	gps := withJPEGSegment(newTestJPEG(t, 40, 20, 0), 0xe1, orientationAndGPS)
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "photo.jpg", content: gps})
+	target = &memoryTarget{}
+
+	testTools = Tools{StripImageMetadata: true}
+	uploadedFiles, err = testTools.UploadFilesTo(req, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := target.files[uploadedFiles[0].NewFileName]
+	if o := jpegOrientation(saved); o != 6 {
+		t.Errorf("expected the stripped image to keep orientation 6, but got %d", o)
+	}
+	if bytes.Contains(saved, []byte("GPSLatitude")) {
+		t.Error("the stripped image still contains its metadata")
+	}
+	if _, err := jpeg.DecodeConfig(bytes.NewReader(saved)); err != nil {
+		t.Errorf("unable to decode the stripped image: %s", err)
+	}
+}
+
+func TestTools_UploadFiles_GenerateThumbnails(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	content := newTestPNG(t, 400, 200)
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "photo.png", content: content})
+
+	testTools := Tools{GenerateThumbnails: true, ThumbnailWidth: 100, ThumbnailHeight: 100}
+
+	uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeUploadedFiles(DiskTarget{Dir: uploadFolder}, uploadedFiles)
+
+	if uploadedFiles[0].ThumbnailFileName != "photo_thumb.png" {
+		t.Fatalf("expected the thumbnail to be photo_thumb.png, but got %q", uploadedFiles[0].ThumbnailFileName)
+	}
+
+	f, err := os.Open(filepath.Join(uploadFolder, "photo_thumb.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	config, err := png.DecodeConfig(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Width != 100 || config.Height != 50 {
+		t.Errorf("expected a 100x50 thumbnail, but got %dx%d", config.Width, config.Height)
+	}
+
+	// files which are not images have no thumbnail
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "notes.txt", content: []byte("hello, world")})
+
+	target := &memoryTarget{}
+	uploadedFiles, err = testTools.UploadFilesTo(req, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFiles[0].ThumbnailFileName != "" || len(target.files) != 1 {
+		t.Errorf("expected no thumbnail for a text file, but got %q", uploadedFiles[0].ThumbnailFileName)
+	}
+}
+
+func TestTools_UploadFiles_ThumbnailOfResizedImage(t *testing.T) {
+	content := newTestPNG(t, 1000, 1000)
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "photo.png", content: content})
+
+	testTools := Tools{ResizeImages: true, ImageMaxWidth: 500, GenerateThumbnails: true}
+	target := &memoryTarget{}
+
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	thumb, ok := target.files[uploadedFiles[0].ThumbnailFileName]
+	if !ok {
+		t.Fatal("expected a thumbnail to have been saved")
+	}
+
+	config, err := png.DecodeConfig(bytes.NewReader(thumb))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if config.Width != 150 || config.Height != 150 {
+		t.Errorf("expected a 150x150 thumbnail by default, but got %dx%d", config.Width, config.Height)
+	}
+}
+
+var thumbnailTests = []struct {
+	name                    string
+	tools                   Tools
+	width, height           int
+	thumbName               string
+	thumbWidth, thumbHeight int
+}{
+	{name: "fit", tools: Tools{ThumbnailWidth: 100, ThumbnailHeight: 100}, width: 400, height: 200, thumbName: "photo_thumb.png", thumbWidth: 100, thumbHeight: 50},
+	{name: "crop wide", tools: Tools{ThumbnailWidth: 100, ThumbnailHeight: 100, ThumbnailCrop: true}, width: 400, height: 200, thumbName: "photo_thumb.png", thumbWidth: 100, thumbHeight: 100},
+	{name: "crop tall", tools: Tools{ThumbnailWidth: 80, ThumbnailHeight: 40, ThumbnailCrop: true}, width: 200, height: 400, thumbName: "photo_thumb.png", thumbWidth: 80, thumbHeight: 40},
+	{name: "suffix", tools: Tools{ThumbnailSuffix: "-small"}, width: 300, height: 300, thumbName: "photo-small.png", thumbWidth: 150, thumbHeight: 150},
+}
+
+func TestTools_UploadFiles_ThumbnailOptions(t *testing.T) {
+	for _, e := range thumbnailTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "photo.png", content: newTestPNG(t, e.width, e.height)})
+
+		testTools := e.tools
+		testTools.GenerateThumbnails = true
+		target := &memoryTarget{}
+
+		uploadedFiles, err := testTools.UploadFilesTo(req, target, false)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		if uploadedFiles[0].ThumbnailFileName != e.thumbName {
+			t.Errorf("%s: expected the thumbnail to be %s, but got %q", e.name, e.thumbName, uploadedFiles[0].ThumbnailFileName)
+			continue
+		}
+
+		config, err := png.DecodeConfig(bytes.NewReader(target.files[e.thumbName]))
+		if err != nil {
+			t.Errorf("%s: %s", e.name, err)
+			continue
+		}
+
+		if config.Width != e.thumbWidth || config.Height != e.thumbHeight {
+			t.Errorf("%s: expected a %dx%d thumbnail, but got %dx%d", e.name, e.thumbWidth, e.thumbHeight, config.Width, config.Height)
+		}
+	}
+}
+
+// thumbnailFailingTarget is a memoryTarget which can't save thumbnails
+type thumbnailFailingTarget struct {
+	memoryTarget
+}
+
+func (f *thumbnailFailingTarget) Save(name string, r io.Reader) (int64, error) {
+	if strings.Contains(name, "_thumb") {
+		return 0, errors.New("no room for thumbnails")
+	}
+	return f.memoryTarget.Save(name, r)
+}
+
+func TestTools_UploadFiles_ThumbnailStrict(t *testing.T) {
+	content := newTestPNG(t, 300, 300)
+
+	// by default, a thumbnail which can't be saved doesn't stop the upload
+	testTools := Tools{GenerateThumbnails: true}
+	target := &thumbnailFailingTarget{}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "photo.png", content: content})
+
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, false)
+	if err != nil {
+		t.Fatalf("expected the upload to succeed without its thumbnail, but got %s", err)
+	}
+	if uploadedFiles[0].ThumbnailFileName != "" {
+		t.Errorf("expected no thumbnail, but got %s", uploadedFiles[0].ThumbnailFileName)
+	}
+
+	// in strict mode it does, and the image is removed
+	testTools.ThumbnailStrict = true
+	target = &thumbnailFailingTarget{}
+
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "photo.png", content: content})
+
+	if _, err := testTools.UploadFilesTo(req, target, false); err == nil {
+		t.Error("expected an error in strict mode, but none received")
+	}
+	if len(target.files) != 0 {
+		t.Errorf("expected the image to be removed, but found %d files", len(target.files))
+	}
+}
+
+// newTestGIF returns a GIF encoded image of the given size with the given number of frames
+func newTestGIF(t *testing.T, width, height, frames int) []byte {
+	t.Helper()
+
+	animation := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		frame := image.NewPaletted(image.Rect(0, 0, width, height), palette.Plan9)
+		frame.SetColorIndex(i%width, 0, uint8(i+1))
+		animation.Image = append(animation.Image, frame)
+		animation.Delay = append(animation.Delay, 10)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTools_UploadFiles_ConvertImages(t *testing.T) {
+	jpegContent, err := os.ReadFile(filepath.Join("testdata", "pic.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pngContent := newTestPNG(t, 20, 10)
+	stillGIF := newTestGIF(t, 20, 10, 1)
+	animatedGIF := newTestGIF(t, 20, 10, 3)
+
+	var convertTests = []struct {
+		name          string
+		tools         Tools
+		fileName      string
+		content       []byte
+		newFileName   string
+		fileType      string
+		format        string
+		frames        int
+		errorExpected bool
+	}{
+		{name: "png to jpeg", tools: Tools{ConvertImagesTo: "jpeg"}, fileName: "photo.png", content: pngContent, newFileName: "photo.jpg", fileType: "image/jpeg", format: "jpeg"},
+		{name: "jpeg to png", tools: Tools{ConvertImagesTo: "png"}, fileName: "pic.jpg", content: jpegContent, newFileName: "pic.png", fileType: "image/png", format: "png"},
+		{name: "gif to png", tools: Tools{ConvertImagesTo: "PNG"}, fileName: "still.gif", content: stillGIF, newFileName: "still.png", fileType: "image/png", format: "png"},
+		{name: "already png", tools: Tools{ConvertImagesTo: "png"}, fileName: "photo.png", content: pngContent, newFileName: "photo.png", fileType: "image/png", format: "png"},
+		{name: "animated gif rejected", tools: Tools{ConvertImagesTo: "png"}, fileName: "moving.gif", content: animatedGIF, errorExpected: true},
+		{name: "animated gif kept", tools: Tools{ConvertImagesTo: "png", KeepAnimatedGIFs: true}, fileName: "moving.gif", content: animatedGIF, newFileName: "moving.gif", fileType: "image/gif", format: "gif", frames: 3},
+		{name: "animated gif not resized", tools: Tools{ResizeImages: true, ImageMaxWidth: 10}, fileName: "moving.gif", content: animatedGIF, errorExpected: true},
+		{name: "animated gif kept unresized", tools: Tools{ResizeImages: true, ImageMaxWidth: 10, KeepAnimatedGIFs: true}, fileName: "moving.gif", content: animatedGIF, newFileName: "moving.gif", fileType: "image/gif", format: "gif", frames: 3},
+		{name: "still gif resized", tools: Tools{ResizeImages: true, ImageMaxWidth: 10}, fileName: "still.gif", content: stillGIF, newFileName: "still.gif", fileType: "image/gif", format: "gif", frames: 1},
+		{name: "unsupported format", tools: Tools{ConvertImagesTo: "webp"}, fileName: "photo.png", content: pngContent, errorExpected: true},
+		{name: "resized and converted", tools: Tools{ConvertImagesTo: "jpeg", ResizeImages: true, ImageMaxWidth: 10}, fileName: "photo.png", content: pngContent, newFileName: "photo.jpg", fileType: "image/jpeg", format: "jpeg"},
+	}
+
+	for _, e := range convertTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: e.content})
+
+		testTools := e.tools
+		target := &memoryTarget{}
+
+		uploadedFiles, err := testTools.UploadFilesTo(req, target, false)
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		uploadedFile := uploadedFiles[0]
+		if uploadedFile.NewFileName != e.newFileName || uploadedFile.FileType != e.fileType {
+			t.Errorf("%s: expected %s of type %s, but got %s of type %s", e.name, e.newFileName, e.fileType, uploadedFile.NewFileName, uploadedFile.FileType)
+		}
+
+		saved := target.files[uploadedFile.NewFileName]
+		_, format, err := image.DecodeConfig(bytes.NewReader(saved))
+		if err != nil || format != e.format {
+			t.Errorf("%s: expected a %s image to be saved, but got %s (%v)", e.name, e.format, format, err)
+		}
+
+		if e.frames > 0 {
+			animation, err := gif.DecodeAll(bytes.NewReader(saved))
+			if err != nil || len(animation.Image) != e.frames {
+				t.Errorf("%s: expected a gif of %d frames to be saved (%v)", e.name, e.frames, err)
+			}
+		}
+
+		// images which need no conversion are saved unchanged
+		if e.fileName == e.newFileName && !e.tools.ResizeImages && !bytes.Equal(saved, e.content) {
+			t.Errorf("%s: expected the image to be saved unchanged", e.name)
+		}
+	}
+}
+
+func TestTools_UploadFiles_JPEGQuality(t *testing.T) {
+	content, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var sizes []int64
+	for _, quality := range []int{10, 95} {
+		testTools := Tools{ConvertImagesTo: "jpeg", JPEGQuality: quality}
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: content})
+
+		uploadedFiles, err := testTools.UploadFilesTo(req, &memoryTarget{}, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, uploadedFiles[0].FileSize)
+	}
+
+	if sizes[0] >= sizes[1] {
+		t.Errorf("expected a lower quality to give a smaller file, but got %d bytes at 10 and %d at 95", sizes[0], sizes[1])
+	}
+}
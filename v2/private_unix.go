@@ -0,0 +1,25 @@
+//go:build !windows && !plan9
+
+package toolkit
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// checkPrivateDir returns an error unless the directory described by info belongs to the current
+// user, and no other user has any permission on it
+func checkPrivateDir(info os.FileInfo) error {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return errors.New("unable to find the owner of the directory")
+	}
+	if int(stat.Uid) != os.Geteuid() {
+		return errors.New("the directory belongs to another user")
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return errors.New("other users have permission to use the directory")
+	}
+	return nil
+}
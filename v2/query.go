@@ -0,0 +1,45 @@
+package toolkit
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// QueryString returns the value of the query parameter key in r, or def if it is missing or empty
+func (t *Tools) QueryString(r *http.Request, key string, def string) string {
+	value := r.URL.Query().Get(key)
+	if value == "" {
+		return def
+	}
+	return value
+}
+
+// QueryInt returns the query parameter key in r as an int, or def if it is missing or is not an int
+func (t *Tools) QueryInt(r *http.Request, key string, def int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+// QueryFloat returns the query parameter key in r as a float64, or def if it is missing or is not a
+// number. NaN and infinite values are treated as not being numbers
+func (t *Tools) QueryFloat(r *http.Request, key string, def float64) float64 {
+	value, err := strconv.ParseFloat(r.URL.Query().Get(key), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		return def
+	}
+	return value
+}
+
+// QueryBool returns the query parameter key in r as a bool, or def if it is missing or is not a
+// bool. The values accepted are those of strconv.ParseBool, such as 1, t, true, 0, f and false
+func (t *Tools) QueryBool(r *http.Request, key string, def bool) bool {
+	value, err := strconv.ParseBool(r.URL.Query().Get(key))
+	if err != nil {
+		return def
+	}
+	return value
+}
@@ -0,0 +1,50 @@
+package toolkit
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+var queryTests = []struct {
+	name       string
+	query      string
+	str        string
+	intValue   int
+	floatValue float64
+	boolValue  bool
+}{
+	{name: "missing", query: "", str: "def", intValue: 7, floatValue: 1.5, boolValue: true},
+	{name: "empty", query: "?v=", str: "def", intValue: 7, floatValue: 1.5, boolValue: true},
+	{name: "int", query: "?v=42", str: "42", intValue: 42, floatValue: 42, boolValue: true},
+	{name: "negative", query: "?v=-3", str: "-3", intValue: -3, floatValue: -3, boolValue: true},
+	{name: "float", query: "?v=2.25", str: "2.25", intValue: 7, floatValue: 2.25, boolValue: true},
+	{name: "bool", query: "?v=false", str: "false", intValue: 7, floatValue: 1.5, boolValue: false},
+	{name: "bool as number", query: "?v=0", str: "0", intValue: 0, floatValue: 0, boolValue: false},
+	{name: "malformed", query: "?v=12abc", str: "12abc", intValue: 7, floatValue: 1.5, boolValue: true},
+	{name: "int overflow", query: "?v=99999999999999999999", str: "99999999999999999999", intValue: 7, floatValue: 1e20, boolValue: true},
+	{name: "not a number", query: "?v=NaN", str: "NaN", intValue: 7, floatValue: 1.5, boolValue: true},
+	{name: "infinite", query: "?v=-Inf", str: "-Inf", intValue: 7, floatValue: 1.5, boolValue: true},
+	{name: "first of several", query: "?v=1&v=2", str: "1", intValue: 1, floatValue: 1, boolValue: true},
+	{name: "escaped", query: "?v=a%20b", str: "a b", intValue: 7, floatValue: 1.5, boolValue: true},
+}
+
+func TestTools_Query(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range queryTests {
+		r := httptest.NewRequest("GET", "/"+e.query, nil)
+
+		if s := testTools.QueryString(r, "v", "def"); s != e.str {
+			t.Errorf("%s: expected string %q, but got %q", e.name, e.str, s)
+		}
+		if i := testTools.QueryInt(r, "v", 7); i != e.intValue {
+			t.Errorf("%s: expected int %d, but got %d", e.name, e.intValue, i)
+		}
+		if f := testTools.QueryFloat(r, "v", 1.5); f != e.floatValue {
+			t.Errorf("%s: expected float %v, but got %v", e.name, e.floatValue, f)
+		}
+		if b := testTools.QueryBool(r, "v", true); b != e.boolValue {
+			t.Errorf("%s: expected bool %v, but got %v", e.name, e.boolValue, b)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package toolkit
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3MinPartSize is the smallest part, other than the last, which S3 accepts in a multipart upload
+const s3MinPartSize = 5 * 1024 * 1024
+
+// S3Target is an UploadTarget which streams files to a bucket in an S3 compatible object store,
+// such as AWS S3, MinIO or DigitalOcean Spaces, using path style requests signed with AWS
+// Signature Version 4. Files are read PartSize bytes at a time (5MB by default, which is also the
+// smallest part S3 accepts, so anything smaller is raised to 5MB), so a file is never held in memory
+// in full; files larger than one part are sent with a multipart upload. The name of each file is
+// used as its object key
+type S3Target struct {
+	Endpoint        string // e.g. https://s3.us-east-1.amazonaws.com or http://localhost:9000
+	Bucket          string
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	PartSize        int64
+	Client          *http.Client
+
+	now func() time.Time
+}
+
+// S3Error is returned by S3Target when the object store responds with an error
+type S3Error struct {
+	Method     string
+	Bucket     string
+	Key        string
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *S3Error) Error() string {
+	return fmt.Sprintf("s3: %s %s/%s: %d %s: %s", e.Method, e.Bucket, e.Key, e.StatusCode, e.Code, e.Message)
+}
+
+// Save uploads everything read from r to the object name, with a content type of
+// application/octet-stream
+func (s S3Target) Save(name string, r io.Reader) (int64, error) {
+	return s.SaveWithContentType(name, "application/octet-stream", r)
+}
+
+// SaveWithContentType uploads everything read from r to the object name, with the given content type
+func (s S3Target) SaveWithContentType(name, contentType string, r io.Reader) (int64, error) {
+	partSize := s.PartSize
+	if partSize < s3MinPartSize {
+		partSize = s3MinPartSize
+	}
+
+	buf := make([]byte, partSize)
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the whole file fits in a single request
+		header := http.Header{"Content-Type": {contentType}}
+
+		res, err := s.do(http.MethodPut, name, nil, header, buf[:n])
+		if err != nil {
+			return 0, err
+		}
+		res.Body.Close()
+
+		return int64(n), nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return s.multipartUpload(name, contentType, buf, r)
+}
+
+// Remove deletes the object name
+func (s S3Target) Remove(name string) error {
+	res, err := s.do(http.MethodDelete, name, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+	return res.Body.Close()
+}
+
+// Open returns the contents of the object name, which the caller must close
+func (s S3Target) Open(name string) (io.ReadCloser, error) {
+	res, err := s.do(http.MethodGet, name, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// Exists reports whether the object name exists
+func (s S3Target) Exists(name string) (bool, error) {
+	res, err := s.do(http.MethodHead, name, nil, nil, nil)
+	if e, ok := err.(*S3Error); ok && e.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	return true, nil
+}
+
+type s3CompletedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// multipartUpload uploads first, which fills buf, followed by the rest of r in parts of len(buf)
+// bytes. The upload is aborted if any part fails
+func (s S3Target) multipartUpload(key, contentType string, buf []byte, r io.Reader) (int64, error) {
+	res, err := s.do(http.MethodPost, key, url.Values{"uploads": {""}}, http.Header{"Content-Type": {contentType}}, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(res.Body).Decode(&initiated)
+	res.Body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("s3: POST %s/%s: reading upload id: %w", s.Bucket, key, err)
+	}
+
+	abort := func(err error) (int64, error) {
+		res, abortErr := s.do(http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil)
+		if abortErr == nil {
+			res.Body.Close()
+		}
+		return 0, err
+	}
+
+	var parts []s3CompletedPart
+	var total int64
+
+	for chunk, number := buf, 1; len(chunk) > 0; number++ {
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadID}}
+
+		res, err := s.do(http.MethodPut, key, query, nil, chunk)
+		if err != nil {
+			return abort(err)
+		}
+		res.Body.Close()
+
+		parts = append(parts, s3CompletedPart{PartNumber: number, ETag: res.Header.Get("ETag")})
+		total += int64(len(chunk))
+
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return abort(err)
+		}
+		chunk = buf[:n]
+	}
+
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return abort(err)
+	}
+
+	res, err = s.do(http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, nil, body)
+	if err != nil {
+		return abort(err)
+	}
+	defer res.Body.Close()
+
+	// completing an upload can fail after S3 has already responded with 200 OK, in which case
+	// the body contains an error rather than the result
+	result, err := io.ReadAll(res.Body)
+	if err != nil {
+		return abort(err)
+	}
+	if bytes.Contains(result, []byte("<Error>")) {
+		s3Err := &S3Error{Method: http.MethodPost, Bucket: s.Bucket, Key: key, StatusCode: res.StatusCode}
+		_ = xml.Unmarshal(result, s3Err)
+		return abort(s3Err)
+	}
+
+	return total, nil
+}
+
+// do sends a signed request for the object key, and returns an *S3Error if the response status
+// is not successful. The caller must close the body of the returned response
+func (s S3Target) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/"))
+	if err != nil {
+		return nil, err
+	}
+	u.Path += "/" + s.Bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	now := time.Now
+	if s.now != nil {
+		now = s.now
+	}
+
+	sum := sha256.Sum256(body)
+	s.sign(req, hex.EncodeToString(sum[:]), now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3: %s %s/%s: %w", method, s.Bucket, key, err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+
+		s3Err := &S3Error{Method: method, Bucket: s.Bucket, Key: key, StatusCode: res.StatusCode, Code: http.StatusText(res.StatusCode)}
+		_ = xml.NewDecoder(io.LimitReader(res.Body, 64*1024)).Decode(s3Err)
+		return nil, s3Err
+	}
+
+	return res, nil
+}
+
+// sign adds the headers of AWS Signature Version 4 to req, whose body has the hex encoded SHA-256
+// digest payloadHash
+func (s S3Target) sign(req *http.Request, payloadHash string, t time.Time) {
+	t = t.UTC()
+	amzDate := t.Format("20060102T150405Z")
+	date := t.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+
+	// the host, and any content type, range or x-amz-* headers are signed
+	signed := map[string]string{"host": host}
+	for k, v := range req.Header {
+		k = strings.ToLower(k)
+		if k == "content-type" || k == "content-md5" || k == "range" || strings.HasPrefix(k, "x-amz-") {
+			signed[k] = strings.TrimSpace(strings.Join(v, ","))
+		}
+	}
+
+	names := make([]string, 0, len(signed))
+	for k := range signed {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + signed[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3CanonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hashedRequest[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3CanonicalQuery encodes query sorted by key, as required by AWS Signature Version 4
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, s3Escape(k, true)+"="+s3Escape(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// s3Escape percent encodes every byte of s other than unreserved characters, and "/" unless
+// encodeSlash is set
+func s3Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,105 @@
+package toolkit
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// VirusScanner checks the contents of uploaded files. Scan reads the file from r, and reports whether
+// it is clean. It may return as soon as it has found an infection, without reading the rest of r
+type VirusScanner interface {
+	Scan(r io.Reader) (clean bool, err error)
+}
+
+// VirusScannerFunc lets an ordinary function be used as a VirusScanner
+type VirusScannerFunc func(r io.Reader) (clean bool, err error)
+
+// Scan calls f(r)
+func (f VirusScannerFunc) Scan(r io.Reader) (bool, error) {
+	return f(r)
+}
+
+// ErrInfectedFile is returned, wrapped with the name of the file, when VirusScanner finds an uploaded
+// file is not clean
+var ErrInfectedFile = errors.New("the uploaded file is infected")
+
+// errScanAborted is given to a scanner whose file was not read to the end, because it could not be saved
+var errScanAborted = errors.New("the upload was abandoned before it was scanned")
+
+// scanReader reads from r, passing everything read to scanner as it goes. The end of r is not
+// reported until the scanner has finished, so that an infected file is never completely saved; the
+// error from the scanner, or ErrInfectedFile, is returned instead
+type scanReader struct {
+	r        io.Reader
+	pw       *io.PipeWriter
+	verdict  chan error
+	fileName string
+	err      error
+}
+
+// newScanReader returns a scanReader which scans the file fileName read from r with scanner. Its close
+// method must be called once it is no longer needed
+func newScanReader(r io.Reader, scanner VirusScanner, fileName string) *scanReader {
+	pr, pw := io.Pipe()
+	s := &scanReader{r: r, pw: pw, verdict: make(chan error, 1), fileName: fileName}
+
+	go func() {
+		clean, err := scanner.Scan(pr)
+
+		// the scanner may stop reading early, so read anything left to keep the upload moving
+		_, _ = io.Copy(io.Discard, pr)
+
+		switch {
+		case err != nil:
+			err = fmt.Errorf("unable to scan the uploaded file %s: %w", fileName, err)
+		case !clean:
+			err = fmt.Errorf("%w: %s", ErrInfectedFile, fileName)
+		}
+		s.verdict <- err
+	}()
+
+	return s
+}
+
+func (s *scanReader) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	// stop as soon as the scanner has found a problem
+	select {
+	case err := <-s.verdict:
+		if err != nil {
+			s.err = err
+			_ = s.pw.CloseWithError(err)
+			return 0, err
+		}
+		s.verdict <- nil
+	default:
+	}
+
+	n, err := s.r.Read(p)
+	if n > 0 {
+		_, _ = s.pw.Write(p[:n])
+	}
+
+	switch {
+	case err == io.EOF:
+		_ = s.pw.Close()
+		if verdict := <-s.verdict; verdict != nil {
+			s.err = verdict
+			return n, verdict
+		}
+		s.err = io.EOF
+	case err != nil:
+		s.err = err
+		_ = s.pw.CloseWithError(err)
+	}
+	return n, err
+}
+
+// close stops the scanner, if the file was not read to the end
+func (s *scanReader) close() {
+	_ = s.pw.CloseWithError(errScanAborted)
+}
@@ -0,0 +1,127 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// signatureScanner finds files containing signature to be infected
+type signatureScanner struct {
+	signature string
+	err       error
+	scanned   int
+}
+
+func (s *signatureScanner) Scan(r io.Reader) (bool, error) {
+	s.scanned++
+	if s.err != nil {
+		return false, s.err
+	}
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return false, err
+	}
+	return !bytes.Contains(content, []byte(s.signature)), nil
+}
+
+// earlyScanner finds every file to be infected without reading any of it
+type earlyScanner struct{}
+
+func (earlyScanner) Scan(r io.Reader) (bool, error) {
+	return false, nil
+}
+
+func TestTools_UploadFiles_VirusScanner(t *testing.T) {
+	var scanTests = []struct {
+		name          string
+		scanner       VirusScanner
+		content       string
+		errorExpected bool
+		infected      bool
+	}{
+		{name: "clean", scanner: &signatureScanner{signature: "VIRUS"}, content: "hello, world", errorExpected: false},
+		{name: "infected", scanner: &signatureScanner{signature: "VIRUS"}, content: "hello, VIRUS", errorExpected: true, infected: true},
+		{name: "infected in the middle of a large file", scanner: &signatureScanner{signature: "VIRUS"}, content: strings.Repeat("x", 100000) + "VIRUS" + strings.Repeat("x", 100000), errorExpected: true, infected: true},
+		{name: "scanner stops early", scanner: earlyScanner{}, content: strings.Repeat("x", 100000), errorExpected: true, infected: true},
+		{name: "scanner fails", scanner: &signatureScanner{err: errors.New("scanner unavailable")}, content: "hello, world", errorExpected: true},
+	}
+
+	for _, e := range scanTests {
+		dir := filepath.Join("testdata", "uploads", "scan")
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "upload.txt", content: []byte(e.content)})
+
+		testTools := Tools{VirusScanner: e.scanner}
+		uploadedFiles, err := testTools.UploadFiles(req, dir, false)
+
+		if !e.errorExpected {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", e.name, err)
+			} else if saved, _ := os.ReadFile(filepath.Join(dir, uploadedFiles[0].NewFileName)); string(saved) != e.content {
+				t.Errorf("%s: the saved file does not match the one uploaded", e.name)
+			}
+		} else {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", e.name)
+			}
+			if errors.Is(err, ErrInfectedFile) != e.infected {
+				t.Errorf("%s: expected errors.Is(err, ErrInfectedFile) to be %v, but got %v", e.name, e.infected, err)
+			}
+
+			// nothing is kept, not even a temporary file
+			if entries, _ := os.ReadDir(dir); len(entries) > 0 {
+				t.Errorf("%s: expected no files to be saved, but found %s", e.name, entries[0].Name())
+			}
+		}
+
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// eicar is the EICAR anti-virus test file, which scanners detect as if it were a virus
+const eicar = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+func TestTools_UploadFiles_VirusScannerFunc(t *testing.T) {
+	errQuarantined := errors.New("quarantined")
+
+	scanner := VirusScannerFunc(func(r io.Reader) (bool, error) {
+		content, err := io.ReadAll(r)
+		if err != nil {
+			return false, err
+		}
+		if bytes.Contains(content, []byte(eicar)) {
+			return false, errQuarantined
+		}
+		return true, nil
+	})
+
+	target := &memoryTarget{}
+	testTools := Tools{VirusScanner: scanner, ContinueOnError: true}
+
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "eicar.com", content: []byte(eicar)},
+		testPart{field: "file", fileName: "notes.txt", content: []byte("hello, world")},
+	)
+
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the error from the scanner is wrapped with the name of the file
+	if !errors.Is(uploadedFiles[0].Error, errQuarantined) || !strings.Contains(uploadedFiles[0].Error.Error(), "eicar.com") {
+		t.Errorf("expected eicar.com to be rejected by the scanner, but got %v", uploadedFiles[0].Error)
+	}
+	if _, ok := target.files["eicar.com"]; ok {
+		t.Error("expected eicar.com not to be saved")
+	}
+
+	if uploadedFiles[1].Error != nil || string(target.files["notes.txt"]) != "hello, world" {
+		t.Errorf("expected notes.txt to be saved, but got %v", uploadedFiles[1].Error)
+	}
+}
@@ -0,0 +1,863 @@
+package toolkit
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// JSONSchemaError is returned by ReadJSON when the body does not match JSONSchema. It lists every
+// way in which it does not, so that they can all be reported to the client at once
+type JSONSchemaError struct {
+	Failures []JSONSchemaFailure
+}
+
+// JSONSchemaFailure is one way in which a JSON value does not match a schema. Path is a JSON
+// pointer, such as "/items/0/name", to the value which does not match, and is "" for the body
+// itself
+type JSONSchemaFailure struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (f JSONSchemaFailure) String() string {
+	if f.Path == "" {
+		return "body " + f.Message
+	}
+	return f.Path + " " + f.Message
+}
+
+func (e *JSONSchemaError) Error() string {
+	failures := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		failures[i] = f.String()
+	}
+	return "body does not match the JSON schema: " + strings.Join(failures, "; ")
+}
+
+// maxCachedJSONSchemas is the number of parsed schemas kept in jsonSchemas
+const maxCachedJSONSchemas = 64
+
+// jsonSchemas holds the schemas already parsed, by their text. Once it is full, a schema is dropped
+// for each one added, so that a program which uses many schemas doesn't keep them all
+var (
+	jsonSchemasMu sync.Mutex
+	jsonSchemas   = make(map[string]*jsonSchema)
+)
+
+// parseJSONSchema returns the schema in text, which is usually parsed only the first time it is seen
+func parseJSONSchema(text string) (*jsonSchema, error) {
+	jsonSchemasMu.Lock()
+	schema, ok := jsonSchemas[text]
+	jsonSchemasMu.Unlock()
+	if ok {
+		return schema, nil
+	}
+
+	var root interface{}
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	if err := dec.Decode(&root); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+
+	p := schemaParser{root: root, refs: make(map[string]*jsonSchema)}
+	schema, err := p.parse(root)
+	if err == nil {
+		err = checkSchemaCycles(schema)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+
+	jsonSchemasMu.Lock()
+	defer jsonSchemasMu.Unlock()
+	if len(jsonSchemas) >= maxCachedJSONSchemas {
+		for cached := range jsonSchemas {
+			delete(jsonSchemas, cached)
+			break
+		}
+	}
+	jsonSchemas[text] = schema
+	return schema, nil
+}
+
+// checkSchemaCycles returns an error if any schema within root, through $ref, applies itself to the
+// same value again, as in {"$ref": "#"} or {"allOf": [{"$ref": "#"}]}, which would make validation
+// recurse for ever. A schema may still refer to itself for the values within the one it checks
+func checkSchemaCycles(root *jsonSchema) error {
+	// every schema within root, found through any keyword
+	all := []*jsonSchema{root}
+	seen := map[*jsonSchema]bool{root: true}
+	for i := 0; i < len(all); i++ {
+		for _, sub := range append(all[i].inPlace(), all[i].children()...) {
+			if !seen[sub] {
+				seen[sub] = true
+				all = append(all, sub)
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[*jsonSchema]int, len(all))
+
+	var visit func(s *jsonSchema) error
+	visit = func(s *jsonSchema) error {
+		switch state[s] {
+		case visiting:
+			return errors.New("$ref refers to a schema which applies itself to the same value")
+		case visited:
+			return nil
+		}
+
+		state[s] = visiting
+		for _, sub := range s.inPlace() {
+			if err := visit(sub); err != nil {
+				return err
+			}
+		}
+		state[s] = visited
+		return nil
+	}
+
+	for _, s := range all {
+		if err := visit(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inPlace returns the schemas which s applies to the same value as itself
+func (s *jsonSchema) inPlace() []*jsonSchema {
+	var schemas []*jsonSchema
+	if s.ref != nil {
+		schemas = append(schemas, s.ref)
+	}
+	for _, schema := range []*jsonSchema{s.not, s.ifSchema, s.thenSchema, s.elseSchema} {
+		if schema != nil {
+			schemas = append(schemas, schema)
+		}
+	}
+	for _, schema := range s.dependentSchemas {
+		schemas = append(schemas, schema)
+	}
+	schemas = append(schemas, s.allOf...)
+	schemas = append(schemas, s.anyOf...)
+	return append(schemas, s.oneOf...)
+}
+
+// children returns the schemas which s applies to the values within the one it checks
+func (s *jsonSchema) children() []*jsonSchema {
+	var schemas []*jsonSchema
+	for _, schema := range s.properties {
+		schemas = append(schemas, schema)
+	}
+	for _, p := range s.patternProperties {
+		schemas = append(schemas, p.schema)
+	}
+	for _, schema := range []*jsonSchema{s.additionalProperties, s.propertyNames, s.items, s.additionalItems, s.contains} {
+		if schema != nil {
+			schemas = append(schemas, schema)
+		}
+	}
+	return append(schemas, s.tupleItems...)
+}
+
+// validateJSONSchema checks the JSON value raw against the schema in text
+func validateJSONSchema(text string, raw []byte) error {
+	schema, err := parseJSONSchema(text)
+	if err != nil {
+		return err
+	}
+
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return err
+	}
+
+	var failures []JSONSchemaFailure
+	schema.validate(value, "", &failures)
+	if len(failures) > 0 {
+		return &JSONSchemaError{Failures: failures}
+	}
+	return nil
+}
+
+// jsonSchema is a parsed draft-07 JSON Schema. It supports every keyword which constrains a value,
+// and references within the schema; annotations, such as title, and format are ignored
+type jsonSchema struct {
+	// always is set for the schemas true and false, which match everything and nothing
+	always *bool
+	ref    *jsonSchema
+
+	types    []string
+	enum     []interface{}
+	constant interface{}
+	hasConst bool
+
+	properties           map[string]*jsonSchema
+	patternProperties    []patternSchema
+	required             []string
+	additionalProperties *jsonSchema
+	propertyNames        *jsonSchema
+	dependentRequired    map[string][]string
+	dependentSchemas     map[string]*jsonSchema
+	minProperties        int
+	maxProperties        int
+
+	items           *jsonSchema
+	tupleItems      []*jsonSchema
+	additionalItems *jsonSchema
+	contains        *jsonSchema
+	minItems        int
+	maxItems        int
+	uniqueItems     bool
+
+	minLength int
+	maxLength int
+	pattern   *regexp.Regexp
+
+	minimum          *float64
+	maximum          *float64
+	exclusiveMinimum *float64
+	exclusiveMaximum *float64
+	multipleOf       *float64
+
+	allOf []*jsonSchema
+	anyOf []*jsonSchema
+	oneOf []*jsonSchema
+	not   *jsonSchema
+
+	ifSchema   *jsonSchema
+	thenSchema *jsonSchema
+	elseSchema *jsonSchema
+}
+
+// patternSchema is the schema for the properties whose names match pattern, from patternProperties
+type patternSchema struct {
+	pattern *regexp.Regexp
+	schema  *jsonSchema
+}
+
+// schemaParser parses a schema, and the parts of it to which it refers
+type schemaParser struct {
+	root interface{}
+	refs map[string]*jsonSchema
+}
+
+func (p *schemaParser) parse(v interface{}) (*jsonSchema, error) {
+	if b, ok := v.(bool); ok {
+		return &jsonSchema{always: &b}, nil
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("a schema must be an object or a boolean")
+	}
+
+	s := &jsonSchema{minProperties: -1, maxProperties: -1, minItems: -1, maxItems: -1, minLength: -1, maxLength: -1}
+	var err error
+
+	// other keywords alongside $ref are ignored
+	if ref, ok := m["$ref"]; ok {
+		refText, ok := ref.(string)
+		if !ok {
+			return nil, errors.New("$ref must be a string")
+		}
+		s.ref, err = p.resolve(refText)
+		return s, err
+	}
+
+	switch types := m["type"].(type) {
+	case nil:
+	case string:
+		s.types = []string{types}
+	case []interface{}:
+		for _, t := range types {
+			name, ok := t.(string)
+			if !ok {
+				return nil, errors.New("type must be a string or an array of strings")
+			}
+			s.types = append(s.types, name)
+		}
+	default:
+		return nil, errors.New("type must be a string or an array of strings")
+	}
+	for _, t := range s.types {
+		switch t {
+		case "null", "boolean", "object", "array", "number", "integer", "string":
+		default:
+			return nil, fmt.Errorf("unknown type %q", t)
+		}
+	}
+
+	if enum, ok := m["enum"]; ok {
+		if s.enum, ok = enum.([]interface{}); !ok {
+			return nil, errors.New("enum must be an array")
+		}
+	}
+	s.constant, s.hasConst = m["const"]
+
+	if properties, ok := m["properties"]; ok {
+		props, ok := properties.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("properties must be an object")
+		}
+		s.properties = make(map[string]*jsonSchema, len(props))
+		for name, prop := range props {
+			if s.properties[name], err = p.parse(prop); err != nil {
+				return nil, fmt.Errorf("property %s: %w", name, err)
+			}
+		}
+	}
+	if patternProperties, ok := m["patternProperties"]; ok {
+		props, ok := patternProperties.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("patternProperties must be an object")
+		}
+		for text, prop := range props {
+			pattern, err := regexp.Compile(text)
+			if err != nil {
+				return nil, fmt.Errorf("patternProperties: %w", err)
+			}
+			schema, err := p.parse(prop)
+			if err != nil {
+				return nil, fmt.Errorf("patternProperties %s: %w", text, err)
+			}
+			s.patternProperties = append(s.patternProperties, patternSchema{pattern: pattern, schema: schema})
+		}
+		// the patterns are checked in order, so that the failures are always reported in the same order
+		sort.Slice(s.patternProperties, func(i, j int) bool {
+			return s.patternProperties[i].pattern.String() < s.patternProperties[j].pattern.String()
+		})
+	}
+	if required, ok := m["required"]; ok {
+		if s.required, err = stringList(required); err != nil {
+			return nil, fmt.Errorf("required %w", err)
+		}
+	}
+	if dependencies, ok := m["dependencies"]; ok {
+		deps, ok := dependencies.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("dependencies must be an object")
+		}
+		s.dependentRequired = make(map[string][]string)
+		s.dependentSchemas = make(map[string]*jsonSchema)
+		for name, dep := range deps {
+			if names, ok := dep.([]interface{}); ok {
+				if s.dependentRequired[name], err = stringList(names); err != nil {
+					return nil, fmt.Errorf("dependencies %s %w", name, err)
+				}
+			} else if s.dependentSchemas[name], err = p.parse(dep); err != nil {
+				return nil, fmt.Errorf("dependencies %s: %w", name, err)
+			}
+		}
+	}
+
+	if items, ok := m["items"]; ok {
+		if tuple, ok := items.([]interface{}); ok {
+			if s.tupleItems, err = p.parseAll(tuple, "items"); err != nil {
+				return nil, err
+			}
+		} else if s.items, err = p.parse(items); err != nil {
+			return nil, fmt.Errorf("items: %w", err)
+		}
+	}
+	if s.uniqueItems, ok = m["uniqueItems"].(bool); !ok && m["uniqueItems"] != nil {
+		return nil, errors.New("uniqueItems must be a boolean")
+	}
+
+	if pattern, ok := m["pattern"]; ok {
+		text, ok := pattern.(string)
+		if !ok {
+			return nil, errors.New("pattern must be a string")
+		}
+		if s.pattern, err = regexp.Compile(text); err != nil {
+			return nil, err
+		}
+	}
+
+	for keyword, schema := range map[string]**jsonSchema{
+		"additionalProperties": &s.additionalProperties,
+		"propertyNames":        &s.propertyNames,
+		"additionalItems":      &s.additionalItems,
+		"contains":             &s.contains,
+		"not":                  &s.not,
+		"if":                   &s.ifSchema,
+		"then":                 &s.thenSchema,
+		"else":                 &s.elseSchema,
+	} {
+		if v, ok := m[keyword]; ok {
+			if *schema, err = p.parse(v); err != nil {
+				return nil, fmt.Errorf("%s: %w", keyword, err)
+			}
+		}
+	}
+
+	for keyword, schemas := range map[string]*[]*jsonSchema{"allOf": &s.allOf, "anyOf": &s.anyOf, "oneOf": &s.oneOf} {
+		if v, ok := m[keyword]; ok {
+			list, ok := v.([]interface{})
+			if !ok || len(list) == 0 {
+				return nil, fmt.Errorf("%s must be a non-empty array", keyword)
+			}
+			if *schemas, err = p.parseAll(list, keyword); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	for keyword, count := range map[string]*int{
+		"minProperties": &s.minProperties,
+		"maxProperties": &s.maxProperties,
+		"minItems":      &s.minItems,
+		"maxItems":      &s.maxItems,
+		"minLength":     &s.minLength,
+		"maxLength":     &s.maxLength,
+	} {
+		if v, ok := m[keyword]; ok {
+			n, ok := v.(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a non-negative integer", keyword)
+			}
+			if *count, err = strconv.Atoi(n.String()); err != nil || *count < 0 {
+				return nil, fmt.Errorf("%s must be a non-negative integer", keyword)
+			}
+		}
+	}
+
+	for keyword, limit := range map[string]**float64{
+		"minimum":          &s.minimum,
+		"maximum":          &s.maximum,
+		"exclusiveMinimum": &s.exclusiveMinimum,
+		"exclusiveMaximum": &s.exclusiveMaximum,
+		"multipleOf":       &s.multipleOf,
+	} {
+		if v, ok := m[keyword]; ok {
+			n, ok := v.(json.Number)
+			if !ok {
+				return nil, fmt.Errorf("%s must be a number", keyword)
+			}
+			f, err := n.Float64()
+			if err != nil {
+				return nil, fmt.Errorf("%s must be a number", keyword)
+			}
+			*limit = &f
+		}
+	}
+	if s.multipleOf != nil && *s.multipleOf <= 0 {
+		return nil, errors.New("multipleOf must be greater than 0")
+	}
+
+	return s, nil
+}
+
+// stringList returns list, which must be an array of strings, as a slice
+func stringList(list interface{}) ([]string, error) {
+	values, ok := list.([]interface{})
+	if !ok {
+		return nil, errors.New("must be an array of strings")
+	}
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		str, ok := v.(string)
+		if !ok {
+			return nil, errors.New("must be an array of strings")
+		}
+		strs = append(strs, str)
+	}
+	return strs, nil
+}
+
+func (p *schemaParser) parseAll(list []interface{}, keyword string) ([]*jsonSchema, error) {
+	schemas := make([]*jsonSchema, len(list))
+	for i, v := range list {
+		var err error
+		if schemas[i], err = p.parse(v); err != nil {
+			return nil, fmt.Errorf("%s/%d: %w", keyword, i, err)
+		}
+	}
+	return schemas, nil
+}
+
+// resolve returns the schema to which ref refers, which must be within the schema being parsed,
+// such as "#" or "#/definitions/address"
+func (p *schemaParser) resolve(ref string) (*jsonSchema, error) {
+	if s, ok := p.refs[ref]; ok {
+		return s, nil
+	}
+	if !strings.HasPrefix(ref, "#") {
+		return nil, fmt.Errorf("$ref %s: only references within the schema are supported", ref)
+	}
+
+	pointer, err := url.PathUnescape(strings.TrimPrefix(ref, "#"))
+	if err != nil {
+		return nil, fmt.Errorf("$ref %s: %w", ref, err)
+	}
+
+	target := p.root
+	if pointer != "" {
+		if !strings.HasPrefix(pointer, "/") {
+			return nil, fmt.Errorf("$ref %s: only JSON pointers are supported", ref)
+		}
+		for _, token := range strings.Split(pointer[1:], "/") {
+			token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+
+			var ok bool
+			switch v := target.(type) {
+			case map[string]interface{}:
+				target, ok = v[token]
+			case []interface{}:
+				i, err := strconv.Atoi(token)
+				ok = err == nil && i >= 0 && i < len(v)
+				if ok {
+					target = v[i]
+				}
+			default:
+				ok = false
+			}
+			if !ok {
+				return nil, fmt.Errorf("$ref %s: not found", ref)
+			}
+		}
+	}
+
+	// the schema is filled in once parsed, so that a schema may refer to itself
+	s := &jsonSchema{}
+	p.refs[ref] = s
+	parsed, err := p.parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("$ref %s: %w", ref, err)
+	}
+	*s = *parsed
+	return s, nil
+}
+
+// validate adds a failure to failures for each way in which v, found at path, does not match s
+func (s *jsonSchema) validate(v interface{}, path string, failures *[]JSONSchemaFailure) {
+	fail := func(format string, args ...interface{}) {
+		*failures = append(*failures, JSONSchemaFailure{Path: path, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			fail("is not permitted")
+		}
+		return
+	}
+	if s.ref != nil {
+		s.ref.validate(v, path, failures)
+		return
+	}
+
+	if len(s.types) > 0 {
+		matched := false
+		for _, t := range s.types {
+			matched = matched || jsonTypeMatches(v, t)
+		}
+		if !matched {
+			if len(s.types) == 1 {
+				fail("must be of type %s", s.types[0])
+			} else {
+				fail("must be one of the types %s", strings.Join(s.types, ", "))
+			}
+			// nothing else about a value of the wrong type is worth reporting
+			return
+		}
+	}
+
+	if s.enum != nil {
+		matched := false
+		for _, e := range s.enum {
+			matched = matched || jsonEqual(v, e)
+		}
+		if !matched {
+			fail("must be one of %s", jsonText(s.enum))
+		}
+	}
+	if s.hasConst && !jsonEqual(v, s.constant) {
+		fail("must be %s", jsonText(s.constant))
+	}
+
+	switch value := v.(type) {
+	case map[string]interface{}:
+		s.validateObject(value, path, failures, fail)
+	case []interface{}:
+		s.validateArray(value, path, failures, fail)
+	case string:
+		length := utf8.RuneCountInString(value)
+		if s.minLength >= 0 && length < s.minLength {
+			fail("must be at least %d characters long", s.minLength)
+		}
+		if s.maxLength >= 0 && length > s.maxLength {
+			fail("must be no more than %d characters long", s.maxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(value) {
+			fail("must match the pattern %s", s.pattern)
+		}
+	case json.Number:
+		s.validateNumber(value, fail)
+	}
+
+	for _, sub := range s.allOf {
+		sub.validate(v, path, failures)
+	}
+	if s.anyOf != nil && countMatches(s.anyOf, v) == 0 {
+		fail("must match at least one of the schemas in anyOf")
+	}
+	if s.oneOf != nil {
+		if n := countMatches(s.oneOf, v); n != 1 {
+			fail("must match exactly one of the schemas in oneOf, but matches %d", n)
+		}
+	}
+	if s.not != nil && countMatches([]*jsonSchema{s.not}, v) == 1 {
+		fail("must not match the schema in not")
+	}
+
+	// then and else apply only once if has been checked, and nothing is reported for if itself
+	if s.ifSchema != nil {
+		if countMatches([]*jsonSchema{s.ifSchema}, v) == 1 {
+			if s.thenSchema != nil {
+				s.thenSchema.validate(v, path, failures)
+			}
+		} else if s.elseSchema != nil {
+			s.elseSchema.validate(v, path, failures)
+		}
+	}
+}
+
+func (s *jsonSchema) validateObject(value map[string]interface{}, path string, failures *[]JSONSchemaFailure, fail func(string, ...interface{})) {
+	if s.minProperties >= 0 && len(value) < s.minProperties {
+		fail("must have at least %d properties", s.minProperties)
+	}
+	if s.maxProperties >= 0 && len(value) > s.maxProperties {
+		fail("must have no more than %d properties", s.maxProperties)
+	}
+
+	for _, name := range s.required {
+		if _, ok := value[name]; !ok {
+			*failures = append(*failures, JSONSchemaFailure{Path: path + "/" + escapePointer(name), Message: "is required"})
+		}
+	}
+
+	// properties are checked in order, so that the failures are always reported in the same order
+	names := make([]string, 0, len(value))
+	for name := range value {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		propertyPath := path + "/" + escapePointer(name)
+
+		if s.propertyNames != nil && countMatches([]*jsonSchema{s.propertyNames}, name) == 0 {
+			*failures = append(*failures, JSONSchemaFailure{Path: propertyPath, Message: "has a name which does not match the schema in propertyNames"})
+		}
+
+		for _, required := range s.dependentRequired[name] {
+			if _, ok := value[required]; !ok {
+				*failures = append(*failures, JSONSchemaFailure{Path: path + "/" + escapePointer(required), Message: "is required when " + name + " is present"})
+			}
+		}
+		if schema, ok := s.dependentSchemas[name]; ok {
+			schema.validate(value, path, failures)
+		}
+
+		// a property which is in properties, or matches any of patternProperties, is checked against
+		// each of them, and is otherwise checked against additionalProperties
+		schema, matched := s.properties[name]
+		if matched {
+			schema.validate(value[name], propertyPath, failures)
+		}
+		for _, p := range s.patternProperties {
+			if p.pattern.MatchString(name) {
+				matched = true
+				p.schema.validate(value[name], propertyPath, failures)
+			}
+		}
+		if !matched && s.additionalProperties != nil {
+			s.additionalProperties.validate(value[name], propertyPath, failures)
+		}
+	}
+}
+
+func (s *jsonSchema) validateArray(value []interface{}, path string, failures *[]JSONSchemaFailure, fail func(string, ...interface{})) {
+	if s.minItems >= 0 && len(value) < s.minItems {
+		fail("must have at least %d items", s.minItems)
+	}
+	if s.maxItems >= 0 && len(value) > s.maxItems {
+		fail("must have no more than %d items", s.maxItems)
+	}
+
+	if s.uniqueItems {
+	unique:
+		for i := range value {
+			for j := i + 1; j < len(value); j++ {
+				if jsonEqual(value[i], value[j]) {
+					fail("must not contain duplicate items")
+					break unique
+				}
+			}
+		}
+	}
+
+	if s.contains != nil && !containsMatch(s.contains, value) {
+		fail("must contain at least one item which matches the schema in contains")
+	}
+
+	for i, item := range value {
+		schema := s.items
+		if s.tupleItems != nil {
+			schema = s.additionalItems
+			if i < len(s.tupleItems) {
+				schema = s.tupleItems[i]
+			}
+		}
+		if schema != nil {
+			schema.validate(item, path+"/"+strconv.Itoa(i), failures)
+		}
+	}
+}
+
+func (s *jsonSchema) validateNumber(value json.Number, fail func(string, ...interface{})) {
+	n, err := value.Float64()
+	if err != nil {
+		fail("must be a number which is not out of range")
+		return
+	}
+
+	if s.minimum != nil && n < *s.minimum {
+		fail("must be at least %v", *s.minimum)
+	}
+	if s.maximum != nil && n > *s.maximum {
+		fail("must be no more than %v", *s.maximum)
+	}
+	if s.exclusiveMinimum != nil && n <= *s.exclusiveMinimum {
+		fail("must be greater than %v", *s.exclusiveMinimum)
+	}
+	if s.exclusiveMaximum != nil && n >= *s.exclusiveMaximum {
+		fail("must be less than %v", *s.exclusiveMaximum)
+	}
+	if s.multipleOf != nil {
+		q := n / *s.multipleOf
+		if math.Abs(q-math.Round(q)) > 1e-9 {
+			fail("must be a multiple of %v", *s.multipleOf)
+		}
+	}
+}
+
+// countMatches returns the number of schemas which v matches
+func countMatches(schemas []*jsonSchema, v interface{}) int {
+	n := 0
+	for _, s := range schemas {
+		var failures []JSONSchemaFailure
+		s.validate(v, "", &failures)
+		if len(failures) == 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// containsMatch reports whether any of items matches s
+func containsMatch(s *jsonSchema, items []interface{}) bool {
+	for _, item := range items {
+		if countMatches([]*jsonSchema{s}, item) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonTypeMatches reports whether v, decoded with UseNumber, is of the JSON Schema type t
+func jsonTypeMatches(v interface{}, t string) bool {
+	switch v := v.(type) {
+	case nil:
+		return t == "null"
+	case bool:
+		return t == "boolean"
+	case string:
+		return t == "string"
+	case []interface{}:
+		return t == "array"
+	case map[string]interface{}:
+		return t == "object"
+	case json.Number:
+		if t == "integer" {
+			n, err := v.Float64()
+			return err == nil && n == math.Trunc(n)
+		}
+		return t == "number"
+	}
+	return false
+}
+
+// jsonEqual reports whether a and b, decoded with UseNumber, are the same JSON value. Numbers are
+// equal if they have the same value, so 1 and 1.0 are equal
+func jsonEqual(a, b interface{}) bool {
+	switch a := a.(type) {
+	case json.Number:
+		b, ok := b.(json.Number)
+		if !ok {
+			return false
+		}
+		x, errA := a.Float64()
+		y, errB := b.Float64()
+		if errA != nil || errB != nil {
+			return a == b
+		}
+		return x == y
+	case []interface{}:
+		b, ok := b.([]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for i := range a {
+			if !jsonEqual(a[i], b[i]) {
+				return false
+			}
+		}
+		return true
+	case map[string]interface{}:
+		b, ok := b.(map[string]interface{})
+		if !ok || len(a) != len(b) {
+			return false
+		}
+		for k, v := range a {
+			w, ok := b[k]
+			if !ok || !jsonEqual(v, w) {
+				return false
+			}
+		}
+		return true
+	default:
+		return a == b
+	}
+}
+
+// jsonText returns v as JSON, for use in a message
+func jsonText(v interface{}) string {
+	text, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(text)
+}
+
+// escapePointer escapes name for use as a token of a JSON pointer
+func escapePointer(name string) string {
+	return strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+}
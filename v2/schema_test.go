@@ -0,0 +1,220 @@
+package toolkit
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var testSchema = `{
+	"type": "object",
+	"required": ["name", "age"],
+	"additionalProperties": false,
+	"properties": {
+		"name": {"type": "string", "minLength": 1, "maxLength": 10, "pattern": "^[a-z]+$"},
+		"age": {"type": "integer", "minimum": 0, "exclusiveMaximum": 150},
+		"role": {"enum": ["admin", "user"]},
+		"tags": {"type": "array", "items": {"type": "string"}, "maxItems": 3, "uniqueItems": true},
+		"address": {"$ref": "#/definitions/address"},
+		"score": {"type": ["number", "null"], "multipleOf": 0.5},
+		"contact": {"oneOf": [{"required": ["email"]}, {"required": ["phone"]}]},
+		"friends": {"type": "array", "items": {"$ref": "#"}}
+	},
+	"definitions": {
+		"address": {
+			"type": "object",
+			"required": ["city"],
+			"properties": {"city": {"type": "string"}, "zip": {"not": {"type": "null"}}}
+		}
+	}
+}`
+
+var jsonSchemaTests = []struct {
+	name          string
+	json          string
+	failures      []JSONSchemaFailure
+	errorExpected bool
+}{
+	{name: "valid", json: `{"name": "jack", "age": 30}`},
+	{name: "valid with everything", json: `{"name": "jack", "age": 30.0, "role": "admin", "tags": ["a", "b"], "address": {"city": "Tokyo", "zip": "100"}, "score": 1.5, "contact": {"email": "a@b"}, "friends": [{"name": "jill", "age": 29}]}`},
+	{name: "null allowed", json: `{"name": "jack", "age": 30, "score": null}`},
+	{name: "not an object", json: `[1, 2]`, failures: []JSONSchemaFailure{{"", "must be of type object"}}},
+	{name: "missing", json: `{}`, failures: []JSONSchemaFailure{{"/name", "is required"}, {"/age", "is required"}}},
+	{name: "wrong types", json: `{"name": 1, "age": 1.5}`, failures: []JSONSchemaFailure{{"/age", "must be of type integer"}, {"/name", "must be of type string"}}},
+	{name: "string checks", json: `{"name": "Jack the giant killer", "age": 1}`, failures: []JSONSchemaFailure{{"/name", "must be no more than 10 characters long"}, {"/name", "must match the pattern ^[a-z]+$"}}},
+	{name: "number checks", json: `{"name": "jack", "age": 150, "score": 0.3}`, failures: []JSONSchemaFailure{{"/age", "must be less than 150"}, {"/score", "must be a multiple of 0.5"}}},
+	{name: "negative", json: `{"name": "jack", "age": -1}`, failures: []JSONSchemaFailure{{"/age", "must be at least 0"}}},
+	{name: "enum", json: `{"name": "jack", "age": 1, "role": "root"}`, failures: []JSONSchemaFailure{{"/role", `must be one of ["admin","user"]`}}},
+	{name: "array checks", json: `{"name": "jack", "age": 1, "tags": ["a", "a", 3, "b"]}`, failures: []JSONSchemaFailure{{"/tags", "must have no more than 3 items"}, {"/tags", "must not contain duplicate items"}, {"/tags/2", "must be of type string"}}},
+	{name: "additional property", json: `{"name": "jack", "age": 1, "extra/field": true}`, failures: []JSONSchemaFailure{{"/extra~1field", "is not permitted"}}},
+	{name: "reference", json: `{"name": "jack", "age": 1, "address": {"zip": null}}`, failures: []JSONSchemaFailure{{"/address/city", "is required"}, {"/address/zip", "must not match the schema in not"}}},
+	{name: "recursive reference", json: `{"name": "jack", "age": 1, "friends": [{"name": "jill"}]}`, failures: []JSONSchemaFailure{{"/friends/0/age", "is required"}}},
+	{name: "one of", json: `{"name": "jack", "age": 1, "contact": {"email": "a@b", "phone": "1"}}`, failures: []JSONSchemaFailure{{"/contact", "must match exactly one of the schemas in oneOf, but matches 2"}}},
+	{name: "badly-formed", json: `{"name": "jack",`, errorExpected: true},
+}
+
+func TestTools_ReadJSONSchema(t *testing.T) {
+	testTools := Tools{JSONSchema: testSchema, AllowUnknownFields: true}
+
+	for _, e := range jsonSchemaTests {
+		var decoded interface{}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(e.json))
+		err := testTools.ReadJSON(httptest.NewRecorder(), req, &decoded)
+
+		var schemaError *JSONSchemaError
+		switch {
+		case e.errorExpected:
+			if err == nil || errors.As(err, &schemaError) {
+				t.Errorf("%s: expected a decoding error, but got %v", e.name, err)
+			}
+		case e.failures == nil:
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", e.name, err)
+			}
+		case !errors.As(err, &schemaError):
+			t.Errorf("%s: expected a JSONSchemaError, but got %v", e.name, err)
+		case !reflect.DeepEqual(schemaError.Failures, e.failures):
+			t.Errorf("%s: expected failures %v, but got %v", e.name, e.failures, schemaError.Failures)
+		}
+	}
+}
+
+var jsonSchemaKeywordTests = []struct {
+	name     string
+	schema   string
+	json     string
+	failures []JSONSchemaFailure
+}{
+	{name: "pattern properties", schema: `{"patternProperties": {"^x-": {"type": "string"}}, "additionalProperties": false}`, json: `{"x-a": "b"}`},
+	{name: "pattern properties failed", schema: `{"patternProperties": {"^x-": {"type": "string"}}, "additionalProperties": false}`, json: `{"x-a": 1, "y": 2}`, failures: []JSONSchemaFailure{{"/x-a", "must be of type string"}, {"/y", "is not permitted"}}},
+	{name: "property and pattern", schema: `{"properties": {"x-a": {"minLength": 2}}, "patternProperties": {"^x-": {"maxLength": 1}}}`, json: `{"x-a": "b"}`, failures: []JSONSchemaFailure{{"/x-a", "must be at least 2 characters long"}}},
+	{name: "property names", schema: `{"propertyNames": {"pattern": "^[a-z]+$"}}`, json: `{"abc": 1, "Abc": 2}`, failures: []JSONSchemaFailure{{"/Abc", "has a name which does not match the schema in propertyNames"}}},
+	{name: "dependent properties", schema: `{"dependencies": {"card": ["billing"]}}`, json: `{"card": 1}`, failures: []JSONSchemaFailure{{"/billing", "is required when card is present"}}},
+	{name: "dependent properties met", schema: `{"dependencies": {"card": ["billing"]}}`, json: `{"card": 1, "billing": 2}`},
+	{name: "dependent schema", schema: `{"dependencies": {"card": {"required": ["billing"]}}}`, json: `{"card": 1}`, failures: []JSONSchemaFailure{{"/billing", "is required"}}},
+	{name: "dependency absent", schema: `{"dependencies": {"card": {"required": ["billing"]}}}`, json: `{}`},
+	{name: "contains", schema: `{"contains": {"const": 3}}`, json: `[1, 2, 3]`},
+	{name: "contains failed", schema: `{"contains": {"const": 3}}`, json: `[1, 2]`, failures: []JSONSchemaFailure{{"", "must contain at least one item which matches the schema in contains"}}},
+	{name: "then", schema: `{"if": {"properties": {"country": {"const": "JP"}}}, "then": {"required": ["prefecture"]}, "else": {"required": ["state"]}}`, json: `{"country": "JP"}`, failures: []JSONSchemaFailure{{"/prefecture", "is required"}}},
+	{name: "else", schema: `{"if": {"properties": {"country": {"const": "JP"}}}, "then": {"required": ["prefecture"]}, "else": {"required": ["state"]}}`, json: `{"country": "US"}`, failures: []JSONSchemaFailure{{"/state", "is required"}}},
+	{name: "if matched", schema: `{"if": {"properties": {"country": {"const": "JP"}}}, "then": {"required": ["prefecture"]}}`, json: `{"country": "JP", "prefecture": "Tokyo"}`},
+}
+
+func TestTools_ReadJSONSchema_Keywords(t *testing.T) {
+	for _, e := range jsonSchemaKeywordTests {
+		testTools := Tools{JSONSchema: e.schema, AllowUnknownFields: true}
+
+		var decoded interface{}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(e.json))
+		err := testTools.ReadJSON(httptest.NewRecorder(), req, &decoded)
+
+		var schemaError *JSONSchemaError
+		switch {
+		case e.failures == nil:
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", e.name, err)
+			}
+		case !errors.As(err, &schemaError):
+			t.Errorf("%s: expected a JSONSchemaError, but got %v", e.name, err)
+		case !reflect.DeepEqual(schemaError.Failures, e.failures):
+			t.Errorf("%s: expected failures %v, but got %v", e.name, e.failures, schemaError.Failures)
+		}
+	}
+}
+
+func TestTools_ReadJSONSchema_Multiple(t *testing.T) {
+	testTools := Tools{JSONSchema: `{"type": "object", "required": ["id"]}`, AllowMultipleJSON: true}
+
+	// each value is checked separately
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"id": 1} {} {"id": 3}`))
+
+	for i, expectError := range []bool{false, true, false} {
+		var decoded struct {
+			ID int `json:"id"`
+		}
+		err := testTools.ReadJSON(httptest.NewRecorder(), req, &decoded)
+		if (err != nil) != expectError {
+			t.Errorf("value %d: expected error %v, but got %v", i, expectError, err)
+		}
+	}
+}
+
+var invalidSchemaTests = []struct {
+	name   string
+	schema string
+}{
+	{name: "not json", schema: `{"type": `},
+	{name: "not an object", schema: `"string"`},
+	{name: "unknown type", schema: `{"type": "date"}`},
+	{name: "bad pattern", schema: `{"pattern": "("}`},
+	{name: "negative length", schema: `{"minLength": -1}`},
+	{name: "draft-04 exclusive minimum", schema: `{"exclusiveMinimum": true}`},
+	{name: "remote reference", schema: `{"$ref": "http://example.com/schema.json"}`},
+	{name: "missing reference", schema: `{"$ref": "#/definitions/missing"}`},
+	{name: "reference to itself", schema: `{"$ref": "#"}`},
+	{name: "reference cycle", schema: `{"$ref": "#/definitions/a", "definitions": {"a": {"$ref": "#/definitions/b"}, "b": {"$ref": "#/definitions/a"}}}`},
+	{name: "reference cycle through allOf", schema: `{"type": "object", "allOf": [{"$ref": "#"}]}`},
+	{name: "bad pattern property", schema: `{"patternProperties": {"(": true}}`},
+	{name: "bad dependency", schema: `{"dependencies": {"a": [1]}}`},
+	{name: "reference cycle through if", schema: `{"if": {"$ref": "#"}}`},
+	{name: "reference cycle through not", schema: `{"definitions": {"a": {"not": {"$ref": "#/definitions/a"}}}, "properties": {"x": {"$ref": "#/definitions/a"}}}`},
+}
+
+func TestTools_ReadJSONSchema_Invalid(t *testing.T) {
+	for _, e := range invalidSchemaTests {
+		testTools := Tools{JSONSchema: e.schema}
+
+		var decoded interface{}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{}`))
+		err := testTools.ReadJSON(httptest.NewRecorder(), req, &decoded)
+		if err == nil || !strings.Contains(err.Error(), "invalid JSON schema") {
+			t.Errorf("%s: expected an invalid schema error, but got %v", e.name, err)
+		}
+	}
+}
+
+func TestParseJSONSchema_Cache(t *testing.T) {
+	// many schemas can be used, but only some are kept
+	for i := 0; i < 2*maxCachedJSONSchemas; i++ {
+		schema := fmt.Sprintf(`{"type": "object", "properties": {"a": {"minLength": %d}}}`, i)
+		if _, err := parseJSONSchema(schema); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	jsonSchemasMu.Lock()
+	cached := len(jsonSchemas)
+	jsonSchemasMu.Unlock()
+
+	if cached > maxCachedJSONSchemas {
+		t.Errorf("expected no more than %d schemas to be cached, but found %d", maxCachedJSONSchemas, cached)
+	}
+
+	// a schema which refers to itself for the values within the one it checks is still valid
+	if _, err := parseJSONSchema(`{"anyOf": [{"type": "string"}, {"type": "array", "items": {"$ref": "#"}}]}`); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestJSONSchemaError_Error(t *testing.T) {
+	err := &JSONSchemaError{Failures: []JSONSchemaFailure{{"", "must be of type object"}, {"/name", "is required"}}}
+
+	expected := "body does not match the JSON schema: body must be of type object; /name is required"
+	if err.Error() != expected {
+		t.Errorf("expected %q, but got %q", expected, err.Error())
+	}
+
+	// the failures can be sent to the client
+	rr := httptest.NewRecorder()
+	var testTools Tools
+	_ = testTools.WriteJSON(rr, http.StatusUnprocessableEntity, JSONResponse{Error: true, Message: "invalid body", Data: err.Failures})
+
+	if !strings.Contains(rr.Body.String(), `{"path":"/name","message":"is required"}`) {
+		t.Errorf("unexpected response %s", rr.Body.String())
+	}
+}
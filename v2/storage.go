@@ -0,0 +1,109 @@
+package toolkit
+
+import (
+	"errors"
+	"io"
+	"net/url"
+	"strings"
+)
+
+// Storage is the type used by StorageBackend to store uploaded files. Write stores everything read
+// from r under name, and URL returns the address at which the file stored under name can be found.
+// If a Storage also implements Remove(name string) error, Exists(name string) (bool, error) or
+// Open(name string) (io.ReadCloser, error), they are used in the same way as those of an UploadTarget
+type Storage interface {
+	Write(name string, r io.Reader) error
+	URL(name string) string
+}
+
+// LocalDiskStorage is a Storage which writes files to the directory Dir on the local file system, in
+// the same way as UploadFiles does without a StorageBackend. Their URLs are their names, escaped and
+// appended to BaseURL
+type LocalDiskStorage struct {
+	Dir     string
+	BaseURL string
+}
+
+// Write writes everything read from r to the file name in Dir, which is created if necessary
+func (l LocalDiskStorage) Write(name string, r io.Reader) error {
+	_, err := DiskTarget{Dir: l.Dir}.Save(name, r)
+	return err
+}
+
+// URL returns the URL of the file name, relative to BaseURL
+func (l LocalDiskStorage) URL(name string) string {
+	parts := strings.Split(name, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return strings.TrimSuffix(l.BaseURL, "/") + "/" + strings.Join(parts, "/")
+}
+
+// Remove deletes the file name from Dir
+func (l LocalDiskStorage) Remove(name string) error {
+	return DiskTarget{Dir: l.Dir}.Remove(name)
+}
+
+// Exists reports whether the file name exists in Dir
+func (l LocalDiskStorage) Exists(name string) (bool, error) {
+	return DiskTarget{Dir: l.Dir}.Exists(name)
+}
+
+// Open opens the file name in Dir
+func (l LocalDiskStorage) Open(name string) (io.ReadCloser, error) {
+	return DiskTarget{Dir: l.Dir}.Open(name)
+}
+
+// errStorageCantRemove is returned when a file has to be removed from a Storage without a Remove method
+var errStorageCantRemove = errors.New("the storage backend can't remove files")
+
+// storageTarget adapts a Storage to the UploadTarget used by UploadFiles
+type storageTarget struct {
+	Storage
+}
+
+func (s storageTarget) Save(name string, r io.Reader) (int64, error) {
+	counter := &countingReader{r: r}
+	err := s.Write(name, counter)
+	if err != nil {
+		return 0, err
+	}
+	return counter.n, nil
+}
+
+func (s storageTarget) Remove(name string) error {
+	if remover, ok := s.Storage.(interface{ Remove(name string) error }); ok {
+		return remover.Remove(name)
+	}
+	return errStorageCantRemove
+}
+
+func (s storageTarget) Open(name string) (io.ReadCloser, error) {
+	if opener, ok := s.Storage.(interface {
+		Open(name string) (io.ReadCloser, error)
+	}); ok {
+		return opener.Open(name)
+	}
+	return nil, errCantOpen
+}
+
+func (s storageTarget) Exists(name string) (bool, error) {
+	if exister, ok := s.Storage.(interface {
+		Exists(name string) (bool, error)
+	}); ok {
+		return exister.Exists(name)
+	}
+	return false, nil
+}
+
+// countingReader reads from r, counting the bytes read in n
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,97 @@
+package toolkit
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// memoryStorage is a Storage which keeps files in memory
+type memoryStorage struct {
+	files map[string][]byte
+}
+
+func (m *memoryStorage) Write(name string, r io.Reader) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	if m.files == nil {
+		m.files = make(map[string][]byte)
+	}
+	m.files[name] = content
+	return nil
+}
+
+func (m *memoryStorage) URL(name string) string {
+	return "https://cdn.example.com/" + name
+}
+
+func TestTools_UploadFiles_StorageBackend(t *testing.T) {
+	storage := &memoryStorage{}
+	testTools := Tools{StorageBackend: storage}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "hello.txt", content: []byte("hello, world")})
+
+	// the upload directory is ignored
+	uploadedFiles, err := testTools.UploadFiles(req, filepath.Join("testdata", "uploads", "ignored"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join("testdata", "uploads", "ignored")); !os.IsNotExist(err) {
+		t.Error("expected the upload directory not to be created")
+		_ = os.RemoveAll(filepath.Join("testdata", "uploads", "ignored"))
+	}
+
+	if !bytes.Equal(storage.files["hello.txt"], []byte("hello, world")) {
+		t.Errorf("wrong content stored: %q", storage.files["hello.txt"])
+	}
+
+	if uploadedFiles[0].FileSize != 12 {
+		t.Errorf("wrong file size; expected 12, but got %d", uploadedFiles[0].FileSize)
+	}
+
+	if uploadedFiles[0].URL != "https://cdn.example.com/hello.txt" {
+		t.Errorf("wrong URL: %s", uploadedFiles[0].URL)
+	}
+}
+
+func TestLocalDiskStorage(t *testing.T) {
+	storage := LocalDiskStorage{Dir: filepath.Join("testdata", "uploads", "storage"), BaseURL: "https://example.com/files/"}
+	defer os.RemoveAll(storage.Dir)
+
+	testTools := Tools{StorageBackend: storage}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "my notes.txt", content: []byte("hello, world")})
+
+	uploadedFiles, err := testTools.UploadFiles(req, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(storage.Dir, "my notes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello, world" {
+		t.Errorf("wrong content saved: %q", content)
+	}
+
+	if uploadedFiles[0].URL != "https://example.com/files/my%20notes.txt" {
+		t.Errorf("wrong URL: %s", uploadedFiles[0].URL)
+	}
+
+	// files which already exist are not overwritten by a generated name
+	testTools.FileNameGenerator = func(originalName, mimeType string) string {
+		return "my notes.txt"
+	}
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "other.txt", content: []byte("goodbye")})
+
+	if _, err := testTools.UploadFiles(req, "", false); err == nil {
+		t.Error("expected an error when the generated name already exists, but none received")
+	}
+}
@@ -0,0 +1,266 @@
+package toolkit
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// UploadTarget is the type used to store uploaded files. Save stores everything read from r under
+// name, and returns the number of bytes stored. If Save returns an error, nothing should remain
+// stored under name. An UploadTarget may also implement:
+//
+//   - Remove(name string) error, which is used to clean up files after a failed upload
+//   - Exists(name string) (bool, error), which is used to avoid overwriting existing files
+//   - SaveWithContentType(name, contentType string, r io.Reader) (int64, error), which is used in
+//     place of Save to pass on the content type detected from the file
+//   - FindSHA256(sum string, size int64) ([]string, error), which is used by RejectDuplicates to
+//     find the stored files of size bytes whose hex encoded SHA-256 digest is sum
+//   - Open(name string) (io.ReadCloser, error), which is used by UploadedFile.Open to read a
+//     stored file
+//   - Rename(oldName, newName string) error, which is used by SubdirPattern to move a file into a
+//     subdirectory named after its checksum
+//   - SaveNew(name string, r io.Reader) (int64, error) and RenameNew(oldName, newName string) error,
+//     which are used in place of Save and Rename when there must not already be a file called name
+//     or newName, and fail with an error wrapping fs.ErrExist if there is, without replacing it
+type UploadTarget interface {
+	Save(name string, r io.Reader) (int64, error)
+}
+
+// saveTo stores everything read from r in target under name, passing on contentType if target
+// implements SaveWithContentType
+func saveTo(target UploadTarget, name, contentType string, r io.Reader) (int64, error) {
+	if typed, ok := target.(interface {
+		SaveWithContentType(name, contentType string, r io.Reader) (int64, error)
+	}); ok {
+		return typed.SaveWithContentType(name, contentType, r)
+	}
+	return target.Save(name, r)
+}
+
+// DiskTarget is an UploadTarget which saves files in the directory Dir on the local file system
+type DiskTarget struct {
+	Dir string
+}
+
+// Save writes everything read from r to the file name in Dir, replacing any existing file. Dir is
+// created if it does not already exist. The contents are written to a temporary file, which is
+// renamed once it is complete, so that a partly written file never appears under name. The temporary
+// file is made in the same directory, rather than in os.TempDir, so that it can always be renamed into
+// place, even when the system's temporary directory is on another file system
+func (d DiskTarget) Save(name string, r io.Reader) (int64, error) {
+	return d.save(name, r, true)
+}
+
+// SaveNew writes everything read from r to the file name in Dir in the same way as Save, unless there
+// is already a file called name, which is left as it is. The temporary file is linked to name, which
+// fails if name exists, so that two files saved under the same name at once can't replace each other
+func (d DiskTarget) SaveNew(name string, r io.Reader) (int64, error) {
+	return d.save(name, r, false)
+}
+
+// save writes everything read from r to the file name in Dir, replacing any existing file if replace
+// is true, and otherwise failing with an error wrapping fs.ErrExist
+func (d DiskTarget) save(name string, r io.Reader, replace bool) (int64, error) {
+	fp, err := joinUploadPath(d.Dir, name)
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(fp), 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	outfile, err := createTempFile(filepath.Dir(fp))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(outfile, r)
+	if err == nil {
+		err = outfile.Sync()
+	}
+	if cerr := outfile.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = moveFile(outfile.Name(), fp, replace)
+	}
+	if err != nil {
+		_ = os.Remove(outfile.Name())
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// createTempFile creates a new file in dir with a random name beginning with tempFilePrefix. Unlike
+// os.CreateTemp, which makes files only their owner can read, the file is given the mode 0666 less the
+// umask, as os.Create would give it
+func createTempFile(dir string) (*os.File, error) {
+	for i := 0; ; i++ {
+		random := make([]byte, 12)
+		if _, err := rand.Read(random); err != nil {
+			return nil, err
+		}
+
+		name := filepath.Join(dir, tempFilePrefix+hex.EncodeToString(random))
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if errors.Is(err, fs.ErrExist) && i < 100 {
+			continue
+		}
+		return f, err
+	}
+}
+
+// moveFile renames oldPath to newPath. If replace is false, and there is already a file at newPath,
+// it fails with an error wrapping fs.ErrExist, and nothing is moved
+func moveFile(oldPath, newPath string, replace bool) error {
+	if replace {
+		return os.Rename(oldPath, newPath)
+	}
+
+	// unlike a rename, a link never replaces an existing file
+	if err := os.Link(oldPath, newPath); err != nil {
+		return err
+	}
+	return os.Remove(oldPath)
+}
+
+// tempFilePrefix begins the names of the temporary files written by DiskTarget.Save
+const tempFilePrefix = ".upload-"
+
+// Remove deletes the file name from Dir
+func (d DiskTarget) Remove(name string) error {
+	fp, err := joinUploadPath(d.Dir, name)
+	if err != nil {
+		return err
+	}
+	return os.Remove(fp)
+}
+
+// Rename moves the file oldName in Dir to newName, creating the directory it is in if necessary
+func (d DiskTarget) Rename(oldName, newName string) error {
+	return d.rename(oldName, newName, true)
+}
+
+// RenameNew moves the file oldName in Dir to newName in the same way as Rename, unless there is
+// already a file called newName, which is left as it is
+func (d DiskTarget) RenameNew(oldName, newName string) error {
+	return d.rename(oldName, newName, false)
+}
+
+// rename moves the file oldName in Dir to newName, replacing any existing file if replace is true
+func (d DiskTarget) rename(oldName, newName string, replace bool) error {
+	oldPath, err := joinUploadPath(d.Dir, oldName)
+	if err != nil {
+		return err
+	}
+	newPath, err := joinUploadPath(d.Dir, newName)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(newPath), 0755)
+	if err != nil {
+		return err
+	}
+	return moveFile(oldPath, newPath, replace)
+}
+
+// Open opens the file name in Dir
+func (d DiskTarget) Open(name string) (io.ReadCloser, error) {
+	fp, err := joinUploadPath(d.Dir, name)
+	if err != nil {
+		return nil, err
+	}
+	return os.Open(fp)
+}
+
+// Exists reports whether the file name exists in Dir
+func (d DiskTarget) Exists(name string) (bool, error) {
+	fp, err := joinUploadPath(d.Dir, name)
+	if err != nil {
+		return false, err
+	}
+
+	_, err = os.Stat(fp)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// FindSHA256 returns the names of the files in Dir, and its subdirectories, of size bytes, whose
+// contents have the hex encoded SHA-256 digest sum, in lexical order. Only the files of the right
+// size are read
+func (d DiskTarget) FindSHA256(sum string, size int64) ([]string, error) {
+	var found []string
+
+	err := filepath.WalkDir(d.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), tempFilePrefix) || strings.HasPrefix(entry.Name(), chunkFilePrefix) {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Size() != size {
+			return nil
+		}
+
+		name, err := filepath.Rel(d.Dir, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h := sha256.New()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+
+		if hex.EncodeToString(h.Sum(nil)) == sum {
+			found = append(found, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return found, nil
+}
+
+// joinUploadPath joins uploadDir and fileName, and returns an error if the resulting path would
+// not be inside uploadDir
+func joinUploadPath(uploadDir, fileName string) (string, error) {
+	fp := filepath.Join(uploadDir, fileName)
+
+	rel, err := filepath.Rel(uploadDir, fp)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("the file name %s is not permitted", fileName)
+	}
+	return fp, nil
+}
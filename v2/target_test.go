@@ -0,0 +1,276 @@
+package toolkit
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiskTarget_Save(t *testing.T) {
+	target := DiskTarget{Dir: filepath.Join("testdata", "uploads", "target")}
+	defer os.RemoveAll(target.Dir)
+
+	n, err := target.Save("hello.txt", strings.NewReader("hello, world"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 12 {
+		t.Errorf("wrong number of bytes saved; expected 12, but got %d", n)
+	}
+
+	content, err := os.ReadFile(filepath.Join(target.Dir, "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(content, []byte("hello, world")) {
+		t.Errorf("wrong content saved: %q", content)
+	}
+
+	exists, err := target.Exists("hello.txt")
+	if err != nil || !exists {
+		t.Errorf("expected hello.txt to exist; got %v, %v", exists, err)
+	}
+
+	err = target.Remove("hello.txt")
+	if err != nil {
+		t.Error(err)
+	}
+
+	exists, err = target.Exists("hello.txt")
+	if err != nil || exists {
+		t.Errorf("expected hello.txt not to exist; got %v, %v", exists, err)
+	}
+}
+
+func TestDiskTarget_SaveOutsideDir(t *testing.T) {
+	target := DiskTarget{Dir: filepath.Join("testdata", "uploads")}
+
+	_, err := target.Save("../evil.txt", strings.NewReader("evil"))
+	if err == nil {
+		t.Error("expected an error saving outside of the directory, but none received")
+	}
+
+	if _, err := os.Stat(filepath.Join("testdata", "evil.txt")); !os.IsNotExist(err) {
+		t.Error("file was saved outside of the directory")
+		_ = os.Remove(filepath.Join("testdata", "evil.txt"))
+	}
+}
+
+func TestDiskTarget_FindSHA256(t *testing.T) {
+	target := DiskTarget{Dir: filepath.Join("testdata", "uploads", "find")}
+	defer os.RemoveAll(target.Dir)
+
+	for name, content := range map[string]string{"a.txt": "apple", "sub/b.txt": "banana", "c.txt": "banana"} {
+		if _, err := target.Save(name, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the SHA-256 digest of "banana"
+	sum := "b493d48364afe44d11c0165cf470a4164d1e2609911ef998be868d46ade3de4e"
+
+	found, err := target.FindSHA256(sum, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(found, []string{"c.txt", "sub/b.txt"}) {
+		t.Errorf("expected to find c.txt and sub/b.txt, but got %q", found)
+	}
+
+	// files of another size are not even read
+	found, err = target.FindSHA256(sum, 5)
+	if err != nil || len(found) != 0 {
+		t.Errorf("expected to find nothing of the wrong size, but got %q, %v", found, err)
+	}
+
+	found, err = target.FindSHA256(strings.Repeat("0", 64), 6)
+	if err != nil || len(found) != 0 {
+		t.Errorf("expected to find nothing, but got %q, %v", found, err)
+	}
+}
+
+// failingReader returns n bytes of content, and then err
+type failingReader struct {
+	n   int
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	if f.n == 0 {
+		return 0, f.err
+	}
+	if len(p) > f.n {
+		p = p[:f.n]
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	f.n -= len(p)
+	return len(p), nil
+}
+
+func TestDiskTarget_SaveAtomic(t *testing.T) {
+	target := DiskTarget{Dir: filepath.Join("testdata", "uploads", "atomic")}
+	defer os.RemoveAll(target.Dir)
+
+	_, err := target.Save("partial.txt", &failingReader{n: 50000, err: errors.New("connection reset")})
+	if err == nil {
+		t.Fatal("expected an error, but none received")
+	}
+
+	entries, err := os.ReadDir(target.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// neither the file nor its temporary file should remain
+	for _, entry := range entries {
+		t.Errorf("expected the directory to be empty, but found %s", entry.Name())
+	}
+
+	// a failed save leaves an existing file untouched
+	if _, err := target.Save("partial.txt", strings.NewReader("complete")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := target.Save("partial.txt", &failingReader{n: 3, err: errors.New("connection reset")}); err == nil {
+		t.Fatal("expected an error, but none received")
+	}
+
+	content, err := os.ReadFile(filepath.Join(target.Dir, "partial.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "complete" {
+		t.Errorf("expected the existing file to be untouched, but got %q", content)
+	}
+
+	// the file is given the same mode as a file made with os.Create, which respects the umask
+	created, err := os.Create(filepath.Join(target.Dir, "created.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = created.Close()
+
+	expected, err := os.Stat(created.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(target.Dir, "partial.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != expected.Mode().Perm() {
+		t.Errorf("expected the file mode to be %v, but got %v", expected.Mode().Perm(), info.Mode().Perm())
+	}
+}
+
+func TestDiskTarget_SaveNew(t *testing.T) {
+	target := DiskTarget{Dir: filepath.Join("testdata", "uploads", "savenew")}
+	defer os.RemoveAll(target.Dir)
+
+	if _, err := target.SaveNew("hello.txt", strings.NewReader("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := target.SaveNew("hello.txt", strings.NewReader("goodbye"))
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected an error wrapping fs.ErrExist, but got %v", err)
+	}
+
+	if _, err := target.Save("other.txt", strings.NewReader("other")); err != nil {
+		t.Fatal(err)
+	}
+	err = target.RenameNew("other.txt", "hello.txt")
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected an error wrapping fs.ErrExist, but got %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(target.Dir, "hello.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "hello, world" {
+		t.Errorf("expected the existing file to be untouched, but got %q", content)
+	}
+
+	// neither leaves anything behind but the files saved
+	entries, err := os.ReadDir(target.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected hello.txt and other.txt, but found %d files", len(entries))
+	}
+
+	if err := target.RenameNew("other.txt", "sub/moved.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(target.Dir, "other.txt")); !os.IsNotExist(err) {
+		t.Error("expected other.txt to have been moved")
+	}
+}
+
+func TestTools_UploadFiles_Interrupted(t *testing.T) {
+	uploadDir := filepath.Join("testdata", "uploads", "interrupted")
+	defer os.RemoveAll(uploadDir)
+
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(uploadDir, "data.txt"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// a request whose body is cut off part of the way through the file
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "data.txt", content: bytes.Repeat([]byte("x"), 100000)})
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body[:50000]))
+
+	var testTools Tools
+	if _, err := testTools.UploadFiles(req, uploadDir, false); err == nil {
+		t.Fatal("expected an error for an interrupted upload, but none received")
+	}
+
+	// the file it would have replaced is untouched, and no temporary file is left behind
+	content, err := os.ReadFile(filepath.Join(uploadDir, "data.txt"))
+	if err != nil || string(content) != "original" {
+		t.Errorf("expected the existing file to be untouched, but got %q, %v", content, err)
+	}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected only data.txt to remain, but found %d files", len(entries))
+	}
+}
+
+func TestDiskTarget_SaveIgnoresTempDir(t *testing.T) {
+	// uploads never buffer in the system's temporary directory, so they still work without one
+	t.Setenv("TMPDIR", filepath.Join("testdata", "missing"))
+	t.Setenv("TMP", filepath.Join("testdata", "missing"))
+	t.Setenv("TEMP", filepath.Join("testdata", "missing"))
+
+	uploadDir := filepath.Join("testdata", "uploads", "tempdir")
+	defer os.RemoveAll(uploadDir)
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: newTestPNG(t, 20, 10)})
+
+	testTools := Tools{GenerateThumbnails: true, StripImageMetadata: true}
+	if _, err := testTools.UploadFiles(req, uploadDir, true); err != nil {
+		t.Errorf("unexpected error uploading without a temporary directory: %s", err)
+	}
+}
@@ -2,16 +2,34 @@ package toolkit
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/fs"
+	"math/big"
+	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const randomStringSource = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_+"
@@ -19,198 +37,2526 @@ const randomStringSource = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ
 // Tools is the type used to instantiate this module. Any variable of this type will have access
 // to all the methods with the receiver *Tools
 type Tools struct {
-	MaxFileSize        int
-	AllowedFileType    []string
+	MaxFileSize int64
+
+	// AllowedFileType, if set, lists the only content types accepted for upload. Each may use * as
+	// a wildcard, as in "image/*", or be * alone to accept any type, and one without parameters, such
+	// as "text/plain", matches a type whatever its parameters
+	AllowedFileType []string
+
+	// AllowedFileExtensions, if set, lists the only extensions, with or without a leading dot, which
+	// uploaded files may have, ignoring case. Set RequireExtensionMatch as well to reject files, such
+	// as a PNG image named "photo.jpg", whose detected type is not the one expected for their extension
+	AllowedFileExtensions []string
+
+	// DisallowedFileType lists content types which are never accepted for upload, whether or not
+	// they are in AllowedFileType. Each may use * as a wildcard, as in "application/x-*"
+	DisallowedFileType []string
+
+	// RequireExtensionMatch, if true, rejects an uploaded file whose detected type is not the one
+	// expected for its extension, such as HTML named "photo.jpg", or whose extension has no known
+	// type. ExtensionMIMEOverrides adds to, or overrides, the built in extensions, mapping them, with
+	// or without a leading dot, to a content type, which may use * as a wildcard, as in "text/*"
+	RequireExtensionMatch  bool
+	ExtensionMIMEOverrides map[string]string
+
+	// AllowedFileNamePattern, if set, must match the original name of every uploaded file
+	AllowedFileNamePattern *regexp.Regexp
+
 	MaxJSONSize        int
 	AllowUnknownFields bool
+
+	// IndentJSON, if true, makes WriteJSON and the functions built on it indent their output, which
+	// is easier to read when debugging
+	IndentJSON bool
+
+	// CompressJSON, if true, lets WriteJSONCompressed compress json with gzip for clients which
+	// accept it
+	CompressJSON bool
+
+	// AllowMultipleJSON, if true, lets ReadJSON be called repeatedly on the same request to decode
+	// a sequence of JSON values, such as newline delimited JSON, one at a time. MaxJSONSize then
+	// limits the size of each value, and ReadJSON returns io.EOF once the body is exhausted.
+	// MaxJSONStreamSize limits the size of the whole body; 100 megs by default
+	AllowMultipleJSON bool
+	MaxJSONStreamSize int64
+
+	// JSONErrorMessages replaces the messages of the errors returned by ReadJSON, which still wrap
+	// the same errors. The keys are "bad_syntax", "wrong_type", "unknown_field", "empty_body",
+	// "too_large" and "multiple_values". In a message, {field} is replaced by the name of the field
+	// for "wrong_type" and "unknown_field", and {limit} by the limit exceeded for "too_large"
+	JSONErrorMessages map[string]string
+
+	// JSONSchema, if set, is a draft-07 JSON Schema which ReadJSON checks each decoded value
+	// against, rejecting one which does not match with a *JSONSchemaError. The format keyword is
+	// ignored, and $ref may only refer to part of the same schema
+	JSONSchema string
+
+	// MaxXMLSize is the largest request body, in bytes, accepted by ReadXML; one meg by default
+	MaxXMLSize int
+
+	// OnUploadProgress, if set, is called as each uploaded file is saved, every time a further
+	// UploadProgressInterval bytes (256KB by default) have been written, and once when the file
+	// is complete. total is -1 if the size of the file is not known in advance
+	OnUploadProgress       func(fileName string, written, total int64)
+	UploadProgressInterval int64
+
+	// MinImageWidth, MinImageHeight, MaxImageWidth and MaxImageHeight, if non-zero, limit the
+	// dimensions in pixels of uploaded GIF, JPEG and PNG images. Other files, including images of
+	// other types, such as WebP, are not checked
+	MinImageWidth  int
+	MinImageHeight int
+	MaxImageWidth  int
+	MaxImageHeight int
+
+	// MaxImagePixels is the largest number of pixels, width times height, which an uploaded image may
+	// have if it is to be decoded, such as to resize it or make a thumbnail. It defaults to 50
+	// million, which takes about 200MB of memory to decode; -1 removes the limit
+	MaxImagePixels int64
+
+	// AllowedImageFormats, if set, lists the formats, such as "jpeg" or "png", which an uploaded image
+	// must actually be encoded in, whatever its detected type. GIF, JPEG and PNG images are decoded
+	// to find their format; other images, such as WebP, are checked by their detected type
+	AllowedImageFormats []string
+
+	// ResizeImages, if true, scales uploaded GIF, JPEG and PNG images which are wider than
+	// ImageMaxWidth or taller than ImageMaxHeight down to fit, keeping their proportions. As with
+	// ConvertImagesTo, animated GIFs are rejected unless KeepAnimatedGIFs is set
+	ResizeImages   bool
+	ImageMaxWidth  int
+	ImageMaxHeight int
+
+	// ContinueOnError, if true, makes UploadFiles carry on with the rest of the files in a request
+	// when one of them can't be uploaded, recording why in the Error field of its UploadedFile.
+	// Only failures of the request as a whole, or of every file in it, are returned as an error
+	ContinueOnError bool
+
+	// GenerateThumbnails, if true, saves a thumbnail of each uploaded GIF, JPEG and PNG image
+	// alongside it, named after the image with ThumbnailSuffix before the extension. An image whose
+	// thumbnail would replace an existing file is rejected
+	GenerateThumbnails bool
+
+	// ThumbnailWidth and ThumbnailHeight are the size thumbnails fit within; 150 by 150 by default
+	ThumbnailWidth  int
+	ThumbnailHeight int
+
+	// ThumbnailSuffix is added to the name of an image to name its thumbnail; "_thumb" by default
+	ThumbnailSuffix string
+
+	// ThumbnailCrop, if true, crops images about their centre to the proportions of thumbnails
+	ThumbnailCrop bool
+
+	// ThumbnailStrict, if true, fails an upload whose thumbnail can't be made, rather than skipping it
+	ThumbnailStrict bool
+
+	// RejectDuplicates, if true, looks in the upload target, which must implement FindSHA256 and
+	// Rename, for a file with the same contents as each uploaded file, which is then not kept
+	RejectDuplicates bool
+
+	// DeduplicateMode says what RejectDuplicates does with a duplicate: "error" (the default)
+	// rejects it, and "reuse" returns the name of the existing file, with Duplicate set
+	DeduplicateMode string
+
+	// CleanupOnError, if true, makes UploadFiles remove every file it has saved if it returns an
+	// error, so that a failed request leaves nothing behind
+	CleanupOnError bool
+
+	// MaxRetries is the number of times PushJSONToRemote retries a request which fails with a
+	// network error or a 5xx response. It waits RetryDelay (100ms by default) before the first
+	// retry, doubling the wait before each one after that, up to a minute
+	MaxRetries int
+	RetryDelay time.Duration
+
+	// DownloadBytesPerSecond, if non-zero, limits the rate at which DownloadStaticFile and the
+	// other functions serving static files send each file
+	DownloadBytesPerSecond int64
+
+	// DownloadCSPHeader and InlineCSPHeader, if set, are sent as the Content-Security-Policy of
+	// files served for download and inline respectively, such as "script-src 'none'" to stop an
+	// SVG or HTML file running scripts
+	DownloadCSPHeader string
+	InlineCSPHeader   string
+
+	// ConvertImagesTo, if set to "png" or "jpeg", converts uploaded GIF, JPEG and PNG images to that
+	// format, changing their extension to match. JPEG images are written with JPEGQuality (75 by
+	// default). Animated GIFs which would be converted or resized are rejected, since only their
+	// first frame would be kept, unless KeepAnimatedGIFs is set, in which case they are saved unchanged
+	ConvertImagesTo  string
+	JPEGQuality      int
+	KeepAnimatedGIFs bool
+
+	// StripImageMetadata, if true, removes metadata such as EXIF, which may include the location a
+	// photo was taken, from uploaded JPEG and PNG images, leaving the image itself unchanged
+	StripImageMetadata bool
+
+	// DecompressGzip, if true, decompresses uploaded files which are gzip compressed, or whose names
+	// end in ".gz", as they are saved. The contents are checked against AllowedFileType,
+	// AllowedFileExtensions and MaxFileSize, and saved without the ".gz" extension
+	DecompressGzip bool
+
+	// SaveUploadMetadata, if true, saves the UploadMetadata of each uploaded file as JSON alongside
+	// it, in a sidecar file named after the file with ".meta.json" appended. A file whose metadata
+	// would replace an existing file is rejected. Neither these files nor thumbnails are found as
+	// duplicates by RejectDuplicates
+	SaveUploadMetadata bool
+
+	// StorageBackend, if set, is where UploadFiles, UploadOneFile and UploadFilesFromMultipart
+	// store uploaded files, in place of the upload directory they are given
+	StorageBackend Storage
+
+	// VirusScanner, if set, scans every uploaded file as it is saved. A file which is not clean is
+	// rejected with ErrInfectedFile, and is not kept
+	VirusScanner VirusScanner
+
+	// MaxUploadCount, if non-zero, is the maximum number of files accepted by a single call to
+	// UploadFiles. Files which fail with ContinueOnError don't count
+	MaxUploadCount int
+
+	// UploadConcurrency, if more than one, is the number of files in a single request which are
+	// checked, processed and saved at once, so functions such as RenameFunc may be called
+	// concurrently. Files over 1MB waiting to be saved are held in TempDir, if set, or else in the
+	// upload directory, or os.TempDir for targets which are not on the local file system
+	UploadConcurrency int
+
+	// MaxTotalUploadSize, if non-zero, is the maximum number of bytes accepted across all of
+	// the files uploaded by a single call to UploadFiles. The body of the request is limited
+	// to this size, plus 1MB for multipart headers and form fields, before it is parsed
+	MaxTotalUploadSize int64
+
+	// MinFileSize, if non-zero, is the smallest number of bytes accepted for an uploaded file, and
+	// RejectEmptyUploads, if true, rejects files with nothing in them. A file which is too small is
+	// not kept
+	MinFileSize        int64
+	RejectEmptyUploads bool
+
+	// RandomStringSource is the set of characters used by RandomString; it defaults to
+	// upper and lower case letters, digits, "_" and "+"
+	RandomStringSource string
+
+	// RenameFunc, if set, is used instead of RandomString to produce the new name of an uploaded
+	// file which is being renamed. The name is sanitized as if it had come from the client, and the
+	// original extension is appended to names without one
+	RenameFunc func(originalName string) string
+
+	// FileNameGenerator, if set, returns the name to store each uploaded file under, given its
+	// original name and detected type, whether or not it is being renamed; "" leaves the name to
+	// RandomString or the original name. As with RenameFunc, the name is sanitized
+	FileNameGenerator func(originalName, mimeType string) string
+
+	// SlugSeparator is used by Slugify and SlugifyUnique to join words; it defaults to "-"
+	SlugSeparator string
+
+	// TransliterateUnicode causes Slugify to convert accented letters to ASCII and romanize Japanese
+	// kana, rather than removing them; kanji are still removed
+	TransliterateUnicode bool
+
+	// TransliterationTable adds to, or overrides, the conversions made by TransliterateUnicode
+	TransliterationTable map[rune]string
+
+	// SlugStopWords are words, such as "the" and "a", which Slugify removes from slugs
+	SlugStopWords []string
+
+	// MaxSlugLength, if non-zero, is the maximum length of a slug produced by Slugify. Longer
+	// slugs are truncated at a word boundary
+	MaxSlugLength int
+
+	// SubdirPattern, if set, is the subdirectory in which each uploaded file is saved, and
+	// NewFileName then includes it. It is a time layout, such as "2006/01/02", formatted in UTC, in
+	// which text in single quotes is literal, and {hash:n} is the first n characters of the Checksum,
+	// for targets which can rename files
+	SubdirPattern string
+
+	// HashAlgorithm is the algorithm used to compute the Checksum of uploaded files; one of
+	// "sha256" (the default), "sha1" or "md5"
+	HashAlgorithm string
+
+	// ChunkDir is the directory in which UploadChunk assembles files uploaded in chunks; it defaults
+	// to toolkit-chunks in TempDir or os.TempDir, which must belong only to the current user
+	ChunkDir string
+
+	// ChunkExpiry is how long a chunked upload is kept without receiving a chunk; 24 hours by default
+	ChunkExpiry time.Duration
+
+	// TempDir, if set, is the directory in which temporary files are made in place of os.TempDir,
+	// such as those holding files waiting to be saved with UploadConcurrency, and, unless ChunkDir is
+	// set, the toolkit-chunks directory in which chunked uploads are assembled. This is useful when
+	// the system's temporary directory is small, such as a tmpfs in a container
+	TempDir string
 }
 
-// RandomString returns a string of random characters of length n, using randomStringSource
-// as the source for the string
+// RandomString returns a string of random characters of length n, using RandomStringSource, or
+// randomStringSource if that is empty, as the source for the string. Characters are drawn from
+// crypto/rand; RandomString panics if the system's source of randomness fails, which
+// RandomStringSecure reports as an error instead
 func (t *Tools) RandomString(n int) string {
-	s, r := make([]rune, n), []rune(randomStringSource)
+	s, err := t.RandomStringSecure(n)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// RandomStringSecure returns a string of random characters of length n, using RandomStringSource,
+// or randomStringSource if that is empty, as the source for the string. Each character is drawn
+// uniformly using crypto/rand, and an error is returned if the system's source of randomness fails
+func (t *Tools) RandomStringSecure(n int) (string, error) {
+	source := randomStringSource
+	if t.RandomStringSource != "" {
+		source = t.RandomStringSource
+	}
+
+	s, r := make([]rune, n), []rune(source)
+	max := big.NewInt(int64(len(r)))
 	for i := range s {
-		p, _ := rand.Prime(rand.Reader, len(r))
-		x, y := p.Uint64(), uint64(len(r))
-		s[i] = r[x%y]
+		x, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		s[i] = r[x.Int64()]
+	}
+	return string(s), nil
+}
+
+// GenerateUUID returns a random (version 4) UUID as defined in RFC 4122, in its canonical
+// lower case form, e.g. 550e8400-e29b-41d4-a716-446655440000
+func (t *Tools) GenerateUUID() string {
+	var u [16]byte
+	_, _ = rand.Read(u[:])
+
+	u[6] = (u[6] & 0x0f) | 0x40 // version 4
+	u[8] = (u[8] & 0x3f) | 0x80 // variant 10
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// ValidateUUID reports whether s is a well-formed UUID. Upper and lower case hex digits are
+// accepted, and the UUID may optionally be wrapped in braces
+func (t *Tools) ValidateUUID(s string) bool {
+	if strings.HasPrefix(s, "{") || strings.HasSuffix(s, "}") {
+		if !strings.HasPrefix(s, "{") || !strings.HasSuffix(s, "}") {
+			return false
+		}
+		s = s[1 : len(s)-1]
+	}
+	return uuidRegexp.MatchString(s)
+}
+
+// UploadedFile is a struct used to save information about an Uploaded file. When ContinueOnError
+// is set, a file which could not be uploaded has only Error, ErrorMessage, OriginalFileName and
+// FieldName set
+type UploadedFile struct {
+	NewFileName      string
+	OriginalFileName string
+
+	// FieldName is the name of the form field the file was sent in
+	FieldName string
+
+	// OriginalMIMEType is the type claimed by the client in the Content-Type header of its part
+	OriginalMIMEType string
+
+	// FileType is the type detected from the file's contents, which is checked against
+	// AllowedFileType, or the type an image was converted to by ConvertImagesTo
+	FileType string
+
+	// FileSize is the number of bytes written to the upload target, counted as the file is copied
+	FileSize int64
+
+	// Checksum is the hex encoded digest, computed with HashAlgorithm, of the bytes written
+	Checksum string
+
+	// OriginalWidth and OriginalHeight are the dimensions of an uploaded image, and FinalWidth and
+	// FinalHeight its dimensions as saved, when ResizeImages or ConvertImagesTo is set
+	OriginalWidth  int
+	OriginalHeight int
+	FinalWidth     int
+	FinalHeight    int
+
+	// ThumbnailFileName is the name of the thumbnail saved with GenerateThumbnails
+	ThumbnailFileName string
+
+	// MetadataFileName is the name of the sidecar file saved with SaveUploadMetadata
+	MetadataFileName string
+
+	// URL is where the file can be found, when it is stored by a StorageBackend
+	URL string
+
+	// FullPath is the path of a file stored on the local file system
+	FullPath string
+
+	// ModTime is when the file was last modified, or for files not on the local file system, stored
+	ModTime time.Time
+
+	// Error is why the file was not uploaded, with ContinueOnError, and ErrorMessage its text,
+	// which is encoded as Error in JSON
+	Error        error  `json:"-"`
+	ErrorMessage string `json:"Error,omitempty"`
+
+	// Duplicate is set when RejectDuplicates found the file had already been stored, in which case
+	// NewFileName is the name of the file stored before, and nothing new was kept
+	Duplicate bool
+
+	// target is where the file is stored, from which Open reads it
+	target UploadTarget
+}
+
+// errCantOpen is returned by UploadedFile.Open when the file is stored somewhere it can't be read from
+var errCantOpen = errors.New("the upload target can't open files")
+
+// Open opens the stored file for reading, wherever it was stored, as long as the upload target can
+// read files, as DiskTarget, S3Target and LocalDiskStorage can. The caller must close it
+func (f *UploadedFile) Open() (io.ReadCloser, error) {
+	opener, ok := f.target.(interface {
+		Open(name string) (io.ReadCloser, error)
+	})
+	if !ok {
+		return nil, fmt.Errorf("unable to open %s: %w", f.NewFileName, errCantOpen)
+	}
+	return opener.Open(f.NewFileName)
+}
+
+// UploadOneFile uploads exactly one file from r to uploadDir. It is an error for the request to
+// contain more than one file
+func (t *Tools) UploadOneFile(r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	mr, err := t.multipartReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := t.uploadTarget(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := t.uploadFiles(r.Context(), mr, target, uploadOptions{rename: renameFile, maxCount: 1})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(files) == 0 {
+		return nil, errors.New("no file was uploaded")
+	}
+
+	if files[0].Error != nil {
+		return nil, files[0].Error
+	}
+
+	return files[0], nil
+}
+
+// UploadFiles uploads every file in the multipart body of r to uploadDir, giving each a random name
+// unless rename is false. It stops as soon as the context of r is done, such as when the client goes
+// away, in the same way as UploadFilesContext
+func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	return t.UploadFilesContext(r.Context(), r, uploadDir, rename...)
+}
+
+// UploadFilesContext uploads files in the same way as UploadFiles, but stops as soon as ctx is done.
+// The file being written at the time is removed, and the error returned wraps ctx.Err() along with
+// the name of that file
+func (t *Tools) UploadFilesContext(ctx context.Context, r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	mr, err := t.multipartReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := t.uploadTarget(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.uploadFiles(ctx, mr, target, uploadOptions{rename: renameFile, maxCount: t.MaxUploadCount})
+}
+
+// UploadFilesForField uploads files in the same way as UploadFiles, but only those sent in the form
+// field named field; files in any other field are skipped. An empty field uploads every file. It is
+// not an error for no file to have been sent in field
+func (t *Tools) UploadFilesForField(r *http.Request, field string, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	mr, err := t.multipartReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	target, err := t.uploadTarget(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.uploadFiles(r.Context(), mr, target, uploadOptions{rename: renameFile, maxCount: t.MaxUploadCount, field: field})
+}
+
+// UploadFilesWithValues uploads files in the same way as UploadFiles, and also returns the values of
+// the form fields which are not files, which can't be read from r once its body has been consumed.
+// No more than 10MB of values are read
+func (t *Tools) UploadFilesWithValues(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, url.Values, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	mr, err := t.multipartReader(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	target, err := t.uploadTarget(uploadDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	values := make(url.Values)
+	uploadedFiles, err := t.uploadFiles(r.Context(), mr, target, uploadOptions{rename: renameFile, maxCount: t.MaxUploadCount, values: values})
+	return uploadedFiles, values, err
+}
+
+// UploadFilesFromMultipart saves every file part read from mr to uploadDir, applying the same
+// validation and rename logic as UploadFiles. It allows multipart data that does not come from an
+// *http.Request, such as a message queue, to be uploaded. Parts which are not files are skipped
+func (t *Tools) UploadFilesFromMultipart(mr *multipart.Reader, uploadDir string, rename bool) ([]*UploadedFile, error) {
+	target, err := t.uploadTarget(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.uploadFiles(context.Background(), mr, target, uploadOptions{rename: rename, maxCount: t.MaxUploadCount})
+}
+
+// ErrInvalidBase64 is wrapped by the error returned by UploadBase64File when its data can't be decoded
+var ErrInvalidBase64 = errors.New("the uploaded file is not valid base64")
+
+// UploadBase64File saves a file sent as base64 encoded data, such as in a JSON body, to uploadDir,
+// applying the same validation and rename logic as UploadFiles. The data may use the standard or URL
+// safe alphabet, with or without padding, and may be a data URI such as "data:image/png;base64,..."
+func (t *Tools) UploadBase64File(data string, fileName string, uploadDir string, rename bool) (*UploadedFile, error) {
+	var contentType string
+	if strings.HasPrefix(data, "data:") {
+		header, encoded, ok := strings.Cut(data, ",")
+		if !ok || !strings.HasSuffix(header, ";base64") {
+			return nil, fmt.Errorf("%w: %s is not a base64 data URI", ErrInvalidBase64, fileName)
+		}
+		contentType = strings.TrimSuffix(strings.TrimPrefix(header, "data:"), ";base64")
+		data = encoded
+	}
+
+	content, err := decodeBase64(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrInvalidBase64, fileName, err)
+	}
+
+	target, err := t.uploadTarget(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	file := uploadSource{r: bytes.NewReader(content), fileName: fileName, contentType: contentType, size: int64(len(content))}
+	return t.uploadFile(context.Background(), file, target, rename)
+}
+
+// decodeBase64 decodes data, which may use the standard or URL safe alphabet, with or without padding
+func decodeBase64(data string) ([]byte, error) {
+	data = strings.TrimSpace(data)
+
+	encoding := base64.StdEncoding
+	if strings.ContainsAny(data, "-_") {
+		encoding = base64.URLEncoding
+	}
+	if !strings.HasSuffix(data, "=") {
+		encoding = encoding.WithPadding(base64.NoPadding)
+	}
+
+	return encoding.DecodeString(data)
+}
+
+// uploadTarget returns the target for files uploaded to uploadDir: StorageBackend if it is set, in
+// which case uploadDir is ignored, or else uploadDir itself, which is created if necessary
+func (t *Tools) uploadTarget(uploadDir string) (UploadTarget, error) {
+	if t.StorageBackend != nil {
+		return storageTarget{t.StorageBackend}, nil
+	}
+
+	err := t.CreateDirIfNotExist(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+	return DiskTarget{Dir: uploadDir}, nil
+}
+
+// UploadFilesTo saves every file uploaded in r to target, applying the same validation and rename
+// logic as UploadFiles. It allows files to be stored somewhere other than the local file system
+func (t *Tools) UploadFilesTo(r *http.Request, target UploadTarget, rename ...bool) ([]*UploadedFile, error) {
+	renameFile := true
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	mr, err := t.multipartReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	return t.uploadFiles(r.Context(), mr, target, uploadOptions{rename: renameFile, maxCount: t.MaxUploadCount})
+}
+
+// maxMultipartOverhead is the number of bytes allowed for the headers and form fields of a multipart
+// request, in addition to MaxTotalUploadSize bytes of files
+const maxMultipartOverhead = 1024 * 1024
+
+// multipartReader returns a reader for the multipart body of r. If MaxTotalUploadSize is set, the
+// size of the whole body is limited before anything is read
+func (t *Tools) multipartReader(r *http.Request) (*multipart.Reader, error) {
+	if t.MaxTotalUploadSize > 0 {
+		r.Body = http.MaxBytesReader(nil, r.Body, t.MaxTotalUploadSize+maxMultipartOverhead)
+	}
+	return r.MultipartReader()
+}
+
+// isBodyTooLarge reports whether err was caused by reading more of a request body than permitted
+// by http.MaxBytesReader
+func isBodyTooLarge(err error) bool {
+	return err != nil && strings.HasSuffix(err.Error(), "http: request body too large")
+}
+
+// uploadOptions holds the settings of a single call to upload files
+type uploadOptions struct {
+	rename   bool
+	maxCount int
+	field    string     // if set, only files sent in this form field are uploaded
+	values   url.Values // if set, the values of the fields which are not files are added to it
+}
+
+// maxFormValuesSize is the number of bytes of form values which are read along with uploaded files
+const maxFormValuesSize = 10 << 20
+
+// uploadFiles saves every file part read from mr to target, until ctx is done. If CleanupOnError
+// is set, the files saved are removed again if there is an error
+func (t *Tools) uploadFiles(ctx context.Context, mr *multipart.Reader, target UploadTarget, opts uploadOptions) ([]*UploadedFile, error) {
+	uploadedFiles, err := t.uploadParts(ctx, mr, target, opts)
+	if err != nil && t.CleanupOnError {
+		if errs := removeUploadedFiles(target, uploadedFiles); len(errs) > 0 {
+			return nil, &cleanupError{err: err, errs: errs}
+		}
+		return nil, err
+	}
+
+	return uploadedFiles, err
+}
+
+// uploadParts saves every file part read from mr to target, until ctx is done. If UploadConcurrency
+// is more than one, the files are read one at a time, and then processed and saved by a pool of
+// workers; the files are returned in the order they were read either way
+func (t *Tools) uploadParts(ctx context.Context, mr *multipart.Reader, target UploadTarget, opts uploadOptions) ([]*UploadedFile, error) {
+	var uploadedFiles []*UploadedFile
+
+	var pool *uploadPool
+	if t.UploadConcurrency > 1 {
+		ctx, pool = newUploadPool(ctx, t.UploadConcurrency, t.ContinueOnError)
+		defer pool.cancel()
+	}
+
+	// stop returns the files saved so far, once those being saved by the pool have been, along with
+	// err, or the error which stopped the pool if there is one
+	stop := func(err error) ([]*UploadedFile, error) {
+		if pool == nil {
+			return uploadedFiles, err
+		}
+		files, poolErr := pool.wait()
+		if poolErr != nil {
+			return files, poolErr
+		}
+		return files, err
+	}
+
+	// tooBig removes every file saved, because the request is bigger than MaxTotalUploadSize
+	tooBig := func() ([]*UploadedFile, error) {
+		files, _ := stop(nil)
+		removeUploadedFiles(target, files)
+		return nil, fmt.Errorf("the uploaded files are too big; no more than %d bytes in total permitted", t.MaxTotalUploadSize)
+	}
+
+	// the number of bytes which may still be read before MaxTotalUploadSize is exceeded
+	remaining := t.MaxTotalUploadSize
+	valuesRemaining := int64(maxFormValuesSize)
+
+	// the number of files read, and the number of those which have been, or are being, stored
+	index, count := 0, 0
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return stop(err)
+		}
+
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if isBodyTooLarge(err) {
+			return tooBig()
+		}
+		if err != nil {
+			return stop(err)
+		}
+
+		if part.FileName() == "" && opts.values != nil {
+			value, err := io.ReadAll(io.LimitReader(part, valuesRemaining+1))
+			_ = part.Close()
+			if isBodyTooLarge(err) {
+				return tooBig()
+			}
+			if err != nil {
+				return stop(err)
+			}
+
+			valuesRemaining -= int64(len(value))
+			if valuesRemaining < 0 {
+				return stop(fmt.Errorf("the form values are too big; no more than %d bytes permitted", maxFormValuesSize))
+			}
+			opts.values.Add(part.FormName(), string(value))
+			continue
+		}
+
+		if part.FileName() == "" || (opts.field != "" && part.FormName() != opts.field) {
+			_ = part.Close()
+			continue
+		}
+
+		// files which failed don't count towards the limit, and those still being saved may yet fail
+		if opts.maxCount > 0 && count == opts.maxCount && pool != nil {
+			count = pool.stored()
+		}
+		if opts.maxCount > 0 && count == opts.maxCount {
+			_ = part.Close()
+			files, _ := stop(nil)
+			removeUploadedFiles(target, files)
+			return nil, fmt.Errorf("too many files uploaded; no more than %d permitted", opts.maxCount)
+		}
+		index++
+		count++
+
+		var src io.Reader = part
+		if t.MaxTotalUploadSize > 0 {
+			src = &quotaReader{r: part, remaining: &remaining, err: errQuotaExceeded}
+		}
+
+		size := int64(-1)
+		if n, err := strconv.ParseInt(part.Header.Get("Content-Length"), 10, 64); err == nil {
+			size = n
+		}
+
+		file := uploadSource{r: src, fileName: part.FileName(), fieldName: part.FormName(), contentType: part.Header.Get("Content-Type"), size: size}
+
+		if pool != nil {
+			// no more of the request is read until there is a worker free to take the file
+			if err := pool.acquire(); err != nil {
+				_ = part.Close()
+				return stop(err)
+			}
+
+			spooled, err := spoolFile(&contextReader{ctx: ctx, r: src}, t.maxFileSize(), t.spoolDir(target))
+			_ = part.Close()
+			switch {
+			case errors.Is(err, errQuotaExceeded) || isBodyTooLarge(err):
+				pool.release()
+				return tooBig()
+			case errors.Is(err, errFileTooBig):
+				// the file fails in the same way as one found to be too big as it is saved
+				err = t.uploadError(ctx, file.fileName, err)
+				pool.upload(index-1, file, func(uploadSource) (*UploadedFile, error) {
+					return nil, err
+				})
+				continue
+			case err != nil:
+				pool.release()
+				return stop(t.uploadError(ctx, file.fileName, err))
+			}
+
+			file.r, file.size = spooled, spooled.size
+			pool.upload(index-1, file, func(file uploadSource) (*UploadedFile, error) {
+				defer spooled.close()
+				return t.uploadFile(ctx, file, target, opts.rename)
+			})
+			continue
+		}
+
+		uploadedFile, err := t.uploadFile(ctx, file, target, opts.rename)
+		_ = part.Close()
+		if errors.Is(err, errQuotaExceeded) || isBodyTooLarge(err) {
+			return tooBig()
+		}
+		if err != nil && t.ContinueOnError && ctx.Err() == nil {
+			uploadedFiles = append(uploadedFiles, failedUpload(file, err))
+			count--
+			continue
+		}
+		if err != nil {
+			return uploadedFiles, err
+		}
+
+		uploadedFiles = append(uploadedFiles, uploadedFile)
+	}
+
+	if pool != nil {
+		var err error
+		uploadedFiles, err = pool.wait()
+		if err != nil {
+			return uploadedFiles, err
+		}
+	}
+
+	if t.ContinueOnError && allFailed(uploadedFiles) {
+		if len(uploadedFiles) == 1 {
+			return uploadedFiles, uploadedFiles[0].Error
+		}
+		return uploadedFiles, fmt.Errorf("none of the %d uploaded files could be saved: %w", len(uploadedFiles), uploadedFiles[0].Error)
+	}
+
+	return uploadedFiles, nil
+}
+
+// uploadPool processes and saves uploaded files on up to a fixed number of goroutines at once. The
+// first error, unless errors are being collected in the files they belong to, cancels the others
+type uploadPool struct {
+	ctx             context.Context
+	cancel          context.CancelFunc
+	slots           chan struct{}
+	continueOnError bool
+
+	wg    sync.WaitGroup
+	mu    sync.Mutex
+	files map[int]*UploadedFile // by the order in which the files were read
+	err   error
+}
+
+// newUploadPool returns a pool of n workers, and a context which is cancelled by the first error
+func newUploadPool(ctx context.Context, n int, continueOnError bool) (context.Context, *uploadPool) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &uploadPool{
+		ctx:             ctx,
+		cancel:          cancel,
+		slots:           make(chan struct{}, n),
+		continueOnError: continueOnError,
+		files:           make(map[int]*UploadedFile),
+	}
+}
+
+// acquire waits for a worker to be free, and reserves it
+func (p *uploadPool) acquire() error {
+	select {
+	case p.slots <- struct{}{}:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+// release frees a worker reserved by acquire
+func (p *uploadPool) release() {
+	<-p.slots
+}
+
+// upload runs save with file on the worker reserved by acquire. i is the position of the file in the
+// request
+func (p *uploadPool) upload(i int, file uploadSource, save func(uploadSource) (*UploadedFile, error)) {
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+		defer p.release()
+
+		uploadedFile, err := save(file)
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		switch {
+		case err != nil && p.continueOnError && p.ctx.Err() == nil:
+			p.files[i] = failedUpload(file, err)
+		case err != nil:
+			if p.err == nil {
+				p.err = err
+				p.cancel()
+			}
+		default:
+			p.files[i] = uploadedFile
+		}
+	}()
+}
+
+// stored waits for every file to be saved, and returns the number which were
+func (p *uploadPool) stored() int {
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	n := 0
+	for _, f := range p.files {
+		if f.Error == nil {
+			n++
+		}
+	}
+	return n
+}
+
+// wait waits for every file to be saved, and returns those which were, in the order they were read,
+// along with the first error
+func (p *uploadPool) wait() ([]*UploadedFile, error) {
+	p.wg.Wait()
+
+	indexes := make([]int, 0, len(p.files))
+	for i := range p.files {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	files := make([]*UploadedFile, len(indexes))
+	for n, i := range indexes {
+		files[n] = p.files[i]
+	}
+	return files, p.err
+}
+
+// tempDir returns the directory in which temporary files are made
+func (t *Tools) tempDir() string {
+	if t.TempDir != "" {
+		return t.TempDir
+	}
+	return os.TempDir()
+}
+
+// maxSpoolMemory is the largest file which is held in memory while it waits to be saved by an
+// uploadPool; larger files are held in a temporary file
+const maxSpoolMemory = 1024 * 1024
+
+// spooledFile is an uploaded file which has been read ahead of being saved, and is held in memory,
+// or if it is large, in a temporary file, which close removes
+type spooledFile struct {
+	io.Reader
+	size int64
+	file *os.File
+}
+
+// spoolDir returns the directory in which files waiting to be saved to target are held: TempDir, if
+// it is set, or else the directory in which target saves files, if it saves them on the local file
+// system, and otherwise os.TempDir
+func (t *Tools) spoolDir(target UploadTarget) string {
+	if t.TempDir != "" {
+		return t.TempDir
+	}
+
+	switch target := target.(type) {
+	case DiskTarget:
+		return target.Dir
+	case *DiskTarget:
+		return target.Dir
+	case storageTarget:
+		if local, ok := target.Storage.(LocalDiskStorage); ok {
+			return local.Dir
+		}
+	}
+	return os.TempDir()
+}
+
+// spoolFile reads all of r, which must be no more than limit bytes, or else errFileTooBig is returned.
+// A file too big to hold in memory is held in a temporary file in dir
+func spoolFile(r io.Reader, limit int64, dir string) (*spooledFile, error) {
+	r = io.LimitReader(r, limit+1)
+
+	head, err := io.ReadAll(io.LimitReader(r, maxSpoolMemory+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(head)) > limit {
+		return nil, errFileTooBig
+	}
+	if len(head) <= maxSpoolMemory {
+		return &spooledFile{Reader: bytes.NewReader(head), size: int64(len(head))}, nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	// the name begins with tempFilePrefix, so that it is never found as a duplicate
+	f, err := os.CreateTemp(dir, tempFilePrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	s := &spooledFile{file: f}
+
+	n, err := io.Copy(f, io.MultiReader(bytes.NewReader(head), r))
+	if err == nil && n > limit {
+		err = errFileTooBig
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+
+	s.Reader, s.size = f, n
+	return s, nil
+}
+
+func (s *spooledFile) close() {
+	if s.file != nil {
+		_ = s.file.Close()
+		_ = os.Remove(s.file.Name())
+	}
+}
+
+// failedUpload returns the UploadedFile recorded for file when it can't be uploaded because of err
+func failedUpload(file uploadSource, err error) *UploadedFile {
+	return &UploadedFile{OriginalFileName: file.fileName, FieldName: file.fieldName, Error: err, ErrorMessage: err.Error()}
+}
+
+// allFailed reports whether there is at least one file in uploadedFiles, and every one has an Error
+func allFailed(uploadedFiles []*UploadedFile) bool {
+	for _, f := range uploadedFiles {
+		if f.Error == nil {
+			return false
+		}
+	}
+	return len(uploadedFiles) > 0
+}
+
+var (
+	errQuotaExceeded = errors.New("upload quota exceeded")
+	errFileTooBig    = errors.New("the uploaded file is too big")
+	errFileTooSmall  = errors.New("the uploaded file is too small")
+)
+
+// quotaReader reads from r, and returns err once more than remaining bytes have been read.
+// remaining may be shared by the readers of every part of a request
+type quotaReader struct {
+	r         io.Reader
+	remaining *int64
+	err       error
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	if *q.remaining < 0 {
+		return 0, q.err
+	}
+
+	// never read more than one byte beyond the quota
+	if int64(len(p)) > *q.remaining+1 {
+		p = p[:*q.remaining+1]
+	}
+
+	n, err := q.r.Read(p)
+	*q.remaining -= int64(n)
+	if *q.remaining < 0 {
+		return n, q.err
+	}
+	return n, err
+}
+
+// maxFileSize returns the largest number of bytes accepted for an uploaded file; one gigabyte if
+// MaxFileSize is not set
+func (t *Tools) maxFileSize() int64 {
+	if t.MaxFileSize == 0 {
+		return 1024 * 1024 * 1024
+	}
+	return t.MaxFileSize
+}
+
+// minFileSize returns the smallest number of bytes accepted for an uploaded file
+func (t *Tools) minFileSize() int64 {
+	if t.RejectEmptyUploads && t.MinFileSize < 1 {
+		return 1
+	}
+	return t.MinFileSize
+}
+
+// minSizeReader reads from r, and returns errFileTooSmall in place of io.EOF if fewer than min bytes
+// were read, so that the file is not saved
+type minSizeReader struct {
+	r   io.Reader
+	min int64
+	n   int64
+}
+
+func (m *minSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	m.n += int64(n)
+	if err == io.EOF && m.n < m.min {
+		return n, errFileTooSmall
+	}
+	return n, err
+}
+
+// contextReader reads from r until ctx is done, after which every read returns ctx.Err()
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// interruptibleReader reads from r, returning ctx.Err() as soon as ctx is done, even while a read is
+// waiting for more data. A read which is abandoned carries on in the background, into a buffer of
+// its own, until r returns, and r is not read again
+type interruptibleReader struct {
+	ctx context.Context
+	r   io.Reader
+	buf []byte
+}
+
+type readResult struct {
+	n   int
+	err error
+}
+
+func (i *interruptibleReader) Read(p []byte) (int, error) {
+	if err := i.ctx.Err(); err != nil {
+		return 0, err
+	}
+	if len(i.buf) < len(p) {
+		i.buf = make([]byte, len(p))
+	}
+	buf := i.buf[:len(p)]
+
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := i.r.Read(buf)
+		done <- readResult{n, err}
+	}()
+
+	select {
+	case res := <-done:
+		return copy(p, buf[:res.n]), res.err
+	case <-i.ctx.Done():
+		// the buffer may still be written to, so it is never used again
+		i.buf = nil
+		return 0, i.ctx.Err()
+	}
+}
+
+// progressReader reads from r, calling fn each time at least interval more bytes have been read, and
+// once more when r is exhausted. A panic in fn is returned as an error
+type progressReader struct {
+	r        io.Reader
+	fn       func(fileName string, written, total int64)
+	fileName string
+	total    int64
+	interval int64
+	written  int64
+	reported int64
+	done     bool
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.written += int64(n)
+
+	if p.written-p.reported >= p.interval || (err == io.EOF && !p.done) {
+		p.done = err == io.EOF
+		if perr := p.report(); perr != nil {
+			return n, perr
+		}
+	}
+	return n, err
+}
+
+func (p *progressReader) report() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("upload progress callback for %s panicked: %v", p.fileName, r)
+		}
+	}()
+
+	p.reported = p.written
+	p.fn(p.fileName, p.written, p.total)
+	return nil
+}
+
+// removeUploadedFiles deletes files which have already been saved to target, and returns an error
+// for each file which could not be removed. Files which were there before the upload are left alone
+func removeUploadedFiles(target UploadTarget, files []*UploadedFile) []error {
+	var errs []error
+
+	remover, ok := target.(interface{ Remove(name string) error })
+	for _, f := range files {
+		if f.Error != nil || f.Duplicate {
+			continue
+		}
+		if !ok {
+			errs = append(errs, fmt.Errorf("unable to remove %s: the upload target can't remove files", f.NewFileName))
+			continue
+		}
+
+		if err := remover.Remove(f.NewFileName); err != nil {
+			errs = append(errs, err)
+		}
+		for _, extra := range []string{f.ThumbnailFileName, f.MetadataFileName} {
+			if extra == "" {
+				continue
+			}
+			if err := remover.Remove(extra); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	return errs
+}
+
+// cleanupError is returned by UploadFiles when CleanupOnError is set, and some of the files which
+// had been uploaded could not be removed after err
+type cleanupError struct {
+	err  error
+	errs []error
+}
+
+func (e *cleanupError) Error() string {
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+	return fmt.Sprintf("%s (cleaning up the uploaded files also failed: %s)", e.err, strings.Join(msgs, "; "))
+}
+
+func (e *cleanupError) Unwrap() error {
+	return e.err
+}
+
+// uploadSource is a file to be uploaded
+type uploadSource struct {
+	r           io.Reader
+	fileName    string // the name of the original file, as supplied by the client
+	fieldName   string // the name of the form field the file was sent in, if any
+	contentType string // the content type supplied by the client, if any
+	size        int64  // the size of the file, or -1 if it is not known
+
+	mustNotExist bool // whether the file must not replace an existing file of the same name
+}
+
+// uploadFile checks the contents of file against the permitted file types and saves it to target.
+// Reading the file stops as soon as ctx is done
+func (t *Tools) uploadFile(ctx context.Context, file uploadSource, target UploadTarget, renameFile bool) (*UploadedFile, error) {
+	var uploadedFile UploadedFile
+	fileName := file.fileName
+
+	// never trust the name supplied by the client
+	safeName, err := sanitizeFileName(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := t.checkSubdirPattern(target); err != nil {
+		return nil, err
+	}
+	if err := t.checkDeduplicate(target); err != nil {
+		return nil, err
+	}
+	uploadedAt := time.Now().UTC()
+
+	var src io.Reader = &contextReader{ctx: ctx, r: file.r}
+
+	buff, err := readHeader(src)
+	if err != nil {
+		return nil, err
+	}
+	fileType := http.DetectContentType(buff)
+
+	// the name the extension is checked against, which for a compressed file is that of its contents
+	innerName := fileName
+
+	if t.DecompressGzip && (fileType == "application/x-gzip" || strings.EqualFold(filepath.Ext(fileName), ".gz")) {
+		gz, err := gzip.NewReader(io.MultiReader(bytes.NewReader(buff), src))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress the uploaded file %s: %w", fileName, err)
+		}
+		src = gz
+
+		buff, err = readHeader(src)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress the uploaded file %s: %w", fileName, err)
+		}
+		fileType = http.DetectContentType(buff)
+
+		if strings.EqualFold(filepath.Ext(fileName), ".gz") {
+			innerName = strings.TrimSuffix(fileName, filepath.Ext(fileName))
+			safeName = strings.TrimSuffix(safeName, filepath.Ext(safeName))
+		}
+		file.size = -1
+	}
+
+	// check to see if the file type is permitted
+	allowed := false
+
+	// an explicitly disallowed type is rejected, even if it is also allowed
+	for _, x := range t.DisallowedFileType {
+		if matchFileType(fileType, x) {
+			return nil, fmt.Errorf("the uploaded file type is not permitted: %s was detected as %s", fileName, fileType)
+		}
+	}
+
+	if len(t.AllowedFileType) > 0 {
+		for _, x := range t.AllowedFileType {
+			if matchFileType(fileType, x) {
+				allowed = true
+			}
+		}
+	} else {
+		allowed = true
+	}
+
+	if !allowed {
+		return nil, fmt.Errorf("the uploaded file type is not permitted: %s was detected as %s", fileName, fileType)
+	}
+
+	// check to see if the file extension is permitted; the type and the extension must both pass
+	if !t.extensionAllowed(innerName) {
+		return nil, fmt.Errorf("the uploaded file extension is not permitted: %s does not end in one of %s", innerName, strings.Join(t.AllowedFileExtensions, ", "))
+	}
+
+	if err := t.checkExtensionMatch(innerName, fileType); err != nil {
+		return nil, err
+	}
+
+	if t.AllowedFileNamePattern != nil && !t.AllowedFileNamePattern.MatchString(fileName) {
+		return nil, fmt.Errorf("the uploaded file name %s is not permitted", fileName)
+	}
+
+	// read the bytes used to detect the file type back in front of the rest of the file
+	maxSize := t.maxFileSize()
+	contents := io.MultiReader(bytes.NewReader(buff), src)
+	contents = &quotaReader{r: contents, remaining: &maxSize, err: errFileTooBig}
+
+	contents, err = t.checkImageFormat(contents, fileName, fileType)
+	if err != nil {
+		return nil, t.uploadError(ctx, fileName, err)
+	}
+
+	contents, err = t.checkImageDimensions(contents, fileName, fileType)
+	if err != nil {
+		return nil, t.uploadError(ctx, fileName, err)
+	}
+
+	detectedType := fileType
+	contents, fileType, err = t.processImage(contents, fileName, fileType, &uploadedFile)
+	if err != nil {
+		return nil, t.uploadError(ctx, fileName, err)
+	}
+
+	contents, err = t.stripImageMetadata(contents, fileName, fileType)
+	if err != nil {
+		return nil, t.uploadError(ctx, fileName, err)
+	}
+
+	// a converted image is stored with the extension of its new type
+	if fileType != detectedType {
+		safeName = strings.TrimSuffix(safeName, filepath.Ext(safeName)) + imageExtension(fileType)
+	}
+
+	var generatedName string
+	if t.FileNameGenerator != nil {
+		generatedName = t.FileNameGenerator(fileName, fileType)
+	}
+
+	// names chosen by the caller must not replace an existing file
+	mustNotExist := file.mustNotExist
+
+	// names chosen by the caller are sanitized in the same way as those sent by the client
+	switch {
+	case generatedName != "":
+		if uploadedFile.NewFileName, err = sanitizeFileName(generatedName); err != nil {
+			return nil, err
+		}
+		mustNotExist = true
+	case renameFile && t.RenameFunc != nil:
+		if uploadedFile.NewFileName, err = sanitizeFileName(t.RenameFunc(fileName)); err != nil {
+			return nil, err
+		}
+		if filepath.Ext(uploadedFile.NewFileName) == "" {
+			uploadedFile.NewFileName += filepath.Ext(safeName)
+		}
+		mustNotExist = true
+	case renameFile:
+		uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(safeName))
+	default:
+		uploadedFile.NewFileName = safeName
+	}
+
+	// a subdirectory which depends on the checksum, or whether the file is a duplicate, can only be
+	// known once the file has been saved, so until then the file is saved under a temporary name
+	var finalName string
+	if t.RejectDuplicates || subdirHashToken.MatchString(t.SubdirPattern) {
+		finalName = uploadedFile.NewFileName
+		uploadedFile.NewFileName = tempFilePrefix + t.RandomString(25)
+	} else {
+		dir, err := t.subdir(uploadedAt, "")
+		if err != nil {
+			return nil, err
+		}
+		uploadedFile.NewFileName = path.Join(dir, uploadedFile.NewFileName)
+
+		if mustNotExist {
+			if err := checkNotExists(target, uploadedFile.NewFileName); err != nil {
+				return nil, err
+			}
+		}
+		if err := t.checkSidecarsNotExist(target, uploadedFile.NewFileName, fileType); err != nil {
+			return nil, err
+		}
+	}
+
+	uploadedFile.OriginalFileName = fileName
+	uploadedFile.FieldName = file.fieldName
+	uploadedFile.OriginalMIMEType = file.contentType
+	uploadedFile.FileType = fileType
+
+	h, err := t.newHash()
+	if err != nil {
+		return nil, err
+	}
+
+	if minSize := t.minFileSize(); minSize > 0 {
+		contents = &minSizeReader{r: contents, min: minSize}
+	}
+
+	if t.OnUploadProgress != nil {
+		interval := t.UploadProgressInterval
+		if interval <= 0 {
+			interval = 256 * 1024
+		}
+		contents = &progressReader{r: contents, fn: t.OnUploadProgress, fileName: fileName, total: file.size, interval: interval}
+	}
+
+	// keep a copy of an image to make its thumbnail from once it has been saved
+	var saved bytes.Buffer
+	if t.makesThumbnail(fileType) {
+		contents = io.TeeReader(contents, &saved)
+	}
+
+	// the end of the file is only reached once the scanner has found it to be clean
+	if t.VirusScanner != nil {
+		scan := newScanReader(contents, t.VirusScanner, fileName)
+		defer scan.close()
+		contents = scan
+	}
+
+	// duplicates are found by their SHA-256 digest, whatever HashAlgorithm is
+	var sum hash.Hash
+	var checksums io.Writer = h
+	if t.RejectDuplicates {
+		sum = sha256.New()
+		checksums = io.MultiWriter(h, sum)
+	}
+
+	save := saveTo
+	if mustNotExist && finalName == "" {
+		save = saveNewTo
+	}
+	fileSize, err := save(target, uploadedFile.NewFileName, fileType, io.TeeReader(contents, checksums))
+	if err != nil {
+		return nil, t.uploadError(ctx, fileName, err)
+	}
+	uploadedFile.FileSize = fileSize
+	uploadedFile.Checksum = hex.EncodeToString(h.Sum(nil))
+
+	if finalName != "" {
+		var duplicate string
+		if t.RejectDuplicates {
+			duplicate, err = t.placeUnlessDuplicate(target, &uploadedFile, finalName, hex.EncodeToString(sum.Sum(nil)), uploadedAt, mustNotExist)
+		} else {
+			err = t.moveToSubdir(target, &uploadedFile, finalName, uploadedAt, mustNotExist)
+		}
+
+		// until it has been moved into place, only the temporary file is removed
+		if err != nil || duplicate != "" {
+			removeUploadedFiles(target, []*UploadedFile{&uploadedFile})
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if duplicate != "" {
+			if !strings.EqualFold(t.DeduplicateMode, "reuse") {
+				return nil, fmt.Errorf("the uploaded file %s is a duplicate of %s", fileName, duplicate)
+			}
+
+			uploadedFile.NewFileName = duplicate
+			uploadedFile.Duplicate = true
+			if storage, ok := target.(storageTarget); ok {
+				uploadedFile.URL = storage.URL(uploadedFile.NewFileName)
+			}
+			describeStored(target, &uploadedFile)
+			return &uploadedFile, nil
+		}
+
+		// the names of the thumbnail and metadata file are only known once the file has been moved
+		// into place, so it is removed again if either would replace an existing file
+		if err := t.checkSidecarsNotExist(target, uploadedFile.NewFileName, fileType); err != nil {
+			removeUploadedFiles(target, []*UploadedFile{&uploadedFile})
+			return nil, err
+		}
+	}
+
+	if storage, ok := target.(storageTarget); ok {
+		uploadedFile.URL = storage.URL(uploadedFile.NewFileName)
+	}
+
+	if t.makesThumbnail(fileType) {
+		err = t.saveThumbnail(saved.Bytes(), target, &uploadedFile)
+		if err != nil && t.ThumbnailStrict {
+			removeUploadedFiles(target, []*UploadedFile{&uploadedFile})
+			return nil, err
+		}
+	}
+
+	if t.SaveUploadMetadata {
+		err = saveMetadata(target, &uploadedFile)
+		if err != nil {
+			removeUploadedFiles(target, []*UploadedFile{&uploadedFile})
+			return nil, err
+		}
+	}
+
+	describeStored(target, &uploadedFile)
+	return &uploadedFile, nil
+}
+
+// describeStored sets the fields of uploadedFile which depend on where it was stored in target
+func describeStored(target UploadTarget, uploadedFile *UploadedFile) {
+	uploadedFile.target = target
+	uploadedFile.ModTime = time.Now()
+
+	var dir string
+	switch target := target.(type) {
+	case DiskTarget:
+		dir = target.Dir
+	case *DiskTarget:
+		dir = target.Dir
+	case storageTarget:
+		local, ok := target.Storage.(LocalDiskStorage)
+		if !ok {
+			return
+		}
+		dir = local.Dir
+	default:
+		return
+	}
+
+	uploadedFile.FullPath = filepath.Join(dir, filepath.FromSlash(uploadedFile.NewFileName))
+	if info, err := os.Stat(uploadedFile.FullPath); err == nil {
+		uploadedFile.ModTime = info.ModTime()
+	}
+}
+
+// UploadMetadata is the content of the JSON sidecar file saved alongside each uploaded file when
+// SaveUploadMetadata is set. MIMEType is the FileType of the UploadedFile, and BytesWritten its FileSize
+type UploadMetadata struct {
+	OriginalFileName string
+	MIMEType         string
+	BytesWritten     int64
+	Checksum         string
+	UploadedAt       time.Time
+}
+
+// metadataSuffix is appended to the name of an uploaded file to name its metadata file
+const metadataSuffix = ".meta.json"
+
+// metadataName returns the name of the metadata file saved for the file called name
+func metadataName(name string) string {
+	return name + metadataSuffix
+}
+
+// thumbnailSuffix returns the suffix added to the name of an image to name its thumbnail
+func (t *Tools) thumbnailSuffix() string {
+	if t.ThumbnailSuffix == "" {
+		return "_thumb"
+	}
+	return t.ThumbnailSuffix
+}
+
+// thumbnailName returns the name of the thumbnail saved for the image called name
+func (t *Tools) thumbnailName(name string) string {
+	ext := path.Ext(name)
+	return strings.TrimSuffix(name, ext) + t.thumbnailSuffix() + ext
+}
+
+// isSidecar reports whether the file called name in target is a thumbnail or metadata file rather
+// than an upload. It is only if GenerateThumbnails or SaveUploadMetadata would have saved it, and
+// the file it was saved for is still there
+func (t *Tools) isSidecar(target UploadTarget, name string) (bool, error) {
+	var original string
+	ext := path.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+
+	switch {
+	case t.SaveUploadMetadata && strings.HasSuffix(name, metadataSuffix):
+		original = strings.TrimSuffix(name, metadataSuffix)
+	case t.GenerateThumbnails && strings.HasSuffix(stem, t.thumbnailSuffix()):
+		original = strings.TrimSuffix(stem, t.thumbnailSuffix()) + ext
+	default:
+		return false, nil
+	}
+
+	// without Exists, the name is all there is to go on
+	exister, ok := target.(interface {
+		Exists(name string) (bool, error)
+	})
+	if !ok {
+		return true, nil
+	}
+	return exister.Exists(original)
+}
+
+// checkSidecarsNotExist returns an error if the thumbnail or metadata file which would be saved for
+// the file of type fileType called name would replace an existing file
+func (t *Tools) checkSidecarsNotExist(target UploadTarget, name, fileType string) error {
+	if t.makesThumbnail(fileType) {
+		if err := checkNotExists(target, t.thumbnailName(name)); err != nil {
+			return err
+		}
+	}
+
+	if t.SaveUploadMetadata {
+		return checkNotExists(target, metadataName(name))
+	}
+	return nil
+}
+
+// saveMetadata saves the UploadMetadata of uploadedFile to target, under the name of the file with
+// ".meta.json" appended, unless there is already a file of that name
+func saveMetadata(target UploadTarget, uploadedFile *UploadedFile) error {
+	metadata := UploadMetadata{
+		OriginalFileName: uploadedFile.OriginalFileName,
+		MIMEType:         uploadedFile.FileType,
+		BytesWritten:     uploadedFile.FileSize,
+		Checksum:         uploadedFile.Checksum,
+		UploadedAt:       time.Now().UTC(),
+	}
+
+	out, err := json.MarshalIndent(metadata, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	name := metadataName(uploadedFile.NewFileName)
+	if _, err := saveNewTo(target, name, "application/json", bytes.NewReader(out)); err != nil {
+		return err
+	}
+
+	uploadedFile.MetadataFileName = name
+	return nil
+}
+
+// duplicateLocks is locked for each upload target while looking for a duplicate of a file uploaded to
+// it with RejectDuplicates, and moving the file into place if there is none, so that two copies
+// uploaded at once can't both be kept
+var duplicateLocks keyedMutex
+
+// checkDeduplicate returns an error if RejectDuplicates is set, but DeduplicateMode is not valid, or
+// target can't find duplicates, before anything is uploaded
+func (t *Tools) checkDeduplicate(target UploadTarget) error {
+	if !t.RejectDuplicates {
+		return nil
+	}
+
+	switch strings.ToLower(t.DeduplicateMode) {
+	case "", "error", "reuse":
+	default:
+		return fmt.Errorf("unsupported deduplicate mode %q", t.DeduplicateMode)
+	}
+
+	if _, ok := target.(duplicateFinder); !ok {
+		return errors.New("the upload target does not support finding duplicate files")
+	}
+	if _, ok := target.(renamer); !ok {
+		return errors.New("the upload target does not support finding duplicate files, since it can't rename files")
+	}
+	return nil
+}
+
+// duplicateFinder is implemented by upload targets which can find a stored file by its contents
+type duplicateFinder interface {
+	FindSHA256(sum string, size int64) ([]string, error)
+}
+
+// placeUnlessDuplicate moves the file saved as uploadedFile, under a temporary name, to name in the
+// same way as moveToSubdir, unless target already holds a file of the same size whose hex encoded
+// SHA-256 digest is sum. The name of that file is returned instead, and uploadedFile is left where
+// it is. Only uploads to the same target wait for each other, and only while this is done
+func (t *Tools) placeUnlessDuplicate(target UploadTarget, uploadedFile *UploadedFile, name, sum string, uploadedAt time.Time, mustNotExist bool) (string, error) {
+	unlock := duplicateLocks.lock(lockKey(target))
+	defer unlock()
+
+	// files still being saved have temporary names, which are never found
+	found, err := target.(duplicateFinder).FindSHA256(sum, uploadedFile.FileSize)
+	if err != nil {
+		return "", err
+	}
+
+	// a thumbnail or metadata file is not a duplicate of an upload, even if it has the same contents
+	for _, name := range found {
+		sidecar, err := t.isSidecar(target, name)
+		if err != nil {
+			return "", err
+		}
+		if !sidecar {
+			return name, nil
+		}
+	}
+
+	return "", t.moveToSubdir(target, uploadedFile, name, uploadedAt, mustNotExist)
+}
+
+// saveNewTo stores everything read from r in target under name in the same way as saveTo, unless
+// there is already a file called name, which is left as it is. Targets without SaveNew are checked
+// first, which can't stop a file of the same name being saved at the same time
+func saveNewTo(target UploadTarget, name, contentType string, r io.Reader) (int64, error) {
+	saver, ok := target.(interface {
+		SaveNew(name string, r io.Reader) (int64, error)
+	})
+	if !ok {
+		if err := checkNotExists(target, name); err != nil {
+			return 0, err
+		}
+		return saveTo(target, name, contentType, r)
+	}
+
+	n, err := saver.SaveNew(name, r)
+	if errors.Is(err, fs.ErrExist) {
+		return 0, fmt.Errorf("a file named %s already exists", name)
+	}
+	return n, err
+}
+
+// renameNew moves the file oldName in target, which must be a renamer, to newName, unless there is
+// already a file called newName, in the same way as saveNewTo
+func renameNew(target UploadTarget, oldName, newName string) error {
+	r, ok := target.(interface {
+		RenameNew(oldName, newName string) error
+	})
+	if !ok {
+		if err := checkNotExists(target, newName); err != nil {
+			return err
+		}
+		return target.(renamer).Rename(oldName, newName)
+	}
+
+	err := r.RenameNew(oldName, newName)
+	if errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("a file named %s already exists", newName)
+	}
+	return err
+}
+
+// lockKey returns the key under which uploads to target are locked: the directory of a target on
+// the local file system, so that every target for the same directory shares it, or else the target
+// itself, if it can be compared, or else its type
+func lockKey(target UploadTarget) interface{} {
+	var dir string
+	switch target := target.(type) {
+	case DiskTarget:
+		dir = target.Dir
+	case *DiskTarget:
+		dir = target.Dir
+	case storageTarget:
+		if local, ok := target.Storage.(LocalDiskStorage); ok {
+			dir = local.Dir
+		}
+	}
+
+	if dir != "" {
+		if abs, err := filepath.Abs(dir); err == nil {
+			dir = abs
+		}
+		return "dir:" + filepath.Clean(dir)
+	}
+	if reflect.TypeOf(target).Comparable() {
+		return target
+	}
+	return reflect.TypeOf(target)
+}
+
+// keyedMutex is a set of mutexes, one for each key, which are made when they are first locked, and
+// dropped once nothing holds or waits for them
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[interface{}]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	refs int // the number of callers holding or waiting for the lock
+}
+
+// lock locks the mutex for key, waiting until it is free, and returns the function which unlocks it
+func (k *keyedMutex) lock(key interface{}) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[interface{}]*keyedLock)
+	}
+	l, ok := k.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	k.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		l.refs--
+		if l.refs == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+// checkNotExists returns an error if target already holds a file called name. Names chosen by
+// RenameFunc or FileNameGenerator may collide with an existing file, which must not be overwritten
+func checkNotExists(target UploadTarget, name string) error {
+	exister, ok := target.(interface {
+		Exists(name string) (bool, error)
+	})
+	if !ok {
+		return nil
+	}
+
+	exists, err := exister.Exists(name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return fmt.Errorf("a file named %s already exists", name)
+	}
+	return nil
+}
+
+// subdirHashToken matches the tokens of SubdirPattern which are replaced by the start of the checksum
+var subdirHashToken = regexp.MustCompile(`\{hash:(\d+)\}`)
+
+// subdir returns the subdirectory given by SubdirPattern for a file uploaded at uploadedAt, whose
+// checksum is checksum. If checksum is "", any {hash:n} tokens are left as they are
+func (t *Tools) subdir(uploadedAt time.Time, checksum string) (string, error) {
+	pattern := t.SubdirPattern
+	if pattern == "" {
+		return "", nil
+	}
+
+	// text in quotes is copied as it is, and the rest formatted
+	var dir strings.Builder
+	for rest := pattern; rest != ""; {
+		quote := strings.IndexByte(rest, '\'')
+		if quote < 0 {
+			quote = len(rest)
+		}
+		if err := formatSubdir(&dir, rest[:quote], uploadedAt, checksum); err != nil {
+			return "", fmt.Errorf("invalid SubdirPattern %q: %w", pattern, err)
+		}
+		if quote == len(rest) {
+			break
+		}
+
+		end := strings.IndexByte(rest[quote+1:], '\'')
+		if end < 0 {
+			return "", fmt.Errorf("invalid SubdirPattern %q: the quote at %d is not closed", pattern, len(pattern)-len(rest)+quote)
+		}
+		dir.WriteString(rest[quote+1 : quote+1+end])
+		rest = rest[quote+1+end+1:]
+	}
+
+	// the subdirectory must be inside the upload directory
+	for _, segment := range strings.Split(dir.String(), "/") {
+		if segment == "" || segment == "." || segment == ".." || strings.ContainsAny(segment, `\:`) {
+			return "", fmt.Errorf("invalid SubdirPattern %q: it must be a relative path, such as 2006/01/02", pattern)
+		}
+	}
+	return dir.String(), nil
+}
+
+// formatSubdir writes the part of SubdirPattern layout, which has no quoted text, to dir, formatted
+// with the time uploadedAt, and with each {hash:n} replaced by the start of checksum, or left as it
+// is if checksum is ""
+func formatSubdir(dir *strings.Builder, layout string, uploadedAt time.Time, checksum string) error {
+	// only the text between the tokens is a time layout
+	last := 0
+	for _, m := range subdirHashToken.FindAllStringSubmatchIndex(layout, -1) {
+		dir.WriteString(uploadedAt.Format(layout[last:m[0]]))
+
+		n, err := strconv.Atoi(layout[m[2]:m[3]])
+		switch {
+		case checksum == "":
+			dir.WriteString(layout[m[0]:m[1]])
+		case err != nil || n < 1 || n > len(checksum):
+			return fmt.Errorf("the checksum has only %d characters", len(checksum))
+		default:
+			dir.WriteString(checksum[:n])
+		}
+		last = m[1]
+	}
+	dir.WriteString(uploadedAt.Format(layout[last:]))
+	return nil
+}
+
+// checkSubdirPattern returns an error if SubdirPattern is not valid, before anything is uploaded
+func (t *Tools) checkSubdirPattern(target UploadTarget) error {
+	if t.SubdirPattern == "" {
+		return nil
+	}
+
+	h, err := t.newHash()
+	if err != nil {
+		return err
+	}
+	dir, err := t.subdir(time.Now(), strings.Repeat("0", h.Size()*2))
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(dir, "{}") {
+		return fmt.Errorf("invalid SubdirPattern %q: the only token permitted is {hash:n}", t.SubdirPattern)
+	}
+
+	if subdirHashToken.MatchString(t.SubdirPattern) {
+		if _, ok := target.(renamer); !ok {
+			return fmt.Errorf("invalid SubdirPattern %q: {hash:n} needs an upload target which can rename files", t.SubdirPattern)
+		}
+	}
+	return nil
+}
+
+// renamer is implemented by upload targets which can rename a stored file
+type renamer interface {
+	Rename(oldName, newName string) error
+}
+
+// moveToSubdir renames the file saved as uploadedFile, which must have its Checksum, to name in the
+// subdirectory given by SubdirPattern
+func (t *Tools) moveToSubdir(target UploadTarget, uploadedFile *UploadedFile, name string, uploadedAt time.Time, mustNotExist bool) error {
+	dir, err := t.subdir(uploadedAt, uploadedFile.Checksum)
+	if err != nil {
+		return err
+	}
+	name = path.Join(dir, name)
+
+	if mustNotExist {
+		err = renameNew(target, uploadedFile.NewFileName, name)
+	} else {
+		err = target.(renamer).Rename(uploadedFile.NewFileName, name)
+	}
+	if err != nil {
+		return err
+	}
+	uploadedFile.NewFileName = name
+	return nil
+}
+
+// matchFileType reports whether the content type fileType matches pattern, ignoring case. A pattern
+// without parameters matches fileType whatever its parameters, and may use * as a wildcard, as in
+// "application/x-*". A pattern of * alone matches every type
+func matchFileType(fileType, pattern string) bool {
+	if pattern == "*" || strings.EqualFold(fileType, pattern) {
+		return true
+	}
+
+	mediaType := fileType
+	if i := strings.IndexByte(mediaType, ';'); i >= 0 {
+		mediaType = strings.TrimSpace(mediaType[:i])
+	}
+
+	matched, err := path.Match(strings.ToLower(pattern), strings.ToLower(mediaType))
+	return err == nil && matched
+}
+
+// readHeader reads the first 512 bytes of r, or all of it if it is shorter, which is enough for
+// http.DetectContentType to detect its type
+func readHeader(r io.Reader) ([]byte, error) {
+	buff := make([]byte, 512)
+	n, err := io.ReadFull(r, buff)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	return buff[:n], nil
+}
+
+// uploadError explains why reading or saving the uploaded file fileName failed with err
+func (t *Tools) uploadError(ctx context.Context, fileName string, err error) error {
+	if ctx.Err() != nil {
+		return fmt.Errorf("the upload of %s was stopped: %w", fileName, ctx.Err())
+	}
+	if errors.Is(err, errFileTooBig) {
+		return fmt.Errorf("the uploaded file %s is too big; no more than %d bytes permitted", fileName, t.maxFileSize())
+	}
+	if errors.Is(err, errFileTooSmall) {
+		if t.minFileSize() == 1 {
+			return fmt.Errorf("the uploaded file %s is empty", fileName)
+		}
+		return fmt.Errorf("the uploaded file %s is too small; at least %d bytes required", fileName, t.minFileSize())
+	}
+	return err
+}
+
+// sanitizeFileName strips any directory components from a client supplied file name, and replaces
+// characters which are not permitted in file names on common operating systems with an underscore
+func sanitizeFileName(fileName string) (string, error) {
+	if i := strings.LastIndexAny(fileName, `/\`); i >= 0 {
+		fileName = fileName[i+1:]
+	}
+
+	fileName = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, fileName)
+
+	if fileName == "" || fileName == "." || fileName == ".." {
+		return "", errors.New("the uploaded file name is not permitted")
+	}
+	return fileName, nil
+}
+
+// newHash returns a new hash.Hash for the configured HashAlgorithm
+func (t *Tools) newHash() (hash.Hash, error) {
+	switch strings.ToLower(t.HashAlgorithm) {
+	case "", "sha256":
+		return sha256.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported hash algorithm %q", t.HashAlgorithm)
+	}
+}
+
+// extensionAllowed reports whether the extension of fileName is in AllowedFileExtensions. Extensions
+// are compared case-insensitively, with or without a leading dot. If no extensions are configured,
+// every file is allowed; otherwise a file with no extension is rejected.
+func (t *Tools) extensionAllowed(fileName string) bool {
+	if len(t.AllowedFileExtensions) == 0 {
+		return true
+	}
+
+	ext := strings.TrimPrefix(filepath.Ext(fileName), ".")
+	if ext == "" {
+		return false
+	}
+
+	for _, x := range t.AllowedFileExtensions {
+		if strings.EqualFold(ext, strings.TrimPrefix(x, ".")) {
+			return true
+		}
+	}
+	return false
+}
+
+// extensionTypes maps extensions to the content type which http.DetectContentType detects for files
+// of that type, for RequireExtensionMatch
+var extensionTypes = map[string]string{
+	"jpg":   "image/jpeg",
+	"jpeg":  "image/jpeg",
+	"png":   "image/png",
+	"gif":   "image/gif",
+	"webp":  "image/webp",
+	"bmp":   "image/bmp",
+	"ico":   "image/x-icon",
+	"pdf":   "application/pdf",
+	"ps":    "application/postscript",
+	"zip":   "application/zip",
+	"gz":    "application/x-gzip",
+	"rar":   "application/x-rar-compressed",
+	"wasm":  "application/wasm",
+	"ogg":   "application/ogg",
+	"mp3":   "audio/mpeg",
+	"wav":   "audio/wave",
+	"mp4":   "video/mp4",
+	"webm":  "video/webm",
+	"avi":   "video/avi",
+	"woff":  "font/woff",
+	"woff2": "font/woff2",
+	"ttf":   "font/ttf",
+	"otf":   "font/otf",
+	"txt":   "text/plain",
+	"csv":   "text/plain",
+	"json":  "text/plain",
+	"html":  "text/html",
+	"htm":   "text/html",
+	"xml":   "text/xml",
+}
+
+// checkExtensionMatch returns an error if RequireExtensionMatch is set and fileType, the detected
+// type of fileName, is not the one expected for its extension
+func (t *Tools) checkExtensionMatch(fileName, fileType string) error {
+	if !t.RequireExtensionMatch {
+		return nil
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(fileName), "."))
+
+	expected, ok := extensionTypes[ext]
+	for x, mimeType := range t.ExtensionMIMEOverrides {
+		if strings.EqualFold(ext, strings.TrimPrefix(x, ".")) {
+			expected, ok = mimeType, true
+		}
+	}
+
+	if !ok || ext == "" {
+		return fmt.Errorf("the uploaded file extension is not permitted: the type of %s can't be checked against its extension", fileName)
+	}
+	if !matchFileType(fileType, expected) {
+		return fmt.Errorf("the uploaded file type does not match its extension: %s was detected as %s, but .%s files are %s", fileName, fileType, ext, expected)
+	}
+	return nil
+}
+
+// CreateDirIfNotExist creates a directory, and all necessary parents, if it does not exist. The
+// directories created are given mode, if it is passed, regardless of the umask, or else 0755 less
+// the umask; the permissions of a directory which already exists are left alone
+func (t *Tools) CreateDirIfNotExist(path string, mode ...os.FileMode) error {
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return nil
+	}
+	if len(mode) == 0 {
+		return os.MkdirAll(path, 0755)
+	}
+
+	// the directories which don't exist yet, from path up to the first one which does
+	var created []string
+	for dir := filepath.Clean(path); ; dir = filepath.Dir(dir) {
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			break
+		}
+		created = append(created, dir)
+		if filepath.Dir(dir) == dir {
+			break
+		}
+	}
+
+	err := os.MkdirAll(path, mode[0])
+	if err != nil {
+		return err
+	}
+
+	// MkdirAll applies the umask, which may have removed some of the permissions asked for
+	for _, dir := range created {
+		if err := os.Chmod(dir, mode[0]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveDirIfExists removes a directory, and everything in it, if it exists. It refuses to remove the
+// current directory or the root of a file system, to guard against an empty or mistaken path
+func (t *Tools) RemoveDirIfExists(path string) error {
+	clean := filepath.Clean(path)
+	if clean == "." || filepath.Dir(clean) == clean {
+		return fmt.Errorf("refusing to remove the directory %q", path)
+	}
+
+	info, err := os.Stat(clean)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+
+	return os.RemoveAll(clean)
+}
+
+// Slugify is a (very) simple means of creating a slug from a string. Words are joined with
+// SlugSeparator, or "-" if no separator is set. Characters other than ASCII letters and digits are
+// removed, unless TransliterateUnicode is set and they can be converted to ASCII
+func (t *Tools) Slugify(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("empty string not permitted")
+	}
+
+	separator := t.slugSeparator()
+
+	if t.TransliterateUnicode {
+		s = t.transliterate(s)
+	}
+
+	var re = regexp.MustCompile(`[^a-z\d]+`)
+	slug := re.ReplaceAllLiteralString(strings.ToLower(s), separator)
+	slug = strings.TrimSuffix(strings.TrimPrefix(slug, separator), separator)
+
+	if len(t.SlugStopWords) > 0 {
+		slug = t.removeStopWords(slug, separator)
+	}
+
+	if len(slug) == 0 {
+		return "", errors.New("after removing characters, slug is zero length")
+	}
+
+	if t.MaxSlugLength > 0 && len(slug) > t.MaxSlugLength {
+		return truncateSlug(slug, separator, t.MaxSlugLength)
+	}
+	return slug, nil
+}
+
+// SlugifyUnique creates a slug from s in the same way as Slugify, then appends "-2", "-3" and so on
+// (using SlugSeparator) until exists reports that the slug is not already in use. The slug is
+// shortened to make room for the number if it would otherwise be longer than MaxSlugLength. If
+// exists is nil, SlugifyUnique behaves exactly like Slugify
+func (t *Tools) SlugifyUnique(s string, exists func(slug string) bool) (string, error) {
+	slug, err := t.Slugify(s)
+	if err != nil || exists == nil {
+		return slug, err
+	}
+
+	separator := t.slugSeparator()
+
+	candidate := slug
+	for i := 2; exists(candidate); i++ {
+		suffix := separator + strconv.Itoa(i)
+
+		// the slug is shortened, if need be, to leave room for the suffix within MaxSlugLength
+		base := slug
+		if t.MaxSlugLength > 0 && len(base)+len(suffix) > t.MaxSlugLength {
+			room := t.MaxSlugLength - len(suffix)
+			if room < 1 {
+				return "", fmt.Errorf("no unique slug of up to %d characters can be made", t.MaxSlugLength)
+			}
+			if base, err = truncateSlug(slug, separator, room); err != nil {
+				base = strings.TrimSuffix(slug[:room], separator)
+			}
+		}
+		candidate = base + suffix
+	}
+	return candidate, nil
+}
+
+// slugSeparator returns the separator used to join the words of a slug
+func (t *Tools) slugSeparator() string {
+	if t.SlugSeparator != "" {
+		return t.SlugSeparator
 	}
-	return string(s)
+	return "-"
 }
 
-// UploadedFile is a struct used to save information about an Uploaded file
-type UploadedFile struct {
-	NewFileName      string
-	OriginalFileName string
-	FileSize         int64
+// removeStopWords removes every word in SlugStopWords from slug, ignoring case
+func (t *Tools) removeStopWords(slug, separator string) string {
+	var words []string
+	for _, w := range strings.Split(slug, separator) {
+		stop := false
+		for _, x := range t.SlugStopWords {
+			if strings.EqualFold(w, x) {
+				stop = true
+				break
+			}
+		}
+
+		if !stop {
+			words = append(words, w)
+		}
+	}
+	return strings.Join(words, separator)
 }
 
-func (t *Tools) UploadOneFile(r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
-	renameFile := true
-	if len(rename) > 0 {
-		renameFile = rename[0]
+// truncateSlug drops whole words from the end of slug until it is no longer than max bytes, so that
+// the result never ends in a partial word or a separator
+func truncateSlug(slug, separator string, max int) (string, error) {
+	words := strings.Split(slug, separator)
+	if len(words[0]) > max {
+		return "", fmt.Errorf("the first word of the slug is longer than %d characters", max)
 	}
 
-	files, err := t.UploadFiles(r, uploadDir, renameFile)
-	if err != nil {
-		return nil, err
+	truncated := words[0]
+	for _, w := range words[1:] {
+		if len(truncated)+len(separator)+len(w) > max {
+			break
+		}
+		truncated += separator + w
 	}
+	return truncated, nil
+}
 
-	return files[0], nil
+// DownloadStaticFile downloads a file, and tries to force the browser to avoid displaying it
+// in the browser window by setting content disposition. It also allows specification of the displayName.
+// A request for a single range of bytes, such as from a video player or resumed download, is answered
+// with just that range and 206 Partial Content. An ETag made from the file's modification time and
+// size is sent, and conditional requests for a file which has not changed get 304 Not Modified
+func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string) {
+	t.ServeStaticFile(w, r, pathName, displayName, false)
 }
 
-func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
-	renameFile := true
-	if len(rename) > 0 {
-		renameFile = rename[0]
+// ServeStaticFile serves a file with the given displayName. If inline is true, the content disposition
+// lets the browser display the file, such as an image or PDF, in the browser window; otherwise the
+// browser is asked to download it, as with DownloadStaticFile
+func (t *Tools) ServeStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string, inline bool) {
+	disposition, csp := "attachment", t.DownloadCSPHeader
+	if inline {
+		disposition, csp = "inline", t.InlineCSPHeader
 	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"", disposition, displayName))
 
-	var uploadedFiles []*UploadedFile
-
-	if t.MaxFileSize == 0 {
-		t.MaxFileSize = 1024 * 1024 * 1024
+	if csp != "" {
+		w.Header().Set("Content-Security-Policy", csp)
 	}
 
-	err := t.CreateDirIfNotExist(uploadDir)
-	if err != nil {
-		return nil, err
+	// ServeFile answers If-None-Match with 304 Not Modified when the ETag matches, and
+	// If-Modified-Since when the file has not changed since
+	if info, err := os.Stat(pathName); err == nil && info.Mode().IsRegular() {
+		w.Header().Set("ETag", fileETag(info))
 	}
 
-	err = r.ParseMultipartForm(int64(t.MaxFileSize))
-	if err != nil {
-		return nil, errors.New("the uploaded file is too big")
+	if t.DownloadBytesPerSecond > 0 {
+		w = &throttledWriter{ResponseWriter: w, ctx: r.Context(), rate: t.DownloadBytesPerSecond, start: time.Now()}
 	}
 
-	for _, fHeaders := range r.MultipartForm.File {
-		for _, hdr := range fHeaders {
-			uploadedFiles, err = func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
-				var uploadedFile UploadedFile
-				infile, err := hdr.Open()
-				if err != nil {
-					return nil, err
-				}
-				defer infile.Close()
+	http.ServeFile(w, r, pathName)
+}
 
-				buff := make([]byte, 512)
-				_, err = infile.Read(buff)
-				if err != nil {
-					return nil, err
-				}
+// throttledWriter writes to ResponseWriter no faster than rate bytes per second, waiting between
+// writes as needed, until ctx is done
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	rate    int64
+	start   time.Time
+	written int64
+}
 
-				// check to see if the file type is permitted
-				allowed := false
-				fileType := http.DetectContentType(buff)
-
-				if len(t.AllowedFileType) > 0 {
-					for _, x := range t.AllowedFileType {
-						if strings.EqualFold(fileType, x) {
-							allowed = true
-						}
-					}
-				} else {
-					allowed = true
-				}
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	// write in pieces of a tenth of a second or so, so that the rate is steady
+	chunk := int(tw.rate / 10)
+	if chunk < 1 {
+		chunk = 1
+	}
 
-				if !allowed {
-					return nil, errors.New("the uploaded file type is not permitted")
-				}
+	total := 0
+	for len(p) > 0 {
+		piece := p
+		if len(piece) > chunk {
+			piece = piece[:chunk]
+		}
 
-				_, err = infile.Seek(0, 0)
-				if err != nil {
-					return nil, err
-				}
+		n, err := tw.ResponseWriter.Write(piece)
+		total += n
+		tw.written += int64(n)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
 
-				if renameFile {
-					uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(hdr.Filename))
-				} else {
-					uploadedFile.NewFileName = hdr.Filename
-				}
+		due := tw.start.Add(time.Duration(float64(tw.written) / float64(tw.rate) * float64(time.Second)))
+		if wait := time.Until(due); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-tw.ctx.Done():
+				timer.Stop()
+				return total, tw.ctx.Err()
+			case <-timer.C:
+			}
+		}
+	}
+	return total, nil
+}
 
-				uploadedFile.OriginalFileName = hdr.Filename
+// ServeInlineFile serves the file at path for the browser to display, named after the file itself. It
+// returns an error, without writing a response, if there is no such file
+func (t *Tools) ServeInlineFile(w http.ResponseWriter, r *http.Request, path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return fmt.Errorf("%s is a directory", path)
+	}
 
-				var outfile *os.File
-				defer outfile.Close()
+	t.ServeStaticFile(w, r, path, filepath.Base(path), true)
+	return nil
+}
 
-				if outfile, err = os.Create(filepath.Join(uploadDir, uploadedFile.NewFileName)); err != nil {
-					return nil, err
-				} else {
-					fileSize, err := io.Copy(outfile, infile)
-					if err != nil {
-						return nil, err
-					}
-					uploadedFile.FileSize = fileSize
-				}
+// DownloadRemoteFile fetches the file at uri, and saves it to dstDir under the last element of the
+// path of uri, applying the same validation as UploadFiles, such as MaxFileSize and AllowedFileType.
+// It returns the path of the saved file. An existing file of the same name is never replaced, and
+// an error is returned instead. client is used for the request if it is not nil, and otherwise a
+// client which gives up on a download which takes longer than two minutes
+func (t *Tools) DownloadRemoteFile(uri, dstDir string, client *http.Client) (string, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
 
-				uploadedFiles = append(uploadedFiles, &uploadedFile)
+	fileName := path.Base(u.Path)
+	if fileName == "/" || fileName == "." {
+		return "", fmt.Errorf("unable to name the file downloaded from %s", uri)
+	}
 
-				return uploadedFiles, nil
+	if client == nil {
+		client = defaultDownloadClient
+	}
 
-			}(uploadedFiles)
+	response, err := client.Get(uri)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
 
-			if err != nil {
-				return uploadedFiles, err
-			}
-		}
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return "", fmt.Errorf("unable to download %s: %s", uri, response.Status)
 	}
-	return uploadedFiles, nil
-}
 
-// CreateDirIfNotExist creates a directory, and all necessary parents, if it does not exist
-func (t *Tools) CreateDirIfNotExist(path string) error {
-	const mode = 0755
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err := os.MkdirAll(path, mode)
-		if err != nil {
-			return err
-		}
+	if response.ContentLength > t.maxFileSize() {
+		return "", fmt.Errorf("the downloaded file %s is too big; no more than %d bytes permitted", fileName, t.maxFileSize())
 	}
-	return nil
-}
 
-// Slugify is a (very) simple means of creating a slug from a string
-func (t *Tools) Slugify(s string) (string, error) {
-	if s == "" {
-		return "", errors.New("empty string not permitted")
+	err = t.CreateDirIfNotExist(dstDir)
+	if err != nil {
+		return "", err
 	}
 
-	var re = regexp.MustCompile(`[^a-z\d]+`)
-	slug := strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
-	if len(slug) == 0 {
-		return "", errors.New("after removing characters, slug is zero length")
+	file := uploadSource{
+		r:            response.Body,
+		fileName:     fileName,
+		contentType:  response.Header.Get("Content-Type"),
+		size:         response.ContentLength,
+		mustNotExist: true,
 	}
-	return slug, nil
+	uploadedFile, err := t.uploadFile(context.Background(), file, DiskTarget{Dir: dstDir}, false)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(dstDir, uploadedFile.NewFileName), nil
 }
 
-// DownloadStaticFile downloads a file, and tries to force the browser to avoid displaying it
-// in the browser window by setting content disposition. It also allows specification of the displayName
-func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string) {
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+// defaultDownloadClient is used by DownloadRemoteFile when it is not given a client
+var defaultDownloadClient = &http.Client{Timeout: 2 * time.Minute}
 
-	http.ServeFile(w, r, pathName)
+// fileETag returns a strong ETag for the file described by info, made from its modification time and size
+func fileETag(info os.FileInfo) string {
+	return fmt.Sprintf("\"%x-%x\"", info.ModTime().UnixNano(), info.Size())
 }
 
-//JSONResponse is the type used for sending JSON around
+// The errors returned by ReadJSON wrap one of these, so that they can be told apart with errors.Is
+var (
+	ErrBodyTooLarge = errors.New("body too large")
+	ErrUnknownField = errors.New("body contains unknown key")
+	ErrMultipleJSON = errors.New("body must contain only one JSON value")
+	ErrEmptyBody    = errors.New("body must not be empty")
+
+	// ErrUnexpectedArray is returned when the body is a JSON array, but data is not a slice or array
+	ErrUnexpectedArray = errors.New("body must not be a JSON array")
+)
+
+// JSONResponse is the type used for sending JSON around
 type JSONResponse struct {
 	Error   bool        `json:"error"`
 	Message string      `json:"message"`
+	Code    string      `json:"code,omitempty"`
 	Data    interface{} `json:"data,omitempty"`
 }
 
-// ReadJSON tries to read the body of a request and converts from json into a go data variable
+// PaginatedResponse is the envelope in which WritePaginatedJSON sends one page of a list. Total is the
+// number of items in the whole list, and TotalPages the number of pages of PageSize items it fills
+type PaginatedResponse struct {
+	Data       interface{} `json:"data"`
+	Page       int         `json:"page"`
+	PageSize   int         `json:"page_size"`
+	Total      int         `json:"total"`
+	TotalPages int         `json:"total_pages"`
+}
+
+// ReadJSON tries to read the body of a request and converts from json into a go data variable. It
+// reads the body until it is complete, whatever the context of the request; use ReadJSONWithContext
+// to stop reading once a context is done
 func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
-	maxBytes := 1024 * 1024 // one meg
-	if t.MaxJSONSize != 0 {
-		maxBytes = t.MaxJSONSize
+	return t.ReadJSONWithContext(context.Background(), w, r, data)
+}
+
+// ReadJSONPreserveBody reads json from the body of r in the same way as ReadJSON, and then replaces
+// the body with a copy of everything that was in it, so that it can be read again by later handlers,
+// such as one checking a signature of the body. It reads a single JSON value, whether or not
+// AllowMultipleJSON is set
+func (t *Tools) ReadJSONPreserveBody(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	body := r.Body
+
+	var raw bytes.Buffer
+	r.Body = io.NopCloser(io.TeeReader(body, &raw))
+
+	single := *t
+	single.AllowMultipleJSON = false
+	err := single.ReadJSON(w, r, data)
+
+	// anything not read, because the json was rejected part of the way through, follows what was
+	r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(raw.Bytes()), body))
+	return err
+}
+
+// ReadJSONWithContext is like ReadJSON, but stops reading the body of the request and returns
+// ctx.Err() as soon as ctx is done, even if it is waiting for a client which is sending the body
+// slowly, or has stopped sending it, so that a deadline on ctx limits how long reading can take
+func (t *Tools) ReadJSONWithContext(ctx context.Context, w http.ResponseWriter, r *http.Request, data interface{}) error {
+	maxBytes := t.maxJSONSize()
+
+	var body io.Reader
+	var stream *jsonStream
+	if t.AllowMultipleJSON {
+		// MaxJSONSize applies to each value, and MaxJSONStreamSize to the body as a whole
+		stream = newJSONStream(r, t.maxJSONStreamSize())
+		remaining := int64(maxBytes)
+		body = &quotaReader{r: stream, remaining: &remaining, err: ErrBodyTooLarge}
+	} else {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+		body = r.Body
+	}
+
+	if ctx.Done() != nil {
+		body = &interruptibleReader{ctx: ctx, r: body}
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	// the JSON is kept, if it is to be checked against a schema once it has been decoded
+	var raw bytes.Buffer
+	if t.JSONSchema != "" {
+		body = io.TeeReader(body, &raw)
+	}
 
-	dec := json.NewDecoder(r.Body)
+	dec := json.NewDecoder(body)
 
 	if !t.AllowUnknownFields {
 		dec.DisallowUnknownFields()
 	}
 
 	err := dec.Decode(data)
+	if stream != nil {
+		stream.unread(dec.Buffered())
+	}
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err == io.EOF && t.AllowMultipleJSON {
+		return io.EOF
+	}
 	if err != nil {
 		var syntaxError *json.SyntaxError
 		var unmarshalTypeError *json.UnmarshalTypeError
@@ -218,26 +2564,33 @@ func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{
 
 		switch {
 		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset)
+			return t.jsonError("bad_syntax", fmt.Errorf("body contains badly-formed JSON (at character %d)", syntaxError.Offset))
 
 		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
+			return t.jsonError("bad_syntax", errors.New("body contains badly-formed JSON"))
 
 		case errors.As(err, &unmarshalTypeError):
+			if unmarshalTypeError.Field == "" && unmarshalTypeError.Value == "array" {
+				return t.jsonError("wrong_type", ErrUnexpectedArray, "{field}", "")
+			}
 			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+				return t.jsonError("wrong_type", fmt.Errorf("body contains incorrect JSON type for field %q (expected %s, got %s)", unmarshalTypeError.Field, unmarshalTypeError.Type, unmarshalTypeError.Value), "{field}", unmarshalTypeError.Field)
 			}
-			return fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset)
+			return t.jsonError("wrong_type", fmt.Errorf("body contains incorrect JSON type (at character %d)", unmarshalTypeError.Offset), "{field}", "")
 
 		case errors.Is(err, io.EOF):
-			return errors.New("body must not by empty")
+			return t.jsonError("empty_body", ErrEmptyBody)
 
 		case strings.HasPrefix(err.Error(), "json: unknown field"):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
+			fieldName := strings.TrimSpace(strings.TrimPrefix(err.Error(), "json: unknown field"))
+			return t.jsonError("unknown_field", fmt.Errorf("%w %s", ErrUnknownField, fieldName), "{field}", strings.Trim(fieldName, `"`))
 
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+		case errors.Is(err, errJSONStreamTooLarge):
+			limit := t.maxJSONStreamSize()
+			return t.jsonError("too_large", fmt.Errorf("%w; the JSON values together must not be larger than %d bytes", ErrBodyTooLarge, limit), "{limit}", strconv.FormatInt(limit, 10))
+
+		case err.Error() == "http: request body too large" || errors.Is(err, ErrBodyTooLarge):
+			return t.jsonError("too_large", fmt.Errorf("%w; it must not be larger than %d bytes", ErrBodyTooLarge, maxBytes), "{limit}", strconv.Itoa(maxBytes))
 
 		case errors.As(err, &invalidUnmarshalError):
 			return fmt.Errorf("error unmarshalling JSON: %s", err.Error())
@@ -247,19 +2600,121 @@ func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{
 		}
 	}
 
+	if t.JSONSchema != "" {
+		if err := validateJSONSchema(t.JSONSchema, raw.Bytes()[:dec.InputOffset()]); err != nil {
+			return err
+		}
+	}
+
+	if t.AllowMultipleJSON {
+		return nil
+	}
+
 	err = dec.Decode(&struct{}{})
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
 	if err != io.EOF {
-		return errors.New("body must contain only one JSON value")
+		return t.jsonError("multiple_values", ErrMultipleJSON)
 	}
 
 	return nil
 }
 
+// jsonError returns err, or, if JSONErrorMessages has a message for token, an error with that
+// message which wraps err. replacements are pairs of placeholders and the text which replaces them
+func (t *Tools) jsonError(token string, err error, replacements ...string) error {
+	message, ok := t.JSONErrorMessages[token]
+	if !ok {
+		return err
+	}
+	return &messageError{message: strings.NewReplacer(replacements...).Replace(message), err: err}
+}
+
+// messageError is an error with its own message, which wraps another error
+type messageError struct {
+	message string
+	err     error
+}
+
+func (e *messageError) Error() string {
+	return e.message
+}
+
+func (e *messageError) Unwrap() error {
+	return e.err
+}
+
+// maxJSONSize returns the largest JSON body, in bytes, which will be read
+func (t *Tools) maxJSONSize() int {
+	if t.MaxJSONSize != 0 {
+		return t.MaxJSONSize
+	}
+	return 1024 * 1024 // one meg
+}
+
+// maxJSONStreamSize returns the largest body, in bytes, from which a sequence of JSON values will be read
+func (t *Tools) maxJSONStreamSize() int64 {
+	if t.MaxJSONStreamSize != 0 {
+		return t.MaxJSONStreamSize
+	}
+	return 100 * 1024 * 1024
+}
+
+// errJSONStreamTooLarge is returned by a jsonStream once more than its limit has been read
+var errJSONStreamTooLarge = errors.New("JSON stream too large")
+
+// jsonStream is the body of a request from which ReadJSON decodes a sequence of JSON values when
+// AllowMultipleJSON is set. It holds on to whatever was read past the end of the last value
+type jsonStream struct {
+	buffered  *bytes.Reader
+	body      io.ReadCloser
+	limited   io.Reader // body, limited to the size of the whole stream
+	remaining int64
+}
+
+// newJSONStream returns the jsonStream for the body of r, replacing the body on the first call. No
+// more than limit bytes are read from the body
+func newJSONStream(r *http.Request, limit int64) *jsonStream {
+	if stream, ok := r.Body.(*jsonStream); ok {
+		return stream
+	}
+
+	stream := &jsonStream{buffered: bytes.NewReader(nil), body: r.Body, remaining: limit}
+	stream.limited = &quotaReader{r: r.Body, remaining: &stream.remaining, err: errJSONStreamTooLarge}
+	r.Body = stream
+	return stream
+}
+
+func (s *jsonStream) Read(p []byte) (int, error) {
+	if s.buffered.Len() > 0 {
+		return s.buffered.Read(p)
+	}
+	return s.limited.Read(p)
+}
+
+func (s *jsonStream) Close() error {
+	return s.body.Close()
+}
+
+// unread puts everything in r back in front of the rest of the stream
+func (s *jsonStream) unread(r io.Reader) {
+	rest, _ := io.ReadAll(io.MultiReader(r, s.buffered))
+	s.buffered = bytes.NewReader(rest)
+}
+
 // WriteJSON takes a response status code and arbitrary data and write json to the client
 func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
-	out, err := json.Marshal(data)
+	_, err := t.WriteJSONN(w, status, data, headers...)
+	return err
+}
+
+// WriteJSONN writes json to the client in the same way as WriteJSON, and returns the number of bytes
+// of json written to w
+func (t *Tools) WriteJSONN(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) (int, error) {
+	out, err := t.marshalJSON(data)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
 	if len(headers) > 0 {
@@ -270,16 +2725,135 @@ func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, h
 
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
+	return w.Write(out)
+}
+
+// WritePaginatedJSON writes items, one page of a list of total items, to the client as json in the
+// same way as WriteJSON, wrapped in a PaginatedResponse which also gives the page number, the page size
+// and the number of pages
+func (t *Tools) WritePaginatedJSON(w http.ResponseWriter, status int, items interface{}, page, pageSize, total int, headers ...http.Header) error {
+	if pageSize <= 0 {
+		return fmt.Errorf("the page size must be greater than zero, not %d", pageSize)
+	}
+	if total < 0 {
+		return fmt.Errorf("the total must not be negative, not %d", total)
+	}
+
+	payload := PaginatedResponse{
+		Data:       items,
+		Page:       page,
+		PageSize:   pageSize,
+		Total:      total,
+		TotalPages: (total + pageSize - 1) / pageSize,
+	}
+
+	return t.WriteJSON(w, status, payload, headers...)
+}
+
+// DownloadJSONFile sends data to the client as a json file to be downloaded, named filename, rather
+// than as a json response to be displayed. It is encoded in the same way as by WriteJSON
+func (t *Tools) DownloadJSONFile(w http.ResponseWriter, filename string, data interface{}) error {
+	out, err := t.marshalJSON(data)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.Header().Set("Content-Length", strconv.Itoa(len(out)))
+	w.WriteHeader(http.StatusOK)
 	_, err = w.Write(out)
+	return err
+}
+
+// marshalJSON encodes data as json for a response, indented with two spaces if IndentJSON is set
+func (t *Tools) marshalJSON(data interface{}) ([]byte, error) {
+	if t.IndentJSON {
+		return json.MarshalIndent(data, "", "  ")
+	}
+	return json.Marshal(data)
+}
+
+// WriteJSONCompressed writes json to the client in the same way as WriteJSON, but if CompressJSON is
+// set and the Accept-Encoding header of r allows it, the json is compressed with gzip
+func (t *Tools) WriteJSONCompressed(w http.ResponseWriter, r *http.Request, status int, data interface{}, headers ...http.Header) error {
+	if !t.CompressJSON {
+		return t.WriteJSON(w, status, data, headers...)
+	}
+
+	// the response depends on whether the client accepts gzip
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	if !acceptsGzip(r) {
+		return t.WriteJSON(w, status, data, headers...)
+	}
+
+	out, err := t.marshalJSON(data)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			w.Header()[key] = value
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Del("Content-Length")
+	w.WriteHeader(status)
+
+	gz := gzip.NewWriter(w)
+	_, err = gz.Write(out)
+	if err != nil {
+		return err
+	}
+
+	// closing the writer flushes whatever is left of the compressed json
+	return gz.Close()
+}
+
+// acceptsGzip reports whether the Accept-Encoding header of r allows a gzip compressed response
+func acceptsGzip(r *http.Request) bool {
+	// the quality values given for gzip and *, or -1 if they are not mentioned
+	gzipQ, wildcardQ := -1.0, -1.0
+
+	for _, header := range r.Header.Values("Accept-Encoding") {
+		for _, encoding := range strings.Split(header, ",") {
+			name, params, _ := strings.Cut(encoding, ";")
+
+			q := 1.0
+			params = strings.TrimSpace(params)
+			if strings.HasPrefix(params, "q=") {
+				if value, err := strconv.ParseFloat(params[2:], 64); err == nil {
+					q = value
+				}
+			}
+
+			switch name = strings.TrimSpace(name); {
+			case strings.EqualFold(name, "gzip"):
+				gzipQ = q
+			case name == "*":
+				wildcardQ = q
+			}
+		}
+	}
+
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return wildcardQ > 0
 }
 
 // ErrorJSON takes an error, and optionally a status code, and generates and send a JSON error message
 func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
+	return t.ErrorJSONWithCode(w, err, "", status...)
+}
+
+// ErrorJSONWithCode is like ErrorJSON, but also sends code, a machine readable error code which clients
+// can rely on rather than the message. The code is left out of the JSON if it is empty
+func (t *Tools) ErrorJSONWithCode(w http.ResponseWriter, err error, code string, status ...int) error {
 	statusCode := http.StatusBadRequest
 
 	if len(status) > 0 {
@@ -289,17 +2863,94 @@ func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error
 	var payload JSONResponse
 	payload.Error = true
 	payload.Message = err.Error()
+	payload.Code = code
 
 	return t.WriteJSON(w, statusCode, payload)
 }
 
 // PushJSONToRemote posts arbitrary data to some URL as JSON, and return the response, status code, and error, if any.
 // The final parameter, client, is optional. if none is specified, we use the standard http.Client.
+// Network errors and 5xx responses are retried up to MaxRetries times, waiting RetryDelay before the
+// first retry and twice as long before each one after that, up to a minute
 func (t *Tools) PushJSONToRemote(uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
+	return t.PushJSONToRemoteContext(context.Background(), uri, data, client...)
+}
+
+// PushJSONToRemoteContext is like PushJSONToRemote, but gives up, returning ctx.Err(), as soon as
+// ctx is done, including while waiting to retry
+func (t *Tools) PushJSONToRemoteContext(ctx context.Context, uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
+	return t.SendJSONToRemote(ctx, "POST", uri, data, nil, client...)
+}
+
+// SendJSONToRemote sends arbitrary data to some URL as JSON in the same way as PushJSONToRemoteContext,
+// but using method ("POST" if empty) and adding headers to the request. The Content-Type header is
+// application/json unless headers says otherwise
+func (t *Tools) SendJSONToRemote(ctx context.Context, method, uri string, data interface{}, headers http.Header, client ...*http.Client) (*http.Response, int, error) {
+	res, err := t.sendJSON(ctx, method, uri, data, headers, client...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+
+	// send response back
+	return res, res.StatusCode, nil
+}
+
+// PushJSONAndDecode posts payload to uri as JSON in the same way as PushJSONToRemote, decodes the JSON
+// response, whatever its status, into target, and returns the status code. The response may be no
+// larger than MaxJSONSize bytes, or one meg if that is not set
+func (t *Tools) PushJSONAndDecode(uri string, payload, target interface{}, client ...*http.Client) (int, error) {
+	res, err := t.sendJSON(context.Background(), "POST", uri, payload, nil, client...)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	maxBytes := int64(t.maxJSONSize())
+	dec := json.NewDecoder(&quotaReader{r: res.Body, remaining: &maxBytes, err: ErrBodyTooLarge})
+
+	err = dec.Decode(target)
+	if err == io.EOF {
+		return res.StatusCode, fmt.Errorf("the response from %s was empty: %w", uri, ErrEmptyBody)
+	}
+	if err != nil {
+		return res.StatusCode, fmt.Errorf("unable to decode the response from %s: %w", uri, err)
+	}
+
+	return res.StatusCode, nil
+}
+
+// maxRetryWait is the longest sendJSON waits before a retry, unless RetryDelay is longer
+const maxRetryWait = time.Minute
+
+// retryWait returns how long to wait before the retry after attempt, which is delay doubled for each
+// attempt, but no more than maxRetryWait, however many attempts there have been
+func retryWait(delay time.Duration, attempt int) time.Duration {
+	wait := delay
+	for i := 0; i < attempt && wait < maxRetryWait; i++ {
+		wait *= 2
+	}
+
+	if wait > maxRetryWait {
+		wait = maxRetryWait
+	}
+	if wait < delay {
+		wait = delay
+	}
+	return wait
+}
+
+// sendJSON sends data to uri as JSON, retrying as described by PushJSONToRemote, and returns the
+// response, whose body the caller must close
+func (t *Tools) sendJSON(ctx context.Context, method, uri string, data interface{}, headers http.Header, client ...*http.Client) (*http.Response, error) {
+	if method == "" {
+		method = "POST"
+	}
+
 	// create JSON
 	jsonData, err := json.Marshal(data)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
 	// check for custom http client
@@ -308,20 +2959,39 @@ func (t *Tools) PushJSONToRemote(uri string, data interface{}, client ...*http.C
 		httpClient = client[0]
 	}
 
-	// build the request and set the header
-	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, 0, err
+	delay := t.RetryDelay
+	if delay <= 0 {
+		delay = 100 * time.Millisecond
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	// call the remote url
-	res, err := httpClient.Do(req)
-	if err != nil {
-		return nil, 0, err
-	}
-	defer res.Body.Close()
+	for attempt := 0; ; attempt++ {
+		// build the request and set the header
+		req, err := http.NewRequestWithContext(ctx, method, uri, bytes.NewReader(jsonData))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		for key, value := range headers {
+			req.Header[http.CanonicalHeaderKey(key)] = value
+		}
 
-	// send response back
-	return res, res.StatusCode, nil
+		// call the remote url
+		res, err := httpClient.Do(req)
+
+		retry := (err != nil && ctx.Err() == nil) || (err == nil && res.StatusCode >= 500)
+		if !retry || attempt >= t.MaxRetries {
+			return res, err
+		}
+		if err == nil {
+			res.Body.Close()
+		}
+
+		timer := time.NewTimer(retryWait(delay, attempt))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
 }
@@ -2,8 +2,14 @@ package toolkit
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"image"
 	"image/png"
 	"io"
@@ -11,11 +17,19 @@ import (
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/textproto"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 func TestTools_RandomString(t *testing.T) {
@@ -27,11 +41,120 @@ func TestTools_RandomString(t *testing.T) {
 	}
 }
 
+func TestTools_RandomStringSecure(t *testing.T) {
+	var testTools Tools
+
+	s, err := testTools.RandomStringSecure(10000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s) != 10000 {
+		t.Errorf("wrong length random string returned; expected 10000, but got %d", len(s))
+	}
+
+	// every character of the source should turn up in a string this long
+	for _, c := range randomStringSource {
+		if !strings.ContainsRune(s, c) {
+			t.Errorf("character %c never appeared in the random string", c)
+		}
+	}
+
+	for _, c := range s {
+		if !strings.ContainsRune(randomStringSource, c) {
+			t.Errorf("unexpected character %c in the random string", c)
+		}
+	}
+}
+
+var randomStringSourceTests = []struct {
+	name   string
+	source string
+}{
+	{name: "default", source: ""},
+	{name: "lower case", source: "abcdefghijklmnopqrstuvwxyz"},
+	{name: "hex", source: "0123456789abcdef"},
+	{name: "multi-byte", source: "あいうえお"},
+	{name: "single space", source: " "},
+}
+
+func TestTools_RandomString_Source(t *testing.T) {
+	for _, e := range randomStringSourceTests {
+		testTools := Tools{RandomStringSource: e.source}
+
+		expectedSource := e.source
+		if expectedSource == "" {
+			expectedSource = randomStringSource
+		}
+
+		s := testTools.RandomString(20)
+		if n := len([]rune(s)); n != 20 {
+			t.Errorf("%s: wrong length random string returned; expected 20, but got %d", e.name, n)
+		}
+
+		for _, c := range s {
+			if !strings.ContainsRune(expectedSource, c) {
+				t.Errorf("%s: unexpected character %q in the random string", e.name, c)
+			}
+		}
+	}
+}
+
+func TestTools_GenerateUUID(t *testing.T) {
+	var testTools Tools
+
+	u := testTools.GenerateUUID()
+	if len(u) != 36 {
+		t.Errorf("wrong length uuid returned: %s", u)
+	}
+
+	if u[14] != '4' {
+		t.Errorf("wrong uuid version; expected 4, but got %c", u[14])
+	}
+
+	if !strings.ContainsRune("89ab", rune(u[19])) {
+		t.Errorf("wrong uuid variant %c", u[19])
+	}
+
+	if !testTools.ValidateUUID(u) {
+		t.Errorf("generated uuid %s is not valid", u)
+	}
+
+	if u == testTools.GenerateUUID() {
+		t.Error("two generated uuids are identical")
+	}
+}
+
+var uuidTests = []struct {
+	name     string
+	uuid     string
+	expected bool
+}{
+	{name: "lower case", uuid: "550e8400-e29b-41d4-a716-446655440000", expected: true},
+	{name: "upper case", uuid: "550E8400-E29B-41D4-A716-446655440000", expected: true},
+	{name: "braces", uuid: "{550e8400-e29b-41d4-a716-446655440000}", expected: true},
+	{name: "unbalanced braces", uuid: "{550e8400-e29b-41d4-a716-446655440000", expected: false},
+	{name: "no hyphens", uuid: "550e8400e29b41d4a716446655440000", expected: false},
+	{name: "not hex", uuid: "550e8400-e29b-41d4-a716-44665544000g", expected: false},
+	{name: "empty", uuid: "", expected: false},
+}
+
+func TestTools_ValidateUUID(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range uuidTests {
+		if got := testTools.ValidateUUID(e.uuid); got != e.expected {
+			t.Errorf("%s: expected %v, but got %v", e.name, e.expected, got)
+		}
+	}
+}
+
 var uploadTests = []struct {
-	name          string
-	allowedTypes  []string
-	renameFile    bool
-	errorExpected bool
+	name              string
+	allowedTypes      []string
+	allowedExtensions []string
+	renameFile        bool
+	errorExpected     bool
 }{
 	{
 		name:          "allowed no rename",
@@ -51,6 +174,44 @@ var uploadTests = []struct {
 		renameFile:    false,
 		errorExpected: true,
 	},
+	{
+		name:          "allowed wildcard",
+		allowedTypes:  []string{"image/*"},
+		renameFile:    false,
+		errorExpected: false,
+	},
+	{
+		name:          "not allowed wildcard",
+		allowedTypes:  []string{"application/*", "text/*"},
+		renameFile:    false,
+		errorExpected: true,
+	},
+	{
+		name:              "allowed extension",
+		allowedExtensions: []string{".jpg", "PNG"},
+		renameFile:        false,
+		errorExpected:     false,
+	},
+	{
+		name:              "not allowed extension",
+		allowedExtensions: []string{".jpg", ".jpeg"},
+		renameFile:        false,
+		errorExpected:     true,
+	},
+	{
+		name:              "allowed type and extension",
+		allowedTypes:      []string{"image/png"},
+		allowedExtensions: []string{".png"},
+		renameFile:        true,
+		errorExpected:     false,
+	},
+	{
+		name:              "allowed type but not extension",
+		allowedTypes:      []string{"image/png"},
+		allowedExtensions: []string{".csv"},
+		renameFile:        false,
+		errorExpected:     true,
+	},
 }
 
 func TestTools_UploadFiles(t *testing.T) {
@@ -67,6 +228,7 @@ func TestTools_UploadFiles(t *testing.T) {
 
 		go func() {
 			defer wg.Done()
+			defer pw.Close()
 			defer writer.Close()
 
 			// create the form data field 'file'
@@ -98,6 +260,7 @@ func TestTools_UploadFiles(t *testing.T) {
 
 		var testTools Tools
 		testTools.AllowedFileType = e.allowedTypes
+		testTools.AllowedFileExtensions = e.allowedExtensions
 
 		uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, e.renameFile)
 		if err != nil && !e.errorExpected {
@@ -113,10 +276,17 @@ func TestTools_UploadFiles(t *testing.T) {
 				t.Errorf("%s: expected file to exist: %s", e.name, err.Error())
 			}
 
+			if uploadedFiles[0].FileType != "image/png" {
+				t.Errorf("%s: wrong file type; expected image/png, but got %s", e.name, uploadedFiles[0].FileType)
+			}
+
 			// clean up
 			_ = os.Remove(filepath.Join(uploadFolder, uploadedFiles[0].NewFileName))
 		}
 
+		// drain whatever is left of the body so that the writer can finish
+		_, _ = io.Copy(io.Discard, pr)
+
 		wg.Wait()
 	}
 }
@@ -175,222 +345,3917 @@ func TestTools_UploadOneFile(t *testing.T) {
 
 }
 
-func TestTools_CreateDirIfNotExist(t *testing.T) {
-	var testTools Tools
+func TestTools_UploadFiles_ContinueOnError(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
 
-	err := testTools.CreateDirIfNotExist("./testdata/myDir")
+	content, err := os.ReadFile(filepath.Join("testdata", "img.png"))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	err = testTools.CreateDirIfNotExist("./testdata/myDir")
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "notes.txt", content: []byte("hello, world")},
+		testPart{field: "file", fileName: "img.png", content: content},
+	)
+
+	testTools := Tools{AllowedFileType: []string{"image/png"}, ContinueOnError: true}
+
+	uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, false)
 	if err != nil {
-		t.Error(err)
+		t.Fatalf("expected no error for the request, but got %s", err)
 	}
 
-	_ = os.Remove("./testdata/myDir")
-}
-
-var slugTests = []struct {
-	name          string
-	s             string
-	expected      string
-	errorExpected bool
-}{
-	{name: "valid string", s: " now is the time ", expected: "now-is-the-time", errorExpected: false},
-	{name: "empty string", s: "", expected: "", errorExpected: true},
-	{name: "complex string", s: "Now is the TIME! + fish & such &^123", expected: "now-is-the-time-fish-such-123", errorExpected: false},
-	{name: "japanese string", s: "こんにちは", expected: "", errorExpected: true},
-	{name: "japanese string and roman characters", s: "hello world こんにちは", expected: "hello-world", errorExpected: false},
-}
+	if len(uploadedFiles) != 2 {
+		t.Fatalf("expected a result for each of 2 files, but got %d", len(uploadedFiles))
+	}
 
-func TestTools_Slugify(t *testing.T) {
-	var testTools Tools
+	if uploadedFiles[0].OriginalFileName != "notes.txt" || uploadedFiles[0].Error == nil {
+		t.Errorf("expected notes.txt to have been rejected, but got %+v", uploadedFiles[0])
+	}
 
-	for _, e := range slugTests {
-		slug, err := testTools.Slugify(e.s)
-		if err != nil && !e.errorExpected {
-			t.Errorf("%s: error received when none expected: %s", e.name, err.Error())
-		}
+	if uploadedFiles[1].OriginalFileName != "img.png" || uploadedFiles[1].Error != nil {
+		t.Errorf("expected img.png to have been uploaded, but got %+v", uploadedFiles[1])
+	}
 
-		if err == nil && e.errorExpected {
-			t.Errorf("%s: no error received when an error expected", e.name)
-		}
+	if _, err := os.Stat(filepath.Join(uploadFolder, "img.png")); err != nil {
+		t.Errorf("expected img.png to exist: %s", err)
+	}
 
-		if !e.errorExpected && slug != e.expected {
-			t.Errorf("%s: wrong slug returned; expected %s, but got %s", e.name, e.expected, slug)
-		}
+	if _, err := os.Stat(filepath.Join(uploadFolder, "notes.txt")); !os.IsNotExist(err) {
+		t.Error("expected notes.txt not to exist")
 	}
-}
 
-func TestTools_DownloadStaticFile(t *testing.T) {
-	req := httptest.NewRequest("GET", "/", nil)
-	rr := httptest.NewRecorder()
+	// the reason is kept when the results are sent back as JSON
+	out, err := json.Marshal(uploadedFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []map[string]interface{}
+	if err := json.Unmarshal(out, &results); err != nil {
+		t.Fatal(err)
+	}
+	if reason, _ := results[0]["Error"].(string); reason != uploadedFiles[0].Error.Error() {
+		t.Errorf("expected the JSON to give the reason notes.txt was rejected, but got %s", out)
+	}
+	if _, ok := results[1]["Error"]; ok {
+		t.Errorf("expected no error in the JSON for img.png, but got %s", out)
+	}
 
-	var testTools Tools
+	removeUploadedFiles(DiskTarget{Dir: uploadFolder}, uploadedFiles)
 
-	testTools.DownloadStaticFile(rr, req, "./testdata/pic.jpg", "puppy.jpg")
+	if _, err := os.Stat(uploadFolder); err != nil {
+		t.Errorf("expected the upload folder to remain: %s", err)
+	}
 
-	res := rr.Result()
-	res.Body.Close()
+	// if every file fails, so does the request, but the reason for each is still reported
+	req = newMultipartRequest(t,
+		testPart{field: "file", fileName: "notes.txt", content: []byte("hello, world")},
+		testPart{field: "file", fileName: "more.txt", content: []byte("goodbye, world")},
+	)
 
-	if res.Header["Content-Length"][0] != "98827" {
-		t.Error("wrong content length of ", res.Header["Content-Length"][0])
+	uploadedFiles, err = testTools.UploadFiles(req, uploadFolder, false)
+	if err == nil {
+		t.Error("expected an error when every file fails, but none received")
 	}
-
-	if res.Header["Content-Disposition"][0] != "attachment; filename=\"puppy.jpg\"" {
-		t.Error("wrong content disposition of ", res.Header["Content-Disposition"][0])
+	if len(uploadedFiles) != 2 || uploadedFiles[0].Error == nil || uploadedFiles[1].Error == nil {
+		t.Errorf("expected both files to be reported as failed, but got %+v", uploadedFiles)
 	}
 
-	_, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		t.Error(err)
+	// without ContinueOnError the first bad file fails the whole request
+	req = newMultipartRequest(t,
+		testPart{field: "file", fileName: "notes.txt", content: []byte("hello, world")},
+		testPart{field: "file", fileName: "img.png", content: content},
+	)
+	testTools.ContinueOnError = false
+
+	if _, err := testTools.UploadFiles(req, uploadFolder, false); err == nil {
+		t.Error("expected an error without ContinueOnError, but none received")
 	}
 }
 
-var jsonTests = []struct {
-	name          string
-	json          string
-	errorExpected bool
-	maxSize       int
-	allowUnknown  bool
-}{
-	{name: "good json", json: `{"foo": "bar"}`, errorExpected: false, maxSize: 1024, allowUnknown: false},
-	{name: "badly formatted json", json: `{"foo":}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "incorrect type", json: `{"foo": 1}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "two json files", json: `{"foo": "1"}{"foo": "2"}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "empty body", json: ``, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "syntax error in json", json: `{"foo": 1"`, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "unknown field in json", json: `{"fooo": "1"}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
-	{name: "allow unknown field in json", json: `{"fooo": "1"}`, errorExpected: false, maxSize: 1024, allowUnknown: true},
-	{name: "missing field name", json: `{jack: "1"}`, errorExpected: true, maxSize: 1024, allowUnknown: true},
-	{name: "file too large", json: `{"foo": "bar"}`, errorExpected: true, maxSize: 5, allowUnknown: true},
-	{name: "not json", json: `Hello, world!`, errorExpected: true, maxSize: 1024, allowUnknown: true},
-}
+func TestTools_UploadFiles_ContinueOnErrorMaxUploadCount(t *testing.T) {
+	// files which fail don't count towards MaxUploadCount, whether or not they are saved concurrently
+	for _, concurrency := range []int{0, 3} {
+		uploadFolder := t.TempDir()
 
-func TestTools_ReadJSON(t *testing.T) {
-	var testTools Tools
+		parts := concurrentParts(t, 3, 0)
+		req := newMultipartRequest(t, parts...)
 
-	for _, e := range jsonTests {
-		// set the max json size
-		testTools.MaxJSONSize = e.maxSize
+		testTools := Tools{AllowedFileType: []string{"image/png"}, ContinueOnError: true, MaxUploadCount: 2, UploadConcurrency: concurrency}
 
-		// allow/disallow unknown fields
-		testTools.AllowUnknownFields = e.allowUnknown
+		uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, false)
+		if err != nil {
+			t.Errorf("concurrency %d: unexpected error: %s", concurrency, err)
+			continue
+		}
 
-		// declare a variable to read the decoded json into
-		var decodedJSON struct {
-			Foo string `json:"foo"`
+		if len(uploadedFiles) != 3 || uploadedFiles[0].Error == nil || uploadedFiles[1].Error != nil || uploadedFiles[2].Error != nil {
+			t.Errorf("concurrency %d: expected the first file to fail, and the other two to be saved, but got %+v", concurrency, uploadedFiles)
 		}
 
-		// create a request with the body
-		req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(e.json)))
+		// a third file which is saved is still too many
+		req = newMultipartRequest(t, concurrentParts(t, 3, -1)...)
+		if _, err := testTools.UploadFiles(req, uploadFolder, true); err == nil {
+			t.Errorf("concurrency %d: expected an error for too many files, but none received", concurrency)
+		}
+	}
+}
 
-		// create a recorder
-		rr := httptest.NewRecorder()
+func TestTools_UploadFiles_RejectDuplicates(t *testing.T) {
+	target := DiskTarget{Dir: filepath.Join("testdata", "uploads", "duplicates")}
+	defer os.RemoveAll(target.Dir)
 
-		err := testTools.ReadJSON(rr, req, &decodedJSON)
+	if _, err := target.Save("original.txt", strings.NewReader("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+
+	var dedupeTests = []struct {
+		name          string
+		mode          string
+		errorExpected bool
+	}{
+		{name: "default", mode: "", errorExpected: true},
+		{name: "error", mode: "error", errorExpected: true},
+		{name: "reuse", mode: "reuse", errorExpected: false},
+		{name: "unknown mode", mode: "replace", errorExpected: true},
+	}
 
+	for _, e := range dedupeTests {
+		testTools := Tools{RejectDuplicates: true, DeduplicateMode: e.mode}
+
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "copy.txt", content: []byte("hello, world")})
+
+		uploadedFiles, err := testTools.UploadFilesTo(req, target, false)
 		if err == nil && e.errorExpected {
 			t.Errorf("%s: error expected, but none received", e.name)
 		}
-
 		if err != nil && !e.errorExpected {
-			t.Errorf("%s: error not expected, but one received: %s", e.name, err.Error())
+			t.Errorf("%s: unexpected error: %s", e.name, err)
 		}
 
-		req.Body.Close()
-	}
-}
-
-func TestTools_WriteJSON(t *testing.T) {
-	var testTools Tools
+		if err == nil && (uploadedFiles[0].NewFileName != "original.txt" || !uploadedFiles[0].Duplicate) {
+			t.Errorf("%s: expected the existing file to be reused, but got %s", e.name, uploadedFiles[0].NewFileName)
+		}
 
-	rr := httptest.NewRecorder()
-	payload := JSONResponse{
-		Error:   false,
-		Message: "foo",
+		if exists, _ := target.Exists("copy.txt"); exists {
+			t.Errorf("%s: expected the duplicate not to be kept", e.name)
+		}
 	}
 
-	headers := make(http.Header)
-	headers.Add("FOO", "BAR")
+	// files with new contents are kept
+	testTools := Tools{RejectDuplicates: true}
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "new.txt", content: []byte("something else")})
 
-	err := testTools.WriteJSON(rr, http.StatusOK, payload, headers)
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, false)
 	if err != nil {
-		t.Errorf("failed to write JSON: %v", err)
+		t.Fatal(err)
 	}
-
-	if rr.Code != http.StatusOK {
-		t.Errorf("expected status code of 200, but got %d", rr.Code)
+	if uploadedFiles[0].NewFileName != "new.txt" {
+		t.Errorf("expected new.txt to be saved, but got %s", uploadedFiles[0].NewFileName)
 	}
 
-	res := rr.Result()
-	defer res.Body.Close()
-
-	if res.Header["Content-Type"][0] != "application/json" {
-		t.Error("wrong content type of ", res.Header["Content-Type"][0])
+	// a duplicate which has the name of an existing file leaves that file alone
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "new.txt", content: []byte("hello, world")})
+	if _, err := testTools.UploadFilesTo(req, target, false); err == nil {
+		t.Error("expected an error for a duplicate, but none received")
 	}
 
-	if res.Header["Foo"][0] != "BAR" {
-		t.Error("wrong header ", res.Header["Foo"][0])
+	content, err := os.ReadFile(filepath.Join(target.Dir, "new.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "something else" {
+		t.Errorf("expected new.txt to be untouched, but it contains %q", content)
 	}
 
-	var response JSONResponse
-
-	body, _ := io.ReadAll(res.Body)
-	if err := json.Unmarshal(body, &response); err != nil {
-		t.Error("unmarshal error", err)
+	entries, err := os.ReadDir(target.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("expected only original.txt and new.txt to be stored, but found %d files", len(entries))
 	}
 
-	if !reflect.DeepEqual(payload, response) {
-		t.Errorf("expected body %+v, but got %+v", payload, response)
+	// targets which can't find duplicates are an error
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "new.txt", content: []byte("something else")})
+	if _, err := testTools.UploadFilesTo(req, &memoryTarget{}, false); err == nil {
+		t.Error("expected an error for a target without FindSHA256, but none received")
 	}
 }
 
-func TestTools_ErrorJSON(t *testing.T) {
-	var testTools Tools
+func TestTools_UploadFiles_ReuseDuplicates(t *testing.T) {
+	uploadDir := filepath.Join("testdata", "uploads", "reuse")
+	defer os.RemoveAll(uploadDir)
 
-	rr := httptest.NewRecorder()
-	err := testTools.ErrorJSON(rr, errors.New("some error"), http.StatusServiceUnavailable)
+	content, err := os.ReadFile(filepath.Join("testdata", "img.png"))
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 
-	var response JSONResponse
+	testTools := Tools{RejectDuplicates: true, DeduplicateMode: "reuse"}
 
-	decorder := json.NewDecoder(rr.Body)
-	err = decorder.Decode(&response)
-	if err != nil {
-		t.Error("received error when decoding JSON", err)
-	}
+	var results []*UploadedFile
+	for i := 0; i < 2; i++ {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: content})
 
-	if !response.Error {
-		t.Error("error set to false in JSON, and it should be true")
+		uploadedFiles, err := testTools.UploadFiles(req, uploadDir, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, uploadedFiles[0])
 	}
 
-	if response.Message != "some error" {
-		t.Errorf("wrong message received; expected some error, but got %s", response.Message)
+	if results[0].Duplicate || !results[1].Duplicate {
+		t.Errorf("expected only the second upload to be a duplicate, but got %v and %v", results[0].Duplicate, results[1].Duplicate)
 	}
-
-	if rr.Code != http.StatusServiceUnavailable {
-		t.Errorf("wrong status code returned; expected 503, but got %d", rr.Code)
+	if results[1].NewFileName != results[0].NewFileName {
+		t.Errorf("expected the second upload to reuse %s, but got %s", results[0].NewFileName, results[1].NewFileName)
 	}
 
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected one file to be stored, but found %d", len(entries))
+	}
 }
 
-type RoundTripFunc func(req *http.Request) *http.Response
+func TestTools_UploadFiles_ReuseDuplicatesConcurrently(t *testing.T) {
+	uploadDir := filepath.Join("testdata", "uploads", "reuseConcurrent")
+	defer os.RemoveAll(uploadDir)
 
-func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
-	return f(req), nil
-}
+	testTools := Tools{MaxFileSize: 1024, RejectDuplicates: true, DeduplicateMode: "reuse"}
 
-func NewTestClient(fn RoundTripFunc) *http.Client {
-	return &http.Client{
-		Transport: fn,
+	var wg sync.WaitGroup
+	results := make([]*UploadedFile, 8)
+	for i := range results {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "copy.txt", content: []byte("the same attachment")})
+
+		wg.Add(1)
+		go func(i int, req *http.Request) {
+			defer wg.Done()
+
+			uploadedFiles, err := testTools.UploadFiles(req, uploadDir, true)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			results[i] = uploadedFiles[0]
+		}(i, req)
 	}
-}
+	wg.Wait()
 
-func TestTools_PushJSONToRemote(t *testing.T) {
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected one file to be stored, but found %d", len(entries))
+	}
+
+	// every upload refers to the one file kept
+	for _, f := range results {
+		if f != nil && f.NewFileName != entries[0].Name() {
+			t.Errorf("expected %s, but got %s", entries[0].Name(), f.NewFileName)
+		}
+	}
+}
+
+func TestTools_UploadFiles_DuplicatesSlowClient(t *testing.T) {
+	uploadDir := t.TempDir()
+
+	testTools := Tools{RejectDuplicates: true, DeduplicateMode: "reuse"}
+
+	// a client which sends part of a file, and then stalls
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	slow := httptest.NewRequest("POST", "/", pr)
+	slow.Header.Add("Content-Type", writer.FormDataContentType())
+
+	slowDone := make(chan error, 1)
+	go func() {
+		_, err := testTools.UploadFiles(slow, uploadDir)
+		slowDone <- err
+	}()
+
+	part, err := writer.CreateFormFile("file", "slow.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the write returns once the upload has read it
+	if _, err := part.Write(bytes.Repeat([]byte("s"), 1024)); err != nil {
+		t.Fatal(err)
+	}
+
+	// another upload to the same directory is not held up by it
+	done := make(chan error, 1)
+	go func() {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "fast.txt", content: []byte("fast")})
+		_, err := testTools.UploadFiles(req, uploadDir)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the upload not to wait for the slow client")
+	}
+
+	_ = writer.Close()
+	_ = pw.Close()
+	if err := <-slowDone; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTools_UploadFiles_CleanupOnError(t *testing.T) {
+	uploadFolder := filepath.Join("testdata", "uploads", "cleanup")
+	defer os.RemoveAll(uploadFolder)
+
+	content, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "one.png", content: content},
+		testPart{field: "file", fileName: "two.png", content: content},
+		testPart{field: "file", fileName: "notes.txt", content: []byte("hello, world")},
+	)
+
+	testTools := Tools{AllowedFileType: []string{"image/png"}, CleanupOnError: true}
+
+	uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, true)
+	if err == nil {
+		t.Fatal("expected an error for the disallowed file, but none received")
+	}
+
+	if len(uploadedFiles) != 0 {
+		t.Errorf("expected no uploaded files, but got %d", len(uploadedFiles))
+	}
+
+	entries, err := os.ReadDir(uploadFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("expected the uploads directory to be empty, but found %s", entry.Name())
+	}
+}
+
+// concurrentParts returns n small PNG images, named img00.png and so on, with a text file in place of
+// the image at position bad, if bad is not -1
+func concurrentParts(t testing.TB, n, bad int) []testPart {
+	content := newTestPNG(t, 40, 30)
+
+	parts := make([]testPart, n)
+	for i := range parts {
+		parts[i] = testPart{field: "file", fileName: fmt.Sprintf("img%02d.png", i), content: content}
+		if i == bad {
+			parts[i] = testPart{field: "file", fileName: fmt.Sprintf("notes%02d.txt", i), content: []byte("hello, world")}
+		}
+	}
+	return parts
+}
+
+var concurrencyTests = []struct {
+	name            string
+	tools           Tools
+	bad             int
+	expectedFiles   int
+	continueOnError bool
+	errorExpected   bool
+}{
+	{name: "all saved", tools: Tools{UploadConcurrency: 4}, bad: -1, expectedFiles: 20},
+	{name: "with thumbnails", tools: Tools{UploadConcurrency: 4, GenerateThumbnails: true, ThumbnailWidth: 10, ThumbnailHeight: 10}, bad: -1, expectedFiles: 40},
+	{name: "more workers than files", tools: Tools{UploadConcurrency: 50}, bad: -1, expectedFiles: 20},
+	{name: "error cleans up", tools: Tools{UploadConcurrency: 4, AllowedFileType: []string{"image/png"}, CleanupOnError: true}, bad: 7, expectedFiles: 0, errorExpected: true},
+	{name: "continue on error", tools: Tools{UploadConcurrency: 4, AllowedFileType: []string{"image/png"}, ContinueOnError: true}, bad: 7, expectedFiles: 19, continueOnError: true},
+	{name: "too many files", tools: Tools{UploadConcurrency: 4, MaxUploadCount: 10}, bad: -1, expectedFiles: 0, errorExpected: true},
+	{name: "file too big", tools: Tools{UploadConcurrency: 4, MaxFileSize: 100, CleanupOnError: true}, bad: -1, expectedFiles: 0, errorExpected: true},
+}
+
+func TestTools_UploadFiles_Concurrency(t *testing.T) {
+	for _, e := range concurrencyTests {
+		dir := filepath.Join("testdata", "uploads", "concurrent")
+
+		req := newMultipartRequest(t, concurrentParts(t, 20, e.bad)...)
+
+		testTools := e.tools
+		uploadedFiles, err := testTools.UploadFiles(req, dir, false)
+
+		if e.errorExpected && err == nil {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+
+		if !e.errorExpected {
+			// the files are returned in the order they were sent, whichever was saved first
+			if len(uploadedFiles) != 20 {
+				t.Errorf("%s: expected 20 files, but got %d", e.name, len(uploadedFiles))
+			}
+			for i, f := range uploadedFiles {
+				if i == e.bad {
+					if f.Error == nil || f.OriginalFileName != fmt.Sprintf("notes%02d.txt", i) {
+						t.Errorf("%s: expected notes%02d.txt to have been rejected, but got %+v", e.name, i, f)
+					}
+					continue
+				}
+				if expected := fmt.Sprintf("img%02d.png", i); f.NewFileName != expected || f.Error != nil {
+					t.Errorf("%s: expected file %d to be %s, but got %+v", e.name, i, expected, f)
+				}
+			}
+		}
+
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != e.expectedFiles {
+			t.Errorf("%s: expected %d files to be saved, but found %d", e.name, e.expectedFiles, len(entries))
+		}
+
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestTools_UploadFiles_ConcurrencySpooled(t *testing.T) {
+	// files too big to be held in memory are held in temporary files alongside the uploads, which
+	// are removed again, and so never in the system's temporary directory, which here doesn't exist
+	t.Setenv("TMPDIR", filepath.Join(t.TempDir(), "missing"))
+
+	uploadDir := filepath.Join(t.TempDir(), "uploads")
+
+	large := bytes.Repeat([]byte("x"), 3*1024*1024)
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "large1.txt", content: large},
+		testPart{field: "file", fileName: "small.txt", content: []byte("hello, world")},
+		testPart{field: "file", fileName: "large2.txt", content: large},
+	)
+
+	testTools := Tools{UploadConcurrency: 2}
+	uploadedFiles, err := testTools.UploadFiles(req, uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range uploadedFiles {
+		info, err := os.Stat(filepath.Join(uploadDir, f.NewFileName))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if info.Size() != f.FileSize {
+			t.Errorf("expected %s to have %d bytes, but it has %d", f.NewFileName, f.FileSize, info.Size())
+		}
+	}
+	if uploadedFiles[0].FileSize != int64(len(large)) {
+		t.Errorf("expected large1.txt to have %d bytes, but got %d", len(large), uploadedFiles[0].FileSize)
+	}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), tempFilePrefix) {
+			t.Errorf("expected the temporary files to have been removed, but found %s", entry.Name())
+		}
+	}
+
+	// files saved elsewhere are held in TempDir, or the system's temporary directory
+	for _, tempDir := range []string{t.TempDir(), ""} {
+		spoolDir := tempDir
+		if tempDir == "" {
+			spoolDir = t.TempDir()
+			t.Setenv("TMPDIR", spoolDir)
+		}
+
+		req = newMultipartRequest(t, testPart{field: "file", fileName: "large1.txt", content: large})
+		testTools := Tools{UploadConcurrency: 2, TempDir: tempDir}
+		if _, err := testTools.UploadFilesTo(req, &memoryTarget{}, false); err != nil {
+			t.Fatal(err)
+		}
+		if entries, _ := os.ReadDir(spoolDir); len(entries) > 0 {
+			t.Errorf("expected the temporary files to have been removed, but found %s", entries[0].Name())
+		}
+	}
+
+	// a compressed file which is too big is reported as too big, rather than as a broken gzip stream
+	compressed := gzipped(t, newTestPNG(t, 400, 300))
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "img.png.gz", content: compressed})
+
+	testTools = Tools{UploadConcurrency: 2, DecompressGzip: true, MaxFileSize: int64(len(compressed) - 1)}
+	_, err = testTools.UploadFiles(req, uploadDir, false)
+	if err == nil || !strings.Contains(err.Error(), "too big") {
+		t.Errorf("expected an error for a file which is too big, but got %v", err)
+	}
+}
+
+func BenchmarkTools_UploadFiles_Concurrency(b *testing.B) {
+	dir := filepath.Join("testdata", "uploads", "bench")
+	defer os.RemoveAll(dir)
+
+	// decoding the images and making their thumbnails is what takes the time
+	parts := concurrentParts(b, 20, -1)
+	content := newTestPNG(b, 1200, 900)
+	for i := range parts {
+		parts[i].content = content
+	}
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for _, p := range parts {
+		part, err := writer.CreateFormFile(p.field, p.fileName)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_, _ = part.Write(p.content)
+	}
+	_ = writer.Close()
+
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			testTools := Tools{UploadConcurrency: workers, GenerateThumbnails: true, ThumbnailWidth: 200, ThumbnailHeight: 200}
+
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("POST", "/", bytes.NewReader(body.Bytes()))
+				req.Header.Add("Content-Type", writer.FormDataContentType())
+
+				if _, err := testTools.UploadFiles(req, dir, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// stickyTarget is a memoryTarget whose files can't be removed
+type stickyTarget struct {
+	memoryTarget
+}
+
+var errSticky = errors.New("file is stuck")
+
+func (s *stickyTarget) Remove(name string) error {
+	return errSticky
+}
+
+func TestTools_UploadFiles_CleanupOnErrorFails(t *testing.T) {
+	testTools := Tools{MaxFileSize: 3, CleanupOnError: true}
+
+	// the second file is too big, and the first can't be removed
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "one.txt", content: []byte("one")},
+		testPart{field: "file", fileName: "two.txt", content: []byte("second")},
+	)
+
+	_, err := testTools.UploadFilesTo(req, &stickyTarget{}, false)
+	if err == nil {
+		t.Fatal("expected an error, but none received")
+	}
+
+	if !strings.Contains(err.Error(), "too big") || !strings.Contains(err.Error(), errSticky.Error()) {
+		t.Errorf("expected the error to give both the reason for the failure and the cleanup error, but got: %s", err)
+	}
+}
+
+func TestTools_UploadFiles_Large(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	// larger than the 32MB that ParseMultipartForm would have held in memory
+	const size = 40 * 1024 * 1024
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		defer pw.Close()
+		defer writer.Close()
+
+		part, err := writer.CreateFormFile("file", "large.bin")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		chunk := bytes.Repeat([]byte("x"), 1024*1024)
+		for i := 0; i < size/len(chunk); i++ {
+			if _, err := part.Write(chunk); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+
+	body := &readCounter{r: pr}
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	var testTools Tools
+	target := &streamingTarget{DiskTarget: DiskTarget{Dir: uploadFolder}, body: body, readBefore: -1}
+
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeUploadedFiles(DiskTarget{Dir: uploadFolder}, uploadedFiles)
+
+	if uploadedFiles[0].FileSize != size {
+		t.Errorf("wrong file size; expected %d, but got %d", size, uploadedFiles[0].FileSize)
+	}
+
+	info, err := os.Stat(filepath.Join(uploadFolder, uploadedFiles[0].NewFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != size {
+		t.Errorf("wrong size on disk; expected %d, but got %d", size, info.Size())
+	}
+
+	// the file is streamed to disk, so the target receives the start of it long before the rest of
+	// the body has been read
+	if target.readBefore < 0 || target.readBefore > size/4 {
+		t.Errorf("expected the upload to be streamed, but %d bytes were read before the target received any", target.readBefore)
+	}
+
+	_, _ = io.Copy(io.Discard, pr)
+}
+
+// readCounter counts the bytes read from r
+type readCounter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *readCounter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// streamingTarget is a DiskTarget which records how much of body had been read when it was first
+// given any of a file to save
+type streamingTarget struct {
+	DiskTarget
+	body       *readCounter
+	readBefore int64
+}
+
+func (s *streamingTarget) Save(name string, r io.Reader) (int64, error) {
+	return s.DiskTarget.Save(name, &firstReadHook{r: r, hook: func() {
+		if s.readBefore < 0 {
+			s.readBefore = s.body.n
+		}
+	}})
+}
+
+// firstReadHook calls hook when the first bytes are read from r
+type firstReadHook struct {
+	r    io.Reader
+	hook func()
+}
+
+func (f *firstReadHook) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if n > 0 && f.hook != nil {
+		f.hook()
+		f.hook = nil
+	}
+	return n, err
+}
+
+// testPart is a single file part of a multipart request built by newMultipartRequest
+type testPart struct {
+	field    string
+	fileName string
+	content  []byte
+}
+
+// newMultipartRequest builds a POST request with a fully buffered multipart body containing parts
+func newMultipartRequest(t *testing.T, parts ...testPart) *http.Request {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	for _, p := range parts {
+		part, err := writer.CreateFormFile(p.field, p.fileName)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := part.Write(p.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+	return req
+}
+
+func TestTools_UploadFiles_TypeAndSize(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	content, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: content})
+
+	var testTools Tools
+
+	uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join(uploadFolder, uploadedFiles[0].NewFileName))
+
+	if uploadedFiles[0].FileType != "image/png" {
+		t.Errorf("wrong file type; expected image/png, but got %s", uploadedFiles[0].FileType)
+	}
+
+	if uploadedFiles[0].FileSize != int64(len(content)) {
+		t.Errorf("wrong file size; expected %d, but got %d", len(content), uploadedFiles[0].FileSize)
+	}
+
+	info, err := os.Stat(filepath.Join(uploadFolder, uploadedFiles[0].NewFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size() != uploadedFiles[0].FileSize {
+		t.Errorf("file size on disk %d does not match reported size %d", info.Size(), uploadedFiles[0].FileSize)
+	}
+}
+
+func TestTools_UploadFilesFromMultipart(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	_ = writer.WriteField("name", "not a file")
+
+	part, err := writer.CreateFormFile("file", "hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write([]byte("hello, world"))
+	_ = writer.Close()
+
+	var testTools Tools
+
+	uploadedFiles, err := testTools.UploadFilesFromMultipart(multipart.NewReader(body, writer.Boundary()), uploadFolder, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploadedFiles) != 1 {
+		t.Fatalf("expected 1 uploaded file, but got %d", len(uploadedFiles))
+	}
+	defer os.Remove(filepath.Join(uploadFolder, uploadedFiles[0].NewFileName))
+
+	if uploadedFiles[0].NewFileName != "hello.txt" {
+		t.Errorf("wrong file name; expected hello.txt, but got %s", uploadedFiles[0].NewFileName)
+	}
+
+	if uploadedFiles[0].FileSize != 12 {
+		t.Errorf("wrong file size; expected 12, but got %d", uploadedFiles[0].FileSize)
+	}
+}
+
+var multipartOptionTests = []struct {
+	name          string
+	tools         Tools
+	rename        bool
+	errorExpected bool
+}{
+	{name: "allowed type", tools: Tools{AllowedFileType: []string{"image/png"}}},
+	{name: "type not allowed", tools: Tools{AllowedFileType: []string{"image/jpeg"}}, errorExpected: true},
+	{name: "too big", tools: Tools{MaxFileSize: 10}, errorExpected: true},
+	{name: "too many files", tools: Tools{MaxUploadCount: 1}, errorExpected: true},
+	{name: "renamed", rename: true},
+}
+
+func TestTools_UploadFilesFromMultipart_Options(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	content, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range multipartOptionTests {
+		// the same checks apply whether or not the multipart data came from an http request
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		for _, name := range []string{"one.png", "two.png"} {
+			part, err := writer.CreateFormFile("file", name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, _ = part.Write(content)
+		}
+		_ = writer.Close()
+
+		testTools := e.tools
+
+		uploadedFiles, err := testTools.UploadFilesFromMultipart(multipart.NewReader(body, writer.Boundary()), uploadFolder, e.rename)
+		for _, f := range uploadedFiles {
+			_ = os.Remove(filepath.Join(uploadFolder, f.NewFileName))
+		}
+
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", e.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		if len(uploadedFiles) != 2 {
+			t.Errorf("%s: expected 2 uploaded files, but got %d", e.name, len(uploadedFiles))
+			continue
+		}
+
+		for _, f := range uploadedFiles {
+			if renamed := f.NewFileName != f.OriginalFileName; renamed != e.rename {
+				t.Errorf("%s: expected renamed to be %v, but %s was saved as %s", e.name, e.rename, f.OriginalFileName, f.NewFileName)
+			}
+		}
+	}
+}
+
+var checksumTests = []struct {
+	name          string
+	algorithm     string
+	expected      string
+	errorExpected bool
+}{
+	{name: "default", algorithm: "", expected: "80babf09b223f1049a5b8216fb5de60ae6dd956e6872e76f838a1c57a5e34147", errorExpected: false},
+	{name: "sha256", algorithm: "sha256", expected: "80babf09b223f1049a5b8216fb5de60ae6dd956e6872e76f838a1c57a5e34147", errorExpected: false},
+	{name: "sha1", algorithm: "sha1", expected: "e29c5ca02f1b2faec0302700fc084584cf2869ae", errorExpected: false},
+	{name: "md5", algorithm: "MD5", expected: "16ad38863c96b5b950d258edd0e6c079", errorExpected: false},
+	{name: "unsupported", algorithm: "crc32", expected: "", errorExpected: true},
+}
+
+func TestTools_UploadFiles_Checksum(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	content, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range checksumTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: content})
+
+		testTools := Tools{HashAlgorithm: e.algorithm}
+
+		uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, true)
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: no error expected but received: %s", e.name, err.Error())
+		}
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: error expected but none received", e.name)
+		}
+
+		if len(uploadedFiles) > 0 {
+			if uploadedFiles[0].Checksum != e.expected {
+				t.Errorf("%s: wrong checksum; expected %s, but got %s", e.name, e.expected, uploadedFiles[0].Checksum)
+			}
+
+			_ = os.Remove(filepath.Join(uploadFolder, uploadedFiles[0].NewFileName))
+		}
+	}
+}
+
+func TestTools_UploadFiles_DisallowedFileType(t *testing.T) {
+	pngContent, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gzipContent bytes.Buffer
+	zw := gzip.NewWriter(&gzipContent)
+	_, _ = zw.Write([]byte("hello, world"))
+	_ = zw.Close()
+
+	var denyTests = []struct {
+		name          string
+		allowed       []string
+		disallowed    []string
+		fileName      string
+		content       []byte
+		errorExpected bool
+	}{
+		{name: "executable rejected", disallowed: []string{"application/octet-stream", "application/x-*"}, fileName: "setup.exe", content: []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff"), errorExpected: true},
+		{name: "png passes", disallowed: []string{"application/octet-stream", "application/x-*"}, fileName: "img.png", content: pngContent, errorExpected: false},
+		{name: "wildcard", disallowed: []string{"application/x-*"}, fileName: "archive.gz", content: gzipContent.Bytes(), errorExpected: true},
+		{name: "case and parameters ignored", disallowed: []string{"TEXT/PLAIN"}, fileName: "notes.txt", content: []byte("hello, world"), errorExpected: true},
+		{name: "deny list wins", allowed: []string{"image/png"}, disallowed: []string{"image/*"}, fileName: "img.png", content: pngContent, errorExpected: true},
+		{name: "allowed wildcard", allowed: []string{"image/*"}, fileName: "img.png", content: pngContent, errorExpected: false},
+		{name: "pdf not in allowed wildcard", allowed: []string{"image/*"}, fileName: "doc.pdf", content: []byte("%PDF-1.4\n%âãÏÓ\n"), errorExpected: true},
+		{name: "allowed without parameters", allowed: []string{"text/plain"}, fileName: "notes.txt", content: []byte("hello, world"), errorExpected: false},
+		{name: "everything allowed", allowed: []string{"*"}, fileName: "doc.pdf", content: []byte("%PDF-1.4\n%âãÏÓ\n"), errorExpected: false},
+	}
+
+	for _, e := range denyTests {
+		testTools := Tools{AllowedFileType: e.allowed, DisallowedFileType: e.disallowed}
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: e.content})
+
+		_, err := testTools.UploadFilesTo(req, &memoryTarget{}, true)
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+	}
+}
+
+var matchFileTypeTests = []struct {
+	name     string
+	fileType string
+	pattern  string
+	expected bool
+}{
+	{name: "png in image/*", fileType: "image/png", pattern: "image/*", expected: true},
+	{name: "jpeg in image/*", fileType: "image/jpeg", pattern: "image/*", expected: true},
+	{name: "pdf not in image/*", fileType: "application/pdf", pattern: "image/*", expected: false},
+	{name: "exact", fileType: "application/pdf", pattern: "application/pdf", expected: true},
+	{name: "exact mismatch", fileType: "image/gif", pattern: "image/png", expected: false},
+	{name: "case", fileType: "image/png", pattern: "IMAGE/*", expected: true},
+	{name: "parameters ignored", fileType: "text/plain; charset=utf-8", pattern: "text/*", expected: true},
+	{name: "parameters ignored exact", fileType: "text/plain; charset=utf-8", pattern: "text/plain", expected: true},
+	{name: "everything", fileType: "application/octet-stream", pattern: "*", expected: true},
+	{name: "prefix only", fileType: "imagery/png", pattern: "image/*", expected: false},
+}
+
+func TestMatchFileType(t *testing.T) {
+	for _, e := range matchFileTypeTests {
+		if matched := matchFileType(e.fileType, e.pattern); matched != e.expected {
+			t.Errorf("%s: expected %v for %s against %s, but got %v", e.name, e.expected, e.fileType, e.pattern, matched)
+		}
+	}
+}
+
+func TestTools_UploadBase64File(t *testing.T) {
+	uploadDir := filepath.Join("testdata", "uploads", "base64")
+	defer os.RemoveAll(uploadDir)
+
+	content, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var base64Tests = []struct {
+		name          string
+		data          string
+		allowed       []string
+		errorExpected bool
+		invalid       bool
+	}{
+		{name: "data uri", data: "data:image/png;base64," + base64.StdEncoding.EncodeToString(content), errorExpected: false},
+		{name: "standard", data: base64.StdEncoding.EncodeToString(content), errorExpected: false},
+		{name: "url safe without padding", data: base64.RawURLEncoding.EncodeToString(content), errorExpected: false},
+		{name: "invalid", data: "not base64!", errorExpected: true, invalid: true},
+		{name: "data uri without base64", data: "data:image/png,hello", errorExpected: true, invalid: true},
+		{name: "type not permitted", data: base64.StdEncoding.EncodeToString(content), allowed: []string{"image/jpeg"}, errorExpected: true, invalid: false},
+	}
+
+	for _, e := range base64Tests {
+		testTools := Tools{AllowedFileType: e.allowed}
+
+		uploadedFile, err := testTools.UploadBase64File(e.data, "img.png", uploadDir, false)
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", e.name)
+			} else if errors.Is(err, ErrInvalidBase64) != e.invalid {
+				t.Errorf("%s: expected errors.Is(err, ErrInvalidBase64) to be %v, but got %v", e.name, e.invalid, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		if uploadedFile.NewFileName != "img.png" || uploadedFile.FileType != "image/png" || uploadedFile.FileSize != int64(len(content)) {
+			t.Errorf("%s: unexpected uploaded file %+v", e.name, uploadedFile)
+		}
+
+		f, err := os.Open(filepath.Join(uploadDir, uploadedFile.NewFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = png.Decode(f)
+		f.Close()
+		if err != nil {
+			t.Errorf("%s: the saved file is not a png: %s", e.name, err)
+		}
+	}
+
+	// the data uri supplies the original content type, and the file can be renamed
+	var testTools Tools
+	uploadedFile, err := testTools.UploadBase64File("data:image/png;base64,"+base64.StdEncoding.EncodeToString(content), "img.png", uploadDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploadedFile.OriginalMIMEType != "image/png" || uploadedFile.NewFileName == "img.png" || filepath.Ext(uploadedFile.NewFileName) != ".png" {
+		t.Errorf("unexpected uploaded file %+v", uploadedFile)
+	}
+}
+
+func TestTools_UploadFilesForField(t *testing.T) {
+	var fieldTests = []struct {
+		name     string
+		field    string
+		expected []string
+	}{
+		{name: "avatar", field: "avatar", expected: []string{"me.txt"}},
+		{name: "document", field: "document", expected: []string{"cv.txt", "letter.txt"}},
+		{name: "every field", field: "", expected: []string{"me.txt", "cv.txt", "letter.txt"}},
+		{name: "no files", field: "passport", expected: nil},
+	}
+
+	for _, e := range fieldTests {
+		req := newMultipartRequest(t,
+			testPart{field: "avatar", fileName: "me.txt", content: []byte("avatar")},
+			testPart{field: "document", fileName: "cv.txt", content: []byte("cv")},
+			testPart{field: "document", fileName: "letter.txt", content: []byte("letter")},
+		)
+
+		dir := filepath.Join("testdata", "uploads", "field")
+
+		var testTools Tools
+		uploadedFiles, err := testTools.UploadFilesForField(req, e.field, dir, false)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+
+		var names []string
+		for _, f := range uploadedFiles {
+			names = append(names, f.NewFileName)
+		}
+		if !reflect.DeepEqual(names, e.expected) {
+			t.Errorf("%s: expected %v to be uploaded, but got %v", e.name, e.expected, names)
+		}
+
+		// nothing from the other fields is saved
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != len(e.expected) {
+			t.Errorf("%s: expected %d files to be saved, but found %d", e.name, len(e.expected), len(entries))
+		}
+
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func TestTools_UploadFilesWithValues(t *testing.T) {
+	dir := filepath.Join("testdata", "uploads", "values")
+	defer os.RemoveAll(dir)
+
+	// a part with no file name is a form field
+	req := newMultipartRequest(t,
+		testPart{field: "title", content: []byte("Holiday")},
+		testPart{field: "photo", fileName: "beach.txt", content: []byte("sand")},
+		testPart{field: "tag", content: []byte("sea")},
+		testPart{field: "tag", content: []byte("sun")},
+	)
+
+	var testTools Tools
+	uploadedFiles, values, err := testTools.UploadFilesWithValues(req, dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploadedFiles) != 1 || uploadedFiles[0].NewFileName != "beach.txt" {
+		t.Errorf("expected beach.txt to be uploaded, but got %v", uploadedFiles)
+	}
+
+	expected := url.Values{"title": {"Holiday"}, "tag": {"sea", "sun"}}
+	if !reflect.DeepEqual(values, expected) {
+		t.Errorf("expected values %v, but got %v", expected, values)
+	}
+
+	// the values are limited in size
+	req = newMultipartRequest(t, testPart{field: "big", content: bytes.Repeat([]byte("a"), maxFormValuesSize+1)})
+
+	_, _, err = testTools.UploadFilesWithValues(req, dir, false)
+	if err == nil || !strings.Contains(err.Error(), "form values are too big") {
+		t.Errorf("expected the values to be too big, but got %v", err)
+	}
+}
+
+func TestTools_UploadFiles_SubdirPattern(t *testing.T) {
+	uploadDir := filepath.Join("testdata", "uploads", "subdir")
+	defer os.RemoveAll(uploadDir)
+
+	content := newTestPNG(t, 40, 30)
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	today := time.Now().UTC().Format("2006/01/02")
+
+	var subdirTests = []struct {
+		name          string
+		pattern       string
+		expected      string
+		errorExpected bool
+	}{
+		{name: "date", pattern: "2006/01/02", expected: today + "/img.png"},
+		{name: "prefix", pattern: "photos/2006-01", expected: "photos/" + time.Now().UTC().Format("2006-01") + "/img.png"},
+		{name: "hash", pattern: "{hash:2}/{hash:4}", expected: checksum[:2] + "/" + checksum[:4] + "/img.png"},
+		{name: "date and hash", pattern: "2006/{hash:2}", expected: time.Now().UTC().Format("2006") + "/" + checksum[:2] + "/img.png"},
+		{name: "literal", pattern: "'user1'/2006", expected: "user1/" + time.Now().UTC().Format("2006") + "/img.png"},
+		{name: "literal and hash", pattern: "'user1'/{hash:2}", expected: "user1/" + checksum[:2] + "/img.png"},
+		{name: "literal in a segment", pattern: "'Jan'-01", expected: "Jan-" + time.Now().UTC().Format("01") + "/img.png"},
+		{name: "unclosed quote", pattern: "'user1/2006", errorExpected: true},
+		{name: "parent", pattern: "../2006", errorExpected: true},
+		{name: "quoted parent", pattern: "'..'/2006", errorExpected: true},
+		{name: "absolute", pattern: "/2006/01", errorExpected: true},
+		{name: "empty segment", pattern: "2006//01", errorExpected: true},
+		{name: "hash too long", pattern: "{hash:65}", errorExpected: true},
+		{name: "hash without length", pattern: "{hash}", errorExpected: true},
+		{name: "hash of nothing", pattern: "{hash:0}", errorExpected: true},
+	}
+
+	for _, e := range subdirTests {
+		testTools := Tools{SubdirPattern: e.pattern}
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: content})
+
+		uploadedFiles, err := testTools.UploadFiles(req, uploadDir, false)
+
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", e.name)
+			}
+			if entries, _ := os.ReadDir(uploadDir); len(entries) > 0 {
+				t.Errorf("%s: expected nothing to be saved, but found %s", e.name, entries[0].Name())
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		// the name returned is the path of the file within the upload directory
+		if uploadedFiles[0].NewFileName != e.expected {
+			t.Errorf("%s: expected the file to be saved as %s, but got %s", e.name, e.expected, uploadedFiles[0].NewFileName)
+		}
+		if _, err := os.Stat(filepath.Join(uploadDir, filepath.FromSlash(e.expected))); err != nil {
+			t.Errorf("%s: expected the file to be saved: %s", e.name, err)
+		}
+
+		// nothing is left behind under a temporary name
+		entries, _ := os.ReadDir(uploadDir)
+		for _, entry := range entries {
+			if strings.HasPrefix(entry.Name(), tempFilePrefix) {
+				t.Errorf("%s: found the temporary file %s", e.name, entry.Name())
+			}
+		}
+
+		_ = os.RemoveAll(uploadDir)
+	}
+
+	// a subdirectory named after the checksum needs a target which can rename files
+	testTools := Tools{SubdirPattern: "{hash:2}"}
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: content})
+
+	target := &memoryTarget{}
+	if _, err := testTools.UploadFilesTo(req, target, false); err == nil || len(target.files) > 0 {
+		t.Errorf("expected an error and nothing to be saved, but got %v and %d files", err, len(target.files))
+	}
+}
+
+func TestUploadedFile_Open(t *testing.T) {
+	uploadDir := filepath.Join("testdata", "uploads", "open")
+	defer os.RemoveAll(uploadDir)
+
+	content := newTestPNG(t, 40, 30)
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+
+	var openTests = []struct {
+		name     string
+		tools    Tools
+		fullPath string
+	}{
+		{name: "disk", fullPath: filepath.Join(uploadDir, "img.png")},
+		{name: "subdirectory", tools: Tools{SubdirPattern: "{hash:2}"}, fullPath: filepath.Join(uploadDir, checksum[:2], "img.png")},
+		{name: "storage backend", tools: Tools{StorageBackend: LocalDiskStorage{Dir: uploadDir}}, fullPath: filepath.Join(uploadDir, "img.png")},
+	}
+
+	for _, e := range openTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: content})
+
+		testTools := e.tools
+		uploadedFiles, err := testTools.UploadFiles(req, uploadDir, false)
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+		uploadedFile := uploadedFiles[0]
+
+		if uploadedFile.FullPath != e.fullPath {
+			t.Errorf("%s: expected the path %s, but got %s", e.name, e.fullPath, uploadedFile.FullPath)
+		}
+
+		info, err := os.Stat(e.fullPath)
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+		if !uploadedFile.ModTime.Equal(info.ModTime()) {
+			t.Errorf("%s: expected the modification time %s, but got %s", e.name, info.ModTime(), uploadedFile.ModTime)
+		}
+
+		rc, err := uploadedFile.Open()
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+		saved, _ := io.ReadAll(rc)
+		_ = rc.Close()
+
+		if !bytes.Equal(saved, content) {
+			t.Errorf("%s: the contents read back do not match those uploaded", e.name)
+		}
+
+		_ = os.RemoveAll(uploadDir)
+	}
+
+	// a target which can't read files
+	var testTools Tools
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: content})
+
+	uploadedFiles, err := testTools.UploadFilesTo(req, &memoryTarget{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploadedFiles[0].Open(); err == nil {
+		t.Error("expected an error opening a file in a target which can't open files, but none received")
+	}
+	if uploadedFiles[0].FullPath != "" || uploadedFiles[0].ModTime.IsZero() {
+		t.Errorf("expected no path and the time it was stored, but got %q and %s", uploadedFiles[0].FullPath, uploadedFiles[0].ModTime)
+	}
+}
+
+func TestTools_UploadFiles_FieldName(t *testing.T) {
+	req := newMultipartRequest(t,
+		testPart{field: "passport", fileName: "passport.txt", content: []byte("passport")},
+		testPart{field: "utility_bill", fileName: "bill.txt", content: []byte("bill")},
+		testPart{field: "utility_bill", fileName: "bill.exe", content: []byte("MZ\x90\x00\x03\x00\x00\x00\x04\x00\x00\x00\xff\xff")},
+	)
+
+	testTools := Tools{AllowedFileType: []string{"text/plain; charset=utf-8"}, ContinueOnError: true}
+	uploadedFiles, err := testTools.UploadFilesTo(req, &memoryTarget{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{"passport.txt": "passport", "bill.txt": "utility_bill", "bill.exe": "utility_bill"}
+	if len(uploadedFiles) != len(expected) {
+		t.Fatalf("expected %d files, but got %d", len(expected), len(uploadedFiles))
+	}
+
+	// the field is recorded for files which were rejected, too
+	for _, f := range uploadedFiles {
+		if f.FieldName != expected[f.OriginalFileName] {
+			t.Errorf("expected %s to come from %s, but got %q", f.OriginalFileName, expected[f.OriginalFileName], f.FieldName)
+		}
+	}
+
+	if uploadedFiles[2].Error == nil {
+		t.Error("expected bill.exe to be rejected, but it was not")
+	}
+}
+
+var minSizeTests = []struct {
+	name          string
+	minSize       int64
+	rejectEmpty   bool
+	content       string
+	errorExpected bool
+	errorContains string
+}{
+	{name: "empty allowed by default", content: "", errorExpected: false},
+	{name: "empty rejected", rejectEmpty: true, content: "", errorExpected: true, errorContains: "is empty"},
+	{name: "not empty", rejectEmpty: true, content: "x", errorExpected: false},
+	{name: "below minimum", minSize: 10, content: "too small", errorExpected: true, errorContains: "at least 10 bytes"},
+	{name: "at minimum", minSize: 10, content: "big enough", errorExpected: false},
+	{name: "minimum with empty rejected", minSize: 10, rejectEmpty: true, content: "", errorExpected: true, errorContains: "at least 10 bytes"},
+}
+
+func TestTools_UploadFiles_MinFileSize(t *testing.T) {
+	uploadDir := filepath.Join("testdata", "uploads", "minsize")
+	defer os.RemoveAll(uploadDir)
+
+	for _, e := range minSizeTests {
+		testTools := Tools{MinFileSize: e.minSize, RejectEmptyUploads: e.rejectEmpty}
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "file.txt", content: []byte(e.content)})
+
+		uploadedFiles, err := testTools.UploadFiles(req, uploadDir, false)
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+		if err != nil && !strings.Contains(err.Error(), e.errorContains) {
+			t.Errorf("%s: expected the error to contain %q, but got %q", e.name, e.errorContains, err)
+		}
+
+		// nothing, not even a temporary file, is left behind by a rejected file
+		entries, _ := os.ReadDir(uploadDir)
+		if e.errorExpected && len(entries) > 0 {
+			t.Errorf("%s: expected nothing to be saved, but found %s", e.name, entries[0].Name())
+		}
+		if !e.errorExpected && uploadedFiles[0].FileSize != int64(len(e.content)) {
+			t.Errorf("%s: expected %d bytes to be saved, but got %d", e.name, len(e.content), uploadedFiles[0].FileSize)
+		}
+
+		_ = os.RemoveAll(uploadDir)
+	}
+}
+
+// gzipped returns content compressed with gzip
+func gzipped(t *testing.T, content []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestTools_UploadFiles_DecompressGzip(t *testing.T) {
+	uploadDir := filepath.Join("testdata", "uploads", "gunzip")
+	defer os.RemoveAll(uploadDir)
+
+	logContent := []byte(strings.Repeat("2024-01-31 12:00:00 sensor reading ok\n", 1000))
+
+	// a gzip stream whose checksum does not match its contents
+	corrupt := gzipped(t, logContent)
+	corrupt[len(corrupt)-5] ^= 0xff
+
+	var gzipTests = []struct {
+		name          string
+		tools         Tools
+		fileName      string
+		content       []byte
+		newFileName   string
+		saved         []byte
+		errorExpected bool
+	}{
+		{name: "decompressed", tools: Tools{DecompressGzip: true, AllowedFileType: []string{"text/plain; charset=utf-8"}, AllowedFileExtensions: []string{"log"}}, fileName: "device.log.gz", content: gzipped(t, logContent), newFileName: "device.log", saved: logContent},
+		{name: "named only by content", tools: Tools{DecompressGzip: true}, fileName: "device.log", content: gzipped(t, logContent), newFileName: "device.log", saved: logContent},
+		{name: "left compressed", tools: Tools{}, fileName: "device.log.gz", content: gzipped(t, logContent), newFileName: "device.log.gz", saved: gzipped(t, logContent)},
+		{name: "contents not permitted", tools: Tools{DecompressGzip: true, AllowedFileType: []string{"text/plain; charset=utf-8"}}, fileName: "img.png.gz", content: gzipped(t, newTestPNG(t, 10, 10)), errorExpected: true},
+		{name: "extension of contents not permitted", tools: Tools{DecompressGzip: true, AllowedFileExtensions: []string{"gz"}}, fileName: "device.log.gz", content: gzipped(t, logContent), errorExpected: true},
+		{name: "not gzip", tools: Tools{DecompressGzip: true}, fileName: "device.log.gz", content: logContent, errorExpected: true},
+		{name: "corrupt", tools: Tools{DecompressGzip: true}, fileName: "device.log.gz", content: corrupt, errorExpected: true},
+		{name: "bomb", tools: Tools{DecompressGzip: true, MaxFileSize: 1024 * 1024}, fileName: "zeros.gz", content: gzipped(t, make([]byte, 20*1024*1024)), errorExpected: true},
+	}
+
+	for _, e := range gzipTests {
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: e.content})
+
+		testTools := e.tools
+		uploadedFiles, err := testTools.UploadFiles(req, uploadDir, false)
+
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", e.name)
+			}
+
+			// nothing, not even part of the file, is left behind
+			if entries, _ := os.ReadDir(uploadDir); len(entries) > 0 {
+				t.Errorf("%s: expected nothing to be saved, but found %s", e.name, entries[0].Name())
+			}
+		} else {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", e.name, err)
+				continue
+			}
+
+			uploadedFile := uploadedFiles[0]
+			if uploadedFile.NewFileName != e.newFileName || uploadedFile.OriginalFileName != e.fileName {
+				t.Errorf("%s: expected %s to be saved as %s, but got %s", e.name, uploadedFile.OriginalFileName, e.newFileName, uploadedFile.NewFileName)
+			}
+
+			saved, _ := os.ReadFile(filepath.Join(uploadDir, uploadedFile.NewFileName))
+			if !bytes.Equal(saved, e.saved) || uploadedFile.FileSize != int64(len(e.saved)) {
+				t.Errorf("%s: expected %d bytes to be saved, but got %d (FileSize %d)", e.name, len(e.saved), len(saved), uploadedFile.FileSize)
+			}
+		}
+
+		_ = os.RemoveAll(uploadDir)
+	}
+}
+
+func TestTools_UploadFiles_TypeAndExtensionErrors(t *testing.T) {
+	pngContent := newTestPNG(t, 10, 10)
+
+	var checkTests = []struct {
+		name          string
+		fileName      string
+		content       []byte
+		errorContains string
+	}{
+		{name: "both pass", fileName: "img.png", content: pngContent, errorContains: ""},
+		{name: "wrong type", fileName: "img.jpg", content: []byte("hello, world"), errorContains: "type is not permitted: img.jpg was detected as text/plain"},
+		{name: "wrong extension", fileName: "img.gif", content: pngContent, errorContains: "extension is not permitted: img.gif"},
+		{name: "png named as jpeg", fileName: "img.jpg", content: pngContent, errorContains: ""},
+	}
+
+	for _, e := range checkTests {
+		testTools := Tools{AllowedFileType: []string{"image/png", "image/jpeg"}, AllowedFileExtensions: []string{"png", "jpg"}}
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: e.content})
+
+		_, err := testTools.UploadFilesTo(req, &memoryTarget{}, false)
+		if e.errorContains == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", e.name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), e.errorContains) {
+			t.Errorf("%s: expected an error containing %q, but got %v", e.name, e.errorContains, err)
+		}
+	}
+}
+
+func TestTools_UploadFiles_RequireExtensionMatch(t *testing.T) {
+	pngContent := newTestPNG(t, 10, 10)
+
+	var matchTests = []struct {
+		name          string
+		fileName      string
+		content       []byte
+		requireMatch  bool
+		extensions    []string
+		overrides     map[string]string
+		errorContains string
+	}{
+		{name: "png named as jpeg, not required", fileName: "img.jpg", content: pngContent},
+		{name: "png named as jpeg, extension allowed", fileName: "img.jpg", content: pngContent, extensions: []string{"jpg"}},
+		{name: "mp3 without a tag, extension allowed", fileName: "song.mp3", content: []byte{0xff, 0xfb, 0x90, 0x64, 0x00, 0x00}, extensions: []string{"mp3"}},
+		{name: "png named as jpeg", fileName: "img.jpg", content: pngContent, requireMatch: true, errorContains: "img.jpg was detected as image/png, but .jpg files are image/jpeg"},
+		{name: "png", fileName: "IMG.PNG", content: pngContent, requireMatch: true},
+		{name: "html named as jpeg", fileName: "photo.jpeg", content: []byte("<html><script>alert(1)</script></html>"), requireMatch: true, errorContains: "detected as text/html; charset=utf-8, but .jpeg files are image/jpeg"},
+		{name: "text with charset", fileName: "notes.txt", content: []byte("hello, world"), requireMatch: true},
+		{name: "unknown extension", fileName: "shell.php", content: []byte("<?php echo 1;"), requireMatch: true, errorContains: "the type of shell.php can't be checked"},
+		{name: "no extension", fileName: "img", content: pngContent, requireMatch: true, errorContains: "can't be checked"},
+		{name: "added extension", fileName: "data.log", content: []byte("hello, world"), requireMatch: true, overrides: map[string]string{".LOG": "text/*"}},
+		{name: "overridden extension", fileName: "img.jpg", content: pngContent, requireMatch: true, overrides: map[string]string{"jpg": "image/png"}},
+	}
+
+	for _, e := range matchTests {
+		testTools := Tools{RequireExtensionMatch: e.requireMatch, AllowedFileExtensions: e.extensions, ExtensionMIMEOverrides: e.overrides}
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: e.content})
+
+		target := &memoryTarget{}
+		_, err := testTools.UploadFilesTo(req, target, false)
+		if e.errorContains == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", e.name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), e.errorContains) {
+			t.Errorf("%s: expected an error containing %q, but got %v", e.name, e.errorContains, err)
+		}
+		if len(target.files) > 0 {
+			t.Errorf("%s: expected nothing to be saved", e.name)
+		}
+	}
+}
+
+func TestTools_UploadFiles_AllowedFileNamePattern(t *testing.T) {
+	pattern := regexp.MustCompile(`^invoice_\d{4}-\d{2}-\d{2}\.pdf$`)
+
+	var nameTests = []struct {
+		name          string
+		fileName      string
+		errorExpected bool
+	}{
+		{name: "matches", fileName: "invoice_2024-01-31.pdf", errorExpected: false},
+		{name: "wrong date", fileName: "invoice_2024-1-31.pdf", errorExpected: true},
+		{name: "wrong prefix", fileName: "receipt_2024-01-31.pdf", errorExpected: true},
+		{name: "trailing text", fileName: "invoice_2024-01-31.pdf.exe", errorExpected: true},
+	}
+
+	for _, e := range nameTests {
+		testTools := Tools{AllowedFileNamePattern: pattern}
+		req := newMultipartRequest(t, testPart{field: "file", fileName: e.fileName, content: []byte("%PDF-1.4")})
+
+		_, err := testTools.UploadFilesTo(req, &memoryTarget{}, true)
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+	}
+}
+
+func TestTools_UploadFiles_RenameFunc(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	var testTools Tools
+	testTools.RenameFunc = func(originalName string) string {
+		return "user-42"
+	}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "hello.txt", content: []byte("hello, world")})
+
+	uploadedFiles, err := testTools.UploadFiles(req, uploadFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join(uploadFolder, "user-42.txt"))
+
+	if uploadedFiles[0].NewFileName != "user-42.txt" {
+		t.Errorf("wrong file name; expected user-42.txt, but got %s", uploadedFiles[0].NewFileName)
+	}
+
+	// a second upload with the same name must not overwrite the first
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "goodbye.txt", content: []byte("goodbye")})
+
+	_, err = testTools.UploadFiles(req, uploadFolder)
+	if err == nil {
+		t.Error("expected an error when the new file name already exists, but none received")
+	}
+
+	content, _ := os.ReadFile(filepath.Join(uploadFolder, "user-42.txt"))
+	if string(content) != "hello, world" {
+		t.Errorf("existing file was overwritten; it now contains %q", content)
+	}
+
+	// the name is sanitized as if it had come from the client
+	testTools.RenameFunc = func(originalName string) string {
+		return "../users/42:" + originalName
+	}
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "hello.txt", content: []byte("hello, world")})
+
+	uploadedFiles, err = testTools.UploadFilesTo(req, &memoryTarget{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploadedFiles[0].NewFileName != "42_hello.txt" {
+		t.Errorf("wrong file name; expected 42_hello.txt, but got %s", uploadedFiles[0].NewFileName)
+	}
+
+	testTools.RenameFunc = func(originalName string) string {
+		return "users/.."
+	}
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "hello.txt", content: []byte("hello, world")})
+
+	if _, err := testTools.UploadFilesTo(req, &memoryTarget{}); err == nil {
+		t.Error("expected an error for a name which is not permitted, but none received")
+	}
+}
+
+func TestTools_UploadFiles_SameNameConcurrently(t *testing.T) {
+	uploadFolder := t.TempDir()
+
+	// two files given the same name, and saved at the same time, must not replace each other
+	testTools := Tools{UploadConcurrency: 2}
+	testTools.RenameFunc = func(originalName string) string {
+		return "same.txt"
+	}
+
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "one.txt", content: bytes.Repeat([]byte("1"), 100000)},
+		testPart{field: "file", fileName: "two.txt", content: bytes.Repeat([]byte("2"), 100000)},
+	)
+
+	_, err := testTools.UploadFiles(req, uploadFolder)
+	if err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("expected an error for the second file named same.txt, but got %v", err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(uploadFolder, "same.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, bytes.Repeat([]byte("1"), 100000)) && !bytes.Equal(content, bytes.Repeat([]byte("2"), 100000)) {
+		t.Error("expected same.txt to hold one of the files, whole")
+	}
+}
+
+func TestTools_UploadFiles_FileNameGenerator(t *testing.T) {
+	var testTools Tools
+	testTools.FileNameGenerator = func(originalName, mimeType string) string {
+		switch {
+		case mimeType == "image/png":
+			return "photo-" + originalName
+		case originalName == "evil.txt":
+			return "../../" + originalName
+		}
+		return ""
+	}
+
+	content, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "img.png", content: content},
+		testPart{field: "file", fileName: "hello.txt", content: []byte("hello, world")},
+		testPart{field: "file", fileName: "evil.txt", content: []byte("hello, world")},
+	)
+
+	// the generator is used even though the files are not being renamed
+	target := &memoryTarget{}
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uploadedFiles[0].NewFileName != "photo-img.png" {
+		t.Errorf("wrong file name; expected photo-img.png, but got %s", uploadedFiles[0].NewFileName)
+	}
+
+	// an empty name falls back to the usual behaviour
+	if uploadedFiles[1].NewFileName != "hello.txt" {
+		t.Errorf("wrong file name; expected hello.txt, but got %s", uploadedFiles[1].NewFileName)
+	}
+
+	// directories are removed from the name, as from a name sent by the client
+	if uploadedFiles[2].NewFileName != "evil.txt" {
+		t.Errorf("wrong file name; expected evil.txt, but got %s", uploadedFiles[2].NewFileName)
+	}
+}
+
+func TestTools_UploadFiles_OriginalMIMEType(t *testing.T) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	h := make(textproto.MIMEHeader)
+	h.Set("Content-Disposition", `form-data; name="file"; filename="hello.txt"`)
+	h.Set("Content-Type", "application/pdf")
+
+	part, err := writer.CreatePart(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write([]byte("hello, world"))
+	_ = writer.Close()
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	var testTools Tools
+
+	uploadedFiles, err := testTools.UploadFilesTo(req, &memoryTarget{}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the type claimed by the client is kept apart from the type detected
+	if uploadedFiles[0].OriginalMIMEType != "application/pdf" {
+		t.Errorf("wrong original MIME type; expected application/pdf, but got %s", uploadedFiles[0].OriginalMIMEType)
+	}
+
+	if uploadedFiles[0].FileType != "text/plain; charset=utf-8" {
+		t.Errorf("wrong file type; expected text/plain; charset=utf-8, but got %s", uploadedFiles[0].FileType)
+	}
+}
+
+var unsafeFileNameTests = []struct {
+	name     string
+	fileName string
+}{
+	{name: "parent directory", fileName: "../../evil.txt"},
+	{name: "windows parent directory", fileName: `..\\..\\evil.txt`},
+	{name: "absolute path", fileName: "/etc/cron.d/evil"},
+	{name: "dot dot", fileName: ".."},
+	{name: "null byte", fileName: "evil\x00.txt"},
+	{name: "invalid characters", fileName: "what?<evil>.txt"},
+}
+
+func TestTools_UploadFiles_UnsafeFileNames(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	absUploadFolder, err := filepath.Abs(uploadFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range unsafeFileNameTests {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="file"; filename="%s"`, e.fileName))
+		h.Set("Content-Type", "application/octet-stream")
+
+		part, err := writer.CreatePart(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = part.Write([]byte("evil"))
+		_ = writer.Close()
+
+		var testTools Tools
+
+		uploadedFiles, err := testTools.UploadFilesFromMultipart(multipart.NewReader(body, writer.Boundary()), uploadFolder, false)
+		if err != nil {
+			continue
+		}
+
+		for _, f := range uploadedFiles {
+			fp, err := filepath.Abs(filepath.Join(uploadFolder, f.NewFileName))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if filepath.Dir(fp) != absUploadFolder {
+				t.Errorf("%s: file written outside the upload folder: %s", e.name, fp)
+			}
+
+			if strings.ContainsAny(f.NewFileName, "\x00<>?") {
+				t.Errorf("%s: invalid characters in file name %q", e.name, f.NewFileName)
+			}
+
+			_ = os.Remove(fp)
+		}
+	}
+}
+
+var sanitizeTests = []struct {
+	name          string
+	fileName      string
+	expected      string
+	errorExpected bool
+}{
+	{name: "plain", fileName: "photo.jpg", expected: "photo.jpg", errorExpected: false},
+	{name: "parent directory", fileName: "../../evil.txt", expected: "evil.txt", errorExpected: false},
+	{name: "windows path", fileName: `C:\\temp\\evil.txt`, expected: "evil.txt", errorExpected: false},
+	{name: "null byte", fileName: "evil\x00.txt", expected: "evil_.txt", errorExpected: false},
+	{name: "dot dot", fileName: "..", expected: "", errorExpected: true},
+	{name: "trailing slash", fileName: "evil/", expected: "", errorExpected: true},
+}
+
+func TestTools_sanitizeFileName(t *testing.T) {
+	for _, e := range sanitizeTests {
+		fileName, err := sanitizeFileName(e.fileName)
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: error received when none expected: %s", e.name, err.Error())
+		}
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: no error received when an error expected", e.name)
+		}
+
+		if fileName != e.expected {
+			t.Errorf("%s: expected %q, but got %q", e.name, e.expected, fileName)
+		}
+	}
+}
+
+func TestTools_UploadFiles_MaxUploadCount(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "one.txt", content: []byte("one")},
+		testPart{field: "file", fileName: "two.txt", content: []byte("two")},
+		testPart{field: "file", fileName: "three.txt", content: []byte("three")},
+	)
+
+	testTools := Tools{MaxUploadCount: 2}
+
+	_, err := testTools.UploadFiles(req, uploadFolder, false)
+	if err == nil {
+		t.Error("expected an error when too many files are uploaded, but none received")
+	}
+
+	for _, name := range []string{"one.txt", "two.txt", "three.txt"} {
+		if _, err := os.Stat(filepath.Join(uploadFolder, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to have been removed", name)
+			_ = os.Remove(filepath.Join(uploadFolder, name))
+		}
+	}
+}
+
+func TestTools_UploadFiles_MaxTotalUploadSize(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	one := bytes.Repeat([]byte("1"), 1000)
+	two := bytes.Repeat([]byte("2"), 1000)
+
+	// the limit is reached halfway through the second file
+	testTools := Tools{MaxTotalUploadSize: 1500}
+
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "one.txt", content: one},
+		testPart{field: "file", fileName: "two.txt", content: two},
+	)
+
+	_, err := testTools.UploadFiles(req, uploadFolder, false)
+	if err == nil {
+		t.Error("expected an error when the total upload size is exceeded, but none received")
+	}
+
+	for _, name := range []string{"one.txt", "two.txt"} {
+		if _, err := os.Stat(filepath.Join(uploadFolder, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to have been removed", name)
+			_ = os.Remove(filepath.Join(uploadFolder, name))
+		}
+	}
+
+	// both files fit within a larger limit
+	testTools.MaxTotalUploadSize = 2000
+
+	req = newMultipartRequest(t,
+		testPart{field: "file", fileName: "one.txt", content: one},
+		testPart{field: "file", fileName: "two.txt", content: two},
+	)
+
+	uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, false)
+	if err != nil {
+		t.Errorf("no error expected but received: %s", err.Error())
+	}
+	removeUploadedFiles(DiskTarget{Dir: uploadFolder}, uploadedFiles)
+
+	if len(uploadedFiles) != 2 {
+		t.Errorf("expected 2 uploaded files, but got %d", len(uploadedFiles))
+	}
+}
+
+func TestTools_UploadFiles_MaxFileSize(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	content, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a limit smaller than the file rejects it, naming the file
+	testTools := Tools{MaxFileSize: int64(len(content) - 1)}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: content})
+
+	_, err = testTools.UploadFiles(req, uploadFolder, false)
+	if err == nil {
+		t.Error("expected an error when the file is too big, but none received")
+	} else if !strings.Contains(err.Error(), "img.png") {
+		t.Errorf("expected the error to name the file, but got: %s", err.Error())
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadFolder, "img.png")); !os.IsNotExist(err) {
+		t.Error("expected img.png to have been removed")
+		_ = os.Remove(filepath.Join(uploadFolder, "img.png"))
+	}
+
+	// a limit matching the file accepts it
+	testTools.MaxFileSize = int64(len(content))
+
+	req = newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: content})
+
+	uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, false)
+	if err != nil {
+		t.Errorf("no error expected but received: %s", err.Error())
+	}
+	removeUploadedFiles(DiskTarget{Dir: uploadFolder}, uploadedFiles)
+
+	// limits of 2GB and more can be set on any platform
+	testTools.MaxFileSize = 5 << 30
+	if testTools.maxFileSize() != 5<<30 {
+		t.Errorf("expected a limit of %d bytes, but got %d", int64(5<<30), testTools.maxFileSize())
+	}
+}
+
+func TestTools_UploadFiles_MaxTotalUploadSizeBody(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	// a large form field counts towards the size of the body, though it is not a file
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, err := writer.CreateFormFile("file", "one.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = part.Write([]byte("one"))
+	_ = writer.WriteField("padding", strings.Repeat("x", maxMultipartOverhead+2000))
+	_ = writer.Close()
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	testTools := Tools{MaxTotalUploadSize: 1000}
+
+	_, err = testTools.UploadFiles(req, uploadFolder, false)
+	if err == nil {
+		t.Error("expected an error when the request body is too big, but none received")
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadFolder, "one.txt")); !os.IsNotExist(err) {
+		t.Error("expected one.txt to have been removed")
+		_ = os.Remove(filepath.Join(uploadFolder, "one.txt"))
+	}
+}
+
+// cancelReader reads from r, and calls cancel once more than n bytes have been read
+type cancelReader struct {
+	r      io.Reader
+	n      int
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n -= n
+	if c.n < 0 {
+		c.cancel()
+	}
+	return n, err
+}
+
+func TestTools_UploadFilesContext(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "big.txt", content: bytes.Repeat([]byte("x"), 100000)})
+
+	// cancel the context part of the way through the file
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req.Body = io.NopCloser(&cancelReader{r: req.Body, n: 10000, cancel: cancel})
+
+	var testTools Tools
+
+	_, err := testTools.UploadFilesContext(ctx, req, uploadFolder, false)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, but got %v", err)
+	}
+
+	if err != nil && !strings.Contains(err.Error(), "big.txt") {
+		t.Errorf("expected the error to name the file, but got: %s", err.Error())
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadFolder, "big.txt")); !os.IsNotExist(err) {
+		t.Error("expected big.txt to have been removed")
+		_ = os.Remove(filepath.Join(uploadFolder, "big.txt"))
+	}
+}
+
+func TestTools_UploadFiles_RequestContext(t *testing.T) {
+	uploadFolder := t.TempDir()
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "big.txt", content: bytes.Repeat([]byte("x"), 100000)})
+
+	// the client goes away part of the way through the file
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req = req.WithContext(ctx)
+	req.Body = io.NopCloser(&cancelReader{r: req.Body, n: 10000, cancel: cancel})
+
+	var testTools Tools
+
+	_, err := testTools.UploadFiles(req, uploadFolder)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, but got %v", err)
+	}
+
+	// neither the renamed file nor any partial file is left behind
+	entries, err := os.ReadDir(uploadFolder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("expected no files to be left in the upload directory, but found %s", entry.Name())
+	}
+}
+
+func TestTools_UploadOneFile_MoreThanOne(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "one.txt", content: []byte("one")},
+		testPart{field: "file", fileName: "two.txt", content: []byte("two")},
+	)
+
+	var testTools Tools
+
+	_, err := testTools.UploadOneFile(req, uploadFolder, false)
+	if err == nil {
+		t.Error("expected an error when more than one file is uploaded, but none received")
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadFolder, "one.txt")); !os.IsNotExist(err) {
+		t.Error("expected one.txt to have been removed")
+		_ = os.Remove(filepath.Join(uploadFolder, "one.txt"))
+	}
+}
+
+// memoryTarget is an UploadTarget which keeps files in memory
+type memoryTarget struct {
+	files map[string][]byte
+}
+
+func (m *memoryTarget) Save(name string, r io.Reader) (int64, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+
+	if m.files == nil {
+		m.files = make(map[string][]byte)
+	}
+	m.files[name] = content
+	return int64(len(content)), nil
+}
+
+func (m *memoryTarget) Remove(name string) error {
+	delete(m.files, name)
+	return nil
+}
+
+// countingTarget is an UploadTarget which stores nothing, and only counts the bytes it is given
+type countingTarget struct {
+	written int64
+}
+
+func (c *countingTarget) Save(name string, r io.Reader) (int64, error) {
+	n, err := io.Copy(io.Discard, r)
+	c.written += n
+	return n, err
+}
+
+func TestTools_UploadFiles_FileSize(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789"), 12345)
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "numbers.txt", content: content})
+
+	var testTools Tools
+	target := &countingTarget{}
+
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the size is counted as the file is written, without looking at what was stored
+	if uploadedFiles[0].FileSize != int64(len(content)) || target.written != int64(len(content)) {
+		t.Errorf("expected %d bytes to be written, but FileSize is %d and the target received %d", len(content), uploadedFiles[0].FileSize, target.written)
+	}
+}
+
+func TestTools_UploadFiles_SaveUploadMetadata(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	testTools := Tools{SaveUploadMetadata: true}
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "hello.txt", content: []byte("hello, world")})
+
+	before := time.Now()
+
+	uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeUploadedFiles(DiskTarget{Dir: uploadFolder}, uploadedFiles)
+
+	uploadedFile := uploadedFiles[0]
+	if uploadedFile.MetadataFileName != uploadedFile.NewFileName+".meta.json" {
+		t.Errorf("wrong metadata file name: %s", uploadedFile.MetadataFileName)
+	}
+
+	content, err := os.ReadFile(filepath.Join(uploadFolder, uploadedFile.MetadataFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var metadata UploadMetadata
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := UploadMetadata{
+		OriginalFileName: "hello.txt",
+		MIMEType:         "text/plain; charset=utf-8",
+		BytesWritten:     12,
+		Checksum:         uploadedFile.Checksum,
+		UploadedAt:       metadata.UploadedAt,
+	}
+	if metadata != expected {
+		t.Errorf("expected metadata %+v, but got %+v", expected, metadata)
+	}
+
+	if metadata.UploadedAt.Before(before.Add(-time.Second)) || metadata.UploadedAt.After(time.Now().Add(time.Second)) {
+		t.Errorf("wrong upload time: %v", metadata.UploadedAt)
+	}
+
+	for _, key := range []string{"OriginalFileName", "MIMEType", "BytesWritten", "Checksum", "UploadedAt"} {
+		if !strings.Contains(string(content), `"`+key+`"`) {
+			t.Errorf("expected the metadata to include %s, but got %s", key, content)
+		}
+	}
+}
+
+func TestTools_UploadFiles_SidecarsNotReplaced(t *testing.T) {
+	pngContent, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reuse := Tools{RejectDuplicates: true, DeduplicateMode: "reuse"}
+	reuseWithThumbnails := Tools{RejectDuplicates: true, DeduplicateMode: "reuse", GenerateThumbnails: true}
+	reuseWithMetadata := Tools{RejectDuplicates: true, DeduplicateMode: "reuse", SaveUploadMetadata: true}
+
+	var sidecarTests = []struct {
+		name              string
+		tools             Tools
+		existing          string
+		existingBody      []byte
+		existingOriginal  string
+		errorExpected     bool
+		duplicateExpected bool
+	}{
+		{name: "metadata", tools: Tools{SaveUploadMetadata: true}, existing: "img.png.meta.json", existingBody: []byte("{}"), errorExpected: true},
+		{name: "thumbnail", tools: Tools{GenerateThumbnails: true}, existing: "img_thumb.png", existingBody: []byte("mine"), errorExpected: true},
+		{name: "metadata of a file checked for duplicates", tools: Tools{SaveUploadMetadata: true, RejectDuplicates: true}, existing: "img.png.meta.json", existingBody: []byte("{}"), errorExpected: true},
+		{name: "thumbnail with the same contents", tools: reuseWithThumbnails, existing: "other_thumb.png", existingBody: pngContent, existingOriginal: "other.png", duplicateExpected: false},
+		{name: "metadata with the same contents", tools: reuseWithMetadata, existing: "other.png.meta.json", existingBody: pngContent, existingOriginal: "other.png", duplicateExpected: false},
+		// files which only look like thumbnails or metadata are uploads like any other
+		{name: "thumbnail without thumbnails", tools: reuse, existing: "other_thumb.png", existingBody: pngContent, existingOriginal: "other.png", duplicateExpected: true},
+		{name: "metadata without metadata", tools: reuse, existing: "other.png.meta.json", existingBody: pngContent, existingOriginal: "other.png", duplicateExpected: true},
+		{name: "thumbnail of nothing", tools: reuseWithThumbnails, existing: "other_thumb.png", existingBody: pngContent, duplicateExpected: true},
+		{name: "metadata of nothing", tools: reuseWithMetadata, existing: "other.png.meta.json", existingBody: pngContent, duplicateExpected: true},
+	}
+
+	for _, e := range sidecarTests {
+		uploadDir := t.TempDir()
+		if err := os.WriteFile(filepath.Join(uploadDir, e.existing), e.existingBody, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if e.existingOriginal != "" {
+			if err := os.WriteFile(filepath.Join(uploadDir, e.existingOriginal), []byte("another image"), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		testTools := e.tools
+		req := newMultipartRequest(t, testPart{field: "file", fileName: "img.png", content: pngContent})
+
+		uploadedFiles, err := testTools.UploadFiles(req, uploadDir, false)
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", e.name)
+			}
+			if _, err := os.Stat(filepath.Join(uploadDir, "img.png")); !os.IsNotExist(err) {
+				t.Errorf("%s: expected the upload to be removed, but got %v", e.name, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		} else if uploadedFiles[0].Duplicate != e.duplicateExpected {
+			t.Errorf("%s: expected Duplicate to be %v, but got %v, with %s", e.name, e.duplicateExpected, uploadedFiles[0].Duplicate, uploadedFiles[0].NewFileName)
+		}
+
+		content, _ := os.ReadFile(filepath.Join(uploadDir, e.existing))
+		if !bytes.Equal(content, e.existingBody) {
+			t.Errorf("%s: the existing file %s was replaced", e.name, e.existing)
+		}
+	}
+}
+
+func TestTools_UploadFilesTo(t *testing.T) {
+	target := &memoryTarget{}
+
+	req := newMultipartRequest(t,
+		testPart{field: "file", fileName: "one.txt", content: []byte("one")},
+		testPart{field: "file", fileName: "two.txt", content: []byte("two")},
+	)
+
+	var testTools Tools
+
+	uploadedFiles, err := testTools.UploadFilesTo(req, target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploadedFiles) != 2 {
+		t.Fatalf("expected 2 uploaded files, but got %d", len(uploadedFiles))
+	}
+
+	for _, f := range uploadedFiles {
+		if _, ok := target.files[f.NewFileName]; !ok {
+			t.Errorf("%s was not saved to the target", f.NewFileName)
+		}
+	}
+
+	if string(target.files["two.txt"]) != "two" {
+		t.Errorf("wrong content saved; expected two, but got %s", target.files["two.txt"])
+	}
+
+	// failed uploads are removed from the target
+	testTools.MaxUploadCount = 1
+
+	req = newMultipartRequest(t,
+		testPart{field: "file", fileName: "three.txt", content: []byte("three")},
+		testPart{field: "file", fileName: "four.txt", content: []byte("four")},
+	)
+
+	_, err = testTools.UploadFilesTo(req, target, false)
+	if err == nil {
+		t.Error("expected an error when too many files are uploaded, but none received")
+	}
+
+	if _, ok := target.files["three.txt"]; ok {
+		t.Error("expected three.txt to have been removed from the target")
+	}
+}
+
+func TestTools_UploadFiles_ChecksumStreamed(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	content := bytes.Repeat([]byte("0123456789abcdef"), 256*1024)
+	expected := sha256.Sum256(content)
+
+	// stream the request body through a pipe, so it is never held in memory in full
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		defer pw.Close()
+		defer writer.Close()
+
+		part, err := writer.CreateFormFile("file", "big.bin")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		_, _ = part.Write(content)
+	}()
+
+	req := httptest.NewRequest("POST", "/", pr)
+	req.Header.Add("Content-Type", writer.FormDataContentType())
+
+	var testTools Tools
+
+	uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeUploadedFiles(DiskTarget{Dir: uploadFolder}, uploadedFiles)
+
+	if uploadedFiles[0].Checksum != hex.EncodeToString(expected[:]) {
+		t.Errorf("wrong checksum; expected %x, but got %s", expected, uploadedFiles[0].Checksum)
+	}
+}
+
+func TestTools_UploadFiles_Progress(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	content := bytes.Repeat([]byte("x"), 3*1024*1024+100)
+
+	type progress struct {
+		fileName       string
+		written, total int64
+	}
+	var calls []progress
+
+	testTools := Tools{
+		UploadProgressInterval: 1024 * 1024,
+		OnUploadProgress: func(fileName string, written, total int64) {
+			calls = append(calls, progress{fileName: fileName, written: written, total: total})
+		},
+	}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "big.bin", content: content})
+
+	uploadedFiles, err := testTools.UploadFiles(req, uploadFolder, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removeUploadedFiles(DiskTarget{Dir: uploadFolder}, uploadedFiles)
+
+	// at least one call for each whole megabyte, the last of them at completion
+	if len(calls) < 3 {
+		t.Fatalf("expected at least 3 progress calls, but got %d: %v", len(calls), calls)
+	}
+
+	for i, c := range calls {
+		if c.fileName != "big.bin" || c.total != -1 {
+			t.Errorf("wrong progress call %v", c)
+		}
+
+		if i > 0 && c.written < calls[i-1].written {
+			t.Errorf("progress went backwards: %v", calls)
+		}
+	}
+
+	if last := calls[len(calls)-1]; last.written != int64(len(content)) {
+		t.Errorf("expected the last call to report %d bytes, but got %d", len(content), last.written)
+	}
+}
+
+func TestTools_UploadFiles_ProgressPanic(t *testing.T) {
+	var uploadFolder = filepath.Join("testdata", "uploads")
+
+	testTools := Tools{
+		OnUploadProgress: func(fileName string, written, total int64) {
+			panic("oops")
+		},
+	}
+
+	req := newMultipartRequest(t, testPart{field: "file", fileName: "panic.txt", content: []byte("hello, world")})
+
+	_, err := testTools.UploadFiles(req, uploadFolder, false)
+	if err == nil {
+		t.Error("expected an error when the progress callback panics, but none received")
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadFolder, "panic.txt")); !os.IsNotExist(err) {
+		t.Error("expected panic.txt to have been removed")
+		_ = os.Remove(filepath.Join(uploadFolder, "panic.txt"))
+	}
+}
+
+func TestTools_extensionAllowed(t *testing.T) {
+	testTools := Tools{AllowedFileExtensions: []string{".csv", "JPG"}}
+
+	tests := []struct {
+		fileName string
+		expected bool
+	}{
+		{fileName: "data.csv", expected: true},
+		{fileName: "DATA.CSV", expected: true},
+		{fileName: "photo.jpg", expected: true},
+		{fileName: "photo.jpeg", expected: false},
+		{fileName: "noextension", expected: false},
+	}
+
+	for _, e := range tests {
+		if got := testTools.extensionAllowed(e.fileName); got != e.expected {
+			t.Errorf("%s: expected %v, but got %v", e.fileName, e.expected, got)
+		}
+	}
+}
+
+func TestTools_CreateDirIfNotExist(t *testing.T) {
+	var testTools Tools
+
+	err := testTools.CreateDirIfNotExist("./testdata/myDir")
+	if err != nil {
+		t.Error(err)
+	}
+
+	err = testTools.CreateDirIfNotExist("./testdata/myDir")
+	if err != nil {
+		t.Error(err)
+	}
+
+	_ = os.Remove("./testdata/myDir")
+}
+
+func TestTools_CreateDirIfNotExistMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("directory permissions are not supported on windows")
+	}
+
+	var testTools Tools
+	dir := filepath.Join("testdata", "modeDir", "private")
+	defer os.RemoveAll(filepath.Join("testdata", "modeDir"))
+
+	err := testTools.CreateDirIfNotExist(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the parents created are given the mode too
+	for _, d := range []string{dir, filepath.Dir(dir)} {
+		info, err := os.Stat(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0700 {
+			t.Errorf("expected the mode of %s to be 0700, but got %v", d, info.Mode().Perm())
+		}
+	}
+
+	// the permissions of an existing directory are left alone
+	err = testTools.CreateDirIfNotExist(dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0700 {
+		t.Errorf("expected the directory mode to remain 0700, but got %v", info.Mode().Perm())
+	}
+
+	// without a mode, the umask is respected, as it is by os.Mkdir
+	probe := filepath.Join("testdata", "modeDir", "probe")
+	if err := os.Mkdir(probe, 0777); err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(probe)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := 0755 & info.Mode().Perm()
+
+	dir = filepath.Join("testdata", "modeDir", "default", "sub")
+	if err := testTools.CreateDirIfNotExist(dir); err != nil {
+		t.Fatal(err)
+	}
+	info, err = os.Stat(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != expected {
+		t.Errorf("expected the directory mode to be %v, but got %v", expected, info.Mode().Perm())
+	}
+}
+
+func TestTools_RemoveDirIfExists(t *testing.T) {
+	var testTools Tools
+	dir := filepath.Join("testdata", "removeDir")
+
+	if err := os.MkdirAll(filepath.Join(dir, "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "sub", "file.txt"), []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := testTools.RemoveDirIfExists(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Error("expected the directory to be removed, but it was not")
+	}
+
+	// a directory which is already absent is not an error
+	if err := testTools.RemoveDirIfExists(dir); err != nil {
+		t.Errorf("unexpected error removing a missing directory: %s", err)
+	}
+
+	// a file is not removed
+	file := filepath.Join("testdata", "removeDir.txt")
+	if err := os.WriteFile(file, []byte("hello"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file)
+
+	if err := testTools.RemoveDirIfExists(file); err == nil {
+		t.Error("expected an error removing a file, but none received")
+	}
+}
+
+func TestTools_RemoveDirIfExistsGuards(t *testing.T) {
+	var testTools Tools
+
+	for _, path := range []string{"", ".", "./", "/", "//", "testdata/.."} {
+		if err := testTools.RemoveDirIfExists(path); err == nil {
+			t.Errorf("expected an error removing %q, but none received", path)
+		}
+	}
+
+	if _, err := os.Stat("testdata"); err != nil {
+		t.Errorf("expected the current directory to be untouched: %s", err)
+	}
+}
+
+var slugTests = []struct {
+	name          string
+	s             string
+	expected      string
+	errorExpected bool
+}{
+	{name: "valid string", s: " now is the time ", expected: "now-is-the-time", errorExpected: false},
+	{name: "empty string", s: "", expected: "", errorExpected: true},
+	{name: "complex string", s: "Now is the TIME! + fish & such &^123", expected: "now-is-the-time-fish-such-123", errorExpected: false},
+	{name: "japanese string", s: "こんにちは", expected: "", errorExpected: true},
+	{name: "japanese string and roman characters", s: "hello world こんにちは", expected: "hello-world", errorExpected: false},
+}
+
+func TestTools_Slugify(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range slugTests {
+		slug, err := testTools.Slugify(e.s)
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: error received when none expected: %s", e.name, err.Error())
+		}
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: no error received when an error expected", e.name)
+		}
+
+		if !e.errorExpected && slug != e.expected {
+			t.Errorf("%s: wrong slug returned; expected %s, but got %s", e.name, e.expected, slug)
+		}
+	}
+}
+
+var slugSeparatorTests = []struct {
+	name      string
+	separator string
+	s         string
+	expected  string
+}{
+	{name: "default", separator: "", s: "hello world", expected: "hello-world"},
+	{name: "underscore", separator: "_", s: "hello world", expected: "hello_world"},
+	{name: "underscore complex string", separator: "_", s: "Now is the TIME! + fish & such &^123", expected: "now_is_the_time_fish_such_123"},
+	{name: "underscore runs", separator: "_", s: "__now__is__the__time__", expected: "now_is_the_time"},
+	{name: "dot", separator: ".", s: " now is the time ", expected: "now.is.the.time"},
+	{name: "dot complex string", separator: ".", s: "Now is the TIME! + fish & such &^123", expected: "now.is.the.time.fish.such.123"},
+	{name: "dot runs", separator: ".", s: "...now...is. .the.time...", expected: "now.is.the.time"},
+}
+
+func TestTools_Slugify_Separator(t *testing.T) {
+	for _, e := range slugSeparatorTests {
+		testTools := Tools{SlugSeparator: e.separator}
+
+		slug, err := testTools.Slugify(e.s)
+		if err != nil {
+			t.Errorf("%s: error received when none expected: %s", e.name, err.Error())
+		}
+
+		if slug != e.expected {
+			t.Errorf("%s: wrong slug returned; expected %s, but got %s", e.name, e.expected, slug)
+		}
+	}
+}
+
+var slugLengthTests = []struct {
+	name          string
+	maxLength     int
+	s             string
+	expected      string
+	errorExpected bool
+}{
+	{name: "no limit", maxLength: 0, s: "now is the time", expected: "now-is-the-time", errorExpected: false},
+	{name: "under limit", maxLength: 20, s: "now is the time", expected: "now-is-the-time", errorExpected: false},
+	{name: "exact limit", maxLength: 15, s: "now is the time", expected: "now-is-the-time", errorExpected: false},
+	{name: "word boundary", maxLength: 10, s: "now is the time", expected: "now-is-the", errorExpected: false},
+	{name: "mid word", maxLength: 12, s: "now is the time", expected: "now-is-the", errorExpected: false},
+	{name: "first word only", maxLength: 3, s: "now is the time", expected: "now", errorExpected: false},
+	{name: "first word too long", maxLength: 5, s: "extraordinary times", expected: "", errorExpected: true},
+}
+
+func TestTools_Slugify_MaxLengthBoundary(t *testing.T) {
+	s := "Now is the TIME! + fish & such &^123 Héllo Wörld"
+
+	for _, separator := range []string{"", "_", ".", "--"} {
+		for max := 3; max <= 60; max++ {
+			testTools := Tools{SlugSeparator: separator, MaxSlugLength: max, TransliterateUnicode: true}
+
+			slug, err := testTools.Slugify(s)
+			if err != nil {
+				t.Errorf("max %d: error received when none expected: %s", max, err.Error())
+				continue
+			}
+
+			if len(slug) > max {
+				t.Errorf("max %d: slug %s is too long", max, slug)
+			}
+
+			sep := separator
+			if sep == "" {
+				sep = "-"
+			}
+
+			if strings.HasSuffix(slug, sep) || strings.HasPrefix(slug, sep) {
+				t.Errorf("max %d: slug %s begins or ends with a separator", max, slug)
+			}
+
+			if !utf8.ValidString(slug) {
+				t.Errorf("max %d: slug %q is not valid UTF-8", max, slug)
+			}
+		}
+	}
+}
+
+func TestTools_Slugify_MaxLength(t *testing.T) {
+	for _, e := range slugLengthTests {
+		testTools := Tools{MaxSlugLength: e.maxLength}
+
+		slug, err := testTools.Slugify(e.s)
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: error received when none expected: %s", e.name, err.Error())
+		}
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: no error received when an error expected", e.name)
+		}
+
+		if !e.errorExpected && slug != e.expected {
+			t.Errorf("%s: wrong slug returned; expected %s, but got %s", e.name, e.expected, slug)
+		}
+	}
+}
+
+var transliterationTests = []struct {
+	name          string
+	table         map[rune]string
+	s             string
+	expected      string
+	errorExpected bool
+}{
+	{name: "accented latin", s: "Héllo Wörld", expected: "hello-world", errorExpected: false},
+	{name: "upper case accents", s: "ÉCOLE ÀÇÃO", expected: "ecole-acao", errorExpected: false},
+	{name: "german", s: "Straße", expected: "strasse", errorExpected: false},
+	{name: "full width", s: "ＴＯＫＹＯ　２０２０", expected: "tokyo-2020", errorExpected: false},
+	{name: "custom table", table: map[rune]string{'こ': "ko", 'ん': "n", 'に': "ni", 'ち': "chi", 'は': "ha"}, s: "こんにちは", expected: "konnichiha", errorExpected: false},
+	{name: "custom table overrides", table: map[rune]string{'ö': "oe"}, s: "Wörld", expected: "woerld", errorExpected: false},
+	{name: "hiragana", s: "こんにちは", expected: "konnichiha", errorExpected: false},
+	{name: "katakana loanword", s: "コーヒー", expected: "kohi", errorExpected: false},
+	{name: "loanwords", s: "ラーメン・チョコレート", expected: "ramen-chokoreto", errorExpected: false},
+	{name: "small ya, yu and yo", s: "きょうと しゃしん じゅうしょ", expected: "kyouto-shashin-juusho", errorExpected: false},
+	{name: "small tsu", s: "ほっかいどう マッチャ", expected: "hokkaidou-matcha", errorExpected: false},
+	{name: "small vowels", s: "パーティー フォーク ウィキペディア", expected: "pati-foku-wikipedia", errorExpected: false},
+	{name: "kana and latin", s: "Café カフェ", expected: "cafe-kafe", errorExpected: false},
+	{name: "kanji from the table", table: map[rune]string{'東': "tou", '京': "kyou"}, s: "東京タワー", expected: "toukyoutawa", errorExpected: false},
+	{name: "kanji", s: "東京", expected: "", errorExpected: true},
+	{name: "french", s: "Crème Brûlée", expected: "creme-brulee", errorExpected: false},
+	{name: "spanish", s: "¡Mañana, señor!", expected: "manana-senor", errorExpected: false},
+	{name: "only accented latin", s: "Éàü", expected: "eau", errorExpected: false},
+	{name: "latin extended-a", s: "Łódź Ĳssel Œuvre", expected: "lodz-ijssel-oeuvre", errorExpected: false},
+}
+
+func TestTools_Slugify_TransliterateLatin(t *testing.T) {
+	testTools := Tools{TransliterateUnicode: true}
+
+	// every letter in the Latin-1 Supplement and Latin Extended-A blocks becomes ASCII
+	for r := rune(0xc0); r <= 0x17f; r++ {
+		if r == 0xd7 || r == 0xf7 {
+			continue
+		}
+
+		slug, err := testTools.Slugify(string(r))
+		if err != nil {
+			t.Errorf("%c (%U): error received when none expected: %s", r, r, err.Error())
+			continue
+		}
+
+		for _, c := range slug {
+			if c > unicode.MaxASCII {
+				t.Errorf("%c (%U): slug %s is not ASCII", r, r, slug)
+			}
+		}
+	}
+
+	// without transliteration, accented latin is still removed
+	testTools.TransliterateUnicode = false
+
+	if _, err := testTools.Slugify("Éàü"); err == nil {
+		t.Error("no error received when an error expected")
+	}
+}
+
+func TestTools_Slugify_Transliterate(t *testing.T) {
+	for _, e := range transliterationTests {
+		testTools := Tools{TransliterateUnicode: true, TransliterationTable: e.table}
+
+		slug, err := testTools.Slugify(e.s)
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: error received when none expected: %s", e.name, err.Error())
+		}
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: no error received when an error expected", e.name)
+		}
+
+		if !e.errorExpected && slug != e.expected {
+			t.Errorf("%s: wrong slug returned; expected %s, but got %s", e.name, e.expected, slug)
+		}
+	}
+}
+
+var stopWordTests = []struct {
+	name          string
+	stopWords     []string
+	s             string
+	expected      string
+	errorExpected bool
+}{
+	{name: "no stop words", stopWords: nil, s: "The quick and the brown fox", expected: "the-quick-and-the-brown-fox", errorExpected: false},
+	{name: "stop words", stopWords: []string{"the", "a", "and"}, s: "The quick and the brown fox", expected: "quick-brown-fox", errorExpected: false},
+	{name: "upper case stop words", stopWords: []string{"THE", "A", "AND"}, s: "A fox and a hound", expected: "fox-hound", errorExpected: false},
+	{name: "only part of a word", stopWords: []string{"the"}, s: "there and then", expected: "there-and-then", errorExpected: false},
+	{name: "only stop words", stopWords: []string{"the", "a", "and"}, s: "The and a", expected: "", errorExpected: true},
+}
+
+func TestTools_Slugify_StopWords(t *testing.T) {
+	for _, e := range stopWordTests {
+		testTools := Tools{SlugStopWords: e.stopWords}
+
+		slug, err := testTools.Slugify(e.s)
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: error received when none expected: %s", e.name, err.Error())
+		}
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: no error received when an error expected", e.name)
+		}
+
+		if !e.errorExpected && slug != e.expected {
+			t.Errorf("%s: wrong slug returned; expected %s, but got %s", e.name, e.expected, slug)
+		}
+	}
+}
+
+func TestTools_SlugifyUnique(t *testing.T) {
+	var testTools Tools
+
+	taken := map[string]bool{"now-is-the-time": true, "now-is-the-time-2": true}
+	exists := func(slug string) bool {
+		return taken[slug]
+	}
+
+	slug, err := testTools.SlugifyUnique("Now is the time", exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slug != "now-is-the-time-3" {
+		t.Errorf("wrong slug returned; expected now-is-the-time-3, but got %s", slug)
+	}
+
+	slug, err = testTools.SlugifyUnique("Now is the time", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slug != "now-is-the-time" {
+		t.Errorf("wrong slug returned; expected now-is-the-time, but got %s", slug)
+	}
+
+	slug, err = testTools.SlugifyUnique("A new day", exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if slug != "a-new-day" {
+		t.Errorf("wrong slug returned; expected a-new-day, but got %s", slug)
+	}
+
+	if _, err := testTools.SlugifyUnique("", exists); err == nil {
+		t.Error("no error received when an error expected")
+	}
+}
+
+var slugUniqueLengthTests = []struct {
+	name          string
+	maxLength     int
+	s             string
+	taken         []string
+	expected      string
+	errorExpected bool
+}{
+	{name: "room for the suffix", maxLength: 20, s: "now is the time", taken: []string{"now-is-the-time"}, expected: "now-is-the-time-2"},
+	{name: "word dropped", maxLength: 15, s: "now is the time", taken: []string{"now-is-the-time"}, expected: "now-is-the-2"},
+	{name: "truncated slug", maxLength: 12, s: "now is the time", taken: []string{"now-is-the", "now-is-the-2"}, expected: "now-is-the-3"},
+	{name: "longer suffix", maxLength: 12, s: "now is the time", taken: []string{"now-is-the", "now-is-the-2", "now-is-the-3", "now-is-the-4", "now-is-the-5", "now-is-the-6", "now-is-the-7", "now-is-the-8", "now-is-the-9"}, expected: "now-is-10"},
+	{name: "word cut", maxLength: 8, s: "extraord", taken: []string{"extraord"}, expected: "extrao-2"},
+	{name: "no room", maxLength: 2, s: "ab", taken: []string{"ab"}, errorExpected: true},
+}
+
+func TestTools_SlugifyUnique_MaxSlugLength(t *testing.T) {
+	for _, e := range slugUniqueLengthTests {
+		testTools := Tools{MaxSlugLength: e.maxLength}
+
+		taken := make(map[string]bool)
+		for _, slug := range e.taken {
+			taken[slug] = true
+		}
+
+		slug, err := testTools.SlugifyUnique(e.s, func(slug string) bool { return taken[slug] })
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: no error received when an error expected", e.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error received when none expected: %s", e.name, err.Error())
+			continue
+		}
+
+		if slug != e.expected || len(slug) > e.maxLength {
+			t.Errorf("%s: wrong slug returned; expected %s, but got %s", e.name, e.expected, slug)
+		}
+	}
+}
+
+func TestTools_DownloadStaticFile(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+
+	var testTools Tools
+
+	testTools.DownloadStaticFile(rr, req, "./testdata/pic.jpg", "puppy.jpg")
+
+	res := rr.Result()
+	res.Body.Close()
+
+	if res.Header["Content-Length"][0] != "98827" {
+		t.Error("wrong content length of ", res.Header["Content-Length"][0])
+	}
+
+	if res.Header["Content-Disposition"][0] != "attachment; filename=\"puppy.jpg\"" {
+		t.Error("wrong content disposition of ", res.Header["Content-Disposition"][0])
+	}
+
+	_, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+var rangeTests = []struct {
+	name         string
+	rangeHeader  string
+	status       int
+	contentRange string
+	length       int
+	offset       int
+}{
+	{name: "no range", rangeHeader: "", status: http.StatusOK, length: 98827},
+	{name: "first bytes", rangeHeader: "bytes=0-9", status: http.StatusPartialContent, contentRange: "bytes 0-9/98827", length: 10, offset: 0},
+	{name: "middle", rangeHeader: "bytes=1000-1999", status: http.StatusPartialContent, contentRange: "bytes 1000-1999/98827", length: 1000, offset: 1000},
+	{name: "open ended", rangeHeader: "bytes=98800-", status: http.StatusPartialContent, contentRange: "bytes 98800-98826/98827", length: 27, offset: 98800},
+	{name: "suffix", rangeHeader: "bytes=-100", status: http.StatusPartialContent, contentRange: "bytes 98727-98826/98827", length: 100, offset: 98727},
+	{name: "unsatisfiable", rangeHeader: "bytes=100000-", status: http.StatusRequestedRangeNotSatisfiable, contentRange: "bytes */98827"},
+}
+
+func TestTools_DownloadStaticFileRange(t *testing.T) {
+	content, err := os.ReadFile("./testdata/pic.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range rangeTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if e.rangeHeader != "" {
+			req.Header.Set("Range", e.rangeHeader)
+		}
+		rr := httptest.NewRecorder()
+
+		var testTools Tools
+		testTools.DownloadStaticFile(rr, req, "./testdata/pic.jpg", "puppy.jpg")
+
+		res := rr.Result()
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+
+		if res.StatusCode != e.status {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.status, res.StatusCode)
+		}
+
+		if res.Header.Get("Content-Range") != e.contentRange {
+			t.Errorf("%s: expected content range %q, but got %q", e.name, e.contentRange, res.Header.Get("Content-Range"))
+		}
+
+		if e.status == http.StatusRequestedRangeNotSatisfiable {
+			continue
+		}
+
+		if res.Header.Get("Accept-Ranges") != "bytes" {
+			t.Errorf("%s: expected ranges to be accepted, but got %q", e.name, res.Header.Get("Accept-Ranges"))
+		}
+
+		if !bytes.Equal(body, content[e.offset:e.offset+e.length]) {
+			t.Errorf("%s: wrong content; expected %d bytes from %d, but got %d bytes", e.name, e.length, e.offset, len(body))
+		}
+	}
+}
+
+func TestTools_DownloadStaticFileConditional(t *testing.T) {
+	info, err := os.Stat("./testdata/pic.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rr := httptest.NewRecorder()
+
+	var testTools Tools
+	testTools.DownloadStaticFile(rr, req, "./testdata/pic.jpg", "puppy.jpg")
+
+	etag := rr.Result().Header.Get("ETag")
+	if etag == "" || !strings.HasPrefix(etag, `"`) {
+		t.Fatalf("expected a quoted ETag, but got %q", etag)
+	}
+
+	var conditionalTests = []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{name: "matching etag", header: "If-None-Match", value: etag, status: http.StatusNotModified},
+		{name: "one of several etags", header: "If-None-Match", value: `"other", ` + etag, status: http.StatusNotModified},
+		{name: "changed etag", header: "If-None-Match", value: `"other"`, status: http.StatusOK},
+		{name: "not modified since", header: "If-Modified-Since", value: info.ModTime().UTC().Add(time.Second).Format(http.TimeFormat), status: http.StatusNotModified},
+		{name: "modified since", header: "If-Modified-Since", value: info.ModTime().UTC().Add(-time.Hour).Format(http.TimeFormat), status: http.StatusOK},
+	}
+
+	for _, e := range conditionalTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set(e.header, e.value)
+		rr := httptest.NewRecorder()
+
+		testTools.DownloadStaticFile(rr, req, "./testdata/pic.jpg", "puppy.jpg")
+
+		res := rr.Result()
+		if res.StatusCode != e.status {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.status, res.StatusCode)
+		}
+		if e.status == http.StatusNotModified && rr.Body.Len() > 0 {
+			t.Errorf("%s: expected no body, but got %d bytes", e.name, rr.Body.Len())
+		}
+	}
+
+	// a missing file has no ETag
+	rr = httptest.NewRecorder()
+	testTools.DownloadStaticFile(rr, httptest.NewRequest("GET", "/", nil), "./testdata/missing.jpg", "missing.jpg")
+	if rr.Result().Header.Get("ETag") != "" {
+		t.Error("expected no ETag for a missing file")
+	}
+}
+
+func TestTools_DownloadStaticFileThrottled(t *testing.T) {
+	content, err := os.ReadFile("./testdata/pic.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 20000 bytes at 80000 bytes a second should take a quarter of a second
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Range", "bytes=0-19999")
+	rr := httptest.NewRecorder()
+
+	testTools := Tools{DownloadBytesPerSecond: 80000}
+
+	start := time.Now()
+	testTools.DownloadStaticFile(rr, req, "./testdata/pic.jpg", "puppy.jpg")
+	elapsed := time.Since(start)
+
+	if elapsed < 200*time.Millisecond {
+		t.Errorf("expected the download to take at least 200ms, but it took %s", elapsed)
+	}
+
+	if !bytes.Equal(rr.Body.Bytes(), content[:20000]) {
+		t.Errorf("wrong content; expected the first 20000 bytes, but got %d bytes", rr.Body.Len())
+	}
+
+	// a cancelled request stops waiting
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	req = httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	rr = httptest.NewRecorder()
+
+	testTools.DownloadBytesPerSecond = 1000
+	start = time.Now()
+	testTools.DownloadStaticFile(rr, req, "./testdata/pic.jpg", "puppy.jpg")
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected a cancelled download to stop, but it took %s", elapsed)
+	}
+}
+
+func TestTools_ServeStaticFile(t *testing.T) {
+	for _, inline := range []bool{true, false} {
+		req := httptest.NewRequest("GET", "/", nil)
+		rr := httptest.NewRecorder()
+
+		var testTools Tools
+
+		testTools.ServeStaticFile(rr, req, "./testdata/pic.jpg", "puppy.jpg", inline)
+
+		res := rr.Result()
+		res.Body.Close()
+
+		if res.Header["Content-Length"][0] != "98827" {
+			t.Error("wrong content length of ", res.Header["Content-Length"][0])
+		}
+
+		expected := "attachment; filename=\"puppy.jpg\""
+		if inline {
+			expected = "inline; filename=\"puppy.jpg\""
+		}
+
+		if res.Header["Content-Disposition"][0] != expected {
+			t.Error("wrong content disposition of ", res.Header["Content-Disposition"][0])
+		}
+	}
+}
+
+func TestTools_ServeInlineFile(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	err := testTools.ServeInlineFile(rr, httptest.NewRequest("GET", "/", nil), "./testdata/pic.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := rr.Result()
+	res.Body.Close()
+
+	if res.Header.Get("Content-Disposition") != "inline; filename=\"pic.jpg\"" {
+		t.Error("wrong content disposition of ", res.Header.Get("Content-Disposition"))
+	}
+
+	if res.Header.Get("Content-Type") != "image/jpeg" {
+		t.Error("wrong content type of ", res.Header.Get("Content-Type"))
+	}
+
+	// nothing is written for a file which can't be served
+	for _, path := range []string{"./testdata/missing.jpg", "./testdata"} {
+		rr := httptest.NewRecorder()
+		if err := testTools.ServeInlineFile(rr, httptest.NewRequest("GET", "/", nil), path); err == nil {
+			t.Errorf("expected an error serving %s, but none received", path)
+		}
+		if rr.Body.Len() > 0 || len(rr.Header()) > 0 {
+			t.Errorf("expected no response for %s", path)
+		}
+	}
+}
+
+func TestTools_ServeStaticFileCSP(t *testing.T) {
+	testTools := Tools{DownloadCSPHeader: "default-src 'none'", InlineCSPHeader: "script-src 'none'"}
+
+	var cspTests = []struct {
+		name     string
+		tools    Tools
+		serve    func(tools *Tools, w http.ResponseWriter, r *http.Request)
+		expected string
+	}{
+		{name: "download", tools: testTools, serve: func(tools *Tools, w http.ResponseWriter, r *http.Request) {
+			tools.DownloadStaticFile(w, r, "./testdata/pic.jpg", "puppy.jpg")
+		}, expected: "default-src 'none'"},
+		{name: "inline", tools: testTools, serve: func(tools *Tools, w http.ResponseWriter, r *http.Request) {
+			_ = tools.ServeInlineFile(w, r, "./testdata/pic.jpg")
+		}, expected: "script-src 'none'"},
+		{name: "not set", tools: Tools{}, serve: func(tools *Tools, w http.ResponseWriter, r *http.Request) {
+			tools.DownloadStaticFile(w, r, "./testdata/pic.jpg", "puppy.jpg")
+		}, expected: ""},
+	}
+
+	for _, e := range cspTests {
+		rr := httptest.NewRecorder()
+		e.serve(&e.tools, rr, httptest.NewRequest("GET", "/", nil))
+
+		if csp := rr.Header().Get("Content-Security-Policy"); csp != e.expected {
+			t.Errorf("%s: expected content security policy %q, but got %q", e.name, e.expected, csp)
+		}
+	}
+}
+
+var jsonTests = []struct {
+	name          string
+	json          string
+	errorExpected bool
+	maxSize       int
+	allowUnknown  bool
+}{
+	{name: "good json", json: `{"foo": "bar"}`, errorExpected: false, maxSize: 1024, allowUnknown: false},
+	{name: "badly formatted json", json: `{"foo":}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "incorrect type", json: `{"foo": 1}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "two json files", json: `{"foo": "1"}{"foo": "2"}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "empty body", json: ``, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "syntax error in json", json: `{"foo": 1"`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "unknown field in json", json: `{"fooo": "1"}`, errorExpected: true, maxSize: 1024, allowUnknown: false},
+	{name: "allow unknown field in json", json: `{"fooo": "1"}`, errorExpected: false, maxSize: 1024, allowUnknown: true},
+	{name: "missing field name", json: `{jack: "1"}`, errorExpected: true, maxSize: 1024, allowUnknown: true},
+	{name: "file too large", json: `{"foo": "bar"}`, errorExpected: true, maxSize: 5, allowUnknown: true},
+	{name: "not json", json: `Hello, world!`, errorExpected: true, maxSize: 1024, allowUnknown: true},
+}
+
+func TestTools_ReadJSON(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range jsonTests {
+		// set the max json size
+		testTools.MaxJSONSize = e.maxSize
+
+		// allow/disallow unknown fields
+		testTools.AllowUnknownFields = e.allowUnknown
+
+		// declare a variable to read the decoded json into
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		// create a request with the body
+		req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(e.json)))
+
+		// create a recorder
+		rr := httptest.NewRecorder()
+
+		err := testTools.ReadJSON(rr, req, &decodedJSON)
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: error not expected, but one received: %s", e.name, err.Error())
+		}
+
+		req.Body.Close()
+	}
+}
+
+func TestTools_ReadJSON_Errors(t *testing.T) {
+	var errorTests = []struct {
+		name    string
+		json    string
+		maxSize int
+		err     error
+	}{
+		{name: "too large", json: `{"foo": "bar"}`, maxSize: 5, err: ErrBodyTooLarge},
+		{name: "unknown field", json: `{"fooo": "bar"}`, err: ErrUnknownField},
+		{name: "two json values", json: `{"foo": "bar"}{"foo": "baz"}`, err: ErrMultipleJSON},
+		{name: "empty body", json: ``, err: ErrEmptyBody},
+		{name: "array", json: `[{"foo": "bar"}]`, err: ErrUnexpectedArray},
+	}
+
+	for _, e := range errorTests {
+		testTools := Tools{MaxJSONSize: e.maxSize}
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(e.json))
+		rr := httptest.NewRecorder()
+
+		err := testTools.ReadJSON(rr, req, &decodedJSON)
+		if !errors.Is(err, e.err) {
+			t.Errorf("%s: expected an error wrapping %q, but got %v", e.name, e.err, err)
+		}
+	}
+}
+
+func TestTools_ReadJSON_Array(t *testing.T) {
+	var testTools Tools
+
+	type foo struct {
+		Foo string `json:"foo"`
+	}
+
+	// an array is accepted by a slice
+	var decodedSlice []foo
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`[{"foo": "bar"}, {"foo": "baz"}]`))
+
+	err := testTools.ReadJSON(httptest.NewRecorder(), req, &decodedSlice)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decodedSlice, []foo{{"bar"}, {"baz"}}) {
+		t.Errorf("wrong values decoded: %+v", decodedSlice)
+	}
+
+	// but not by a struct, or a map
+	for _, data := range []interface{}{&foo{}, &map[string]string{}} {
+		req = httptest.NewRequest("POST", "/", strings.NewReader(`[{"foo": "bar"}]`))
+
+		err = testTools.ReadJSON(httptest.NewRecorder(), req, data)
+		if !errors.Is(err, ErrUnexpectedArray) {
+			t.Errorf("%T: expected ErrUnexpectedArray, but got %v", data, err)
+		}
+	}
+
+	// an array in the wrong place inside an object is reported as a field of the wrong type
+	var decodedJSON foo
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": ["bar"]}`))
+
+	err = testTools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON)
+	if err == nil || errors.Is(err, ErrUnexpectedArray) || !strings.Contains(err.Error(), `"foo"`) {
+		t.Errorf("expected an error for the field foo, but got %v", err)
+	}
+}
+
+func TestTools_ReadJSON_ErrorMessages(t *testing.T) {
+	messages := map[string]string{
+		"too_large":       "la requête dépasse {limit} octets",
+		"bad_syntax":      "JSON invalide",
+		"wrong_type":      "type incorrect pour {field}",
+		"unknown_field":   "champ inconnu : {field}",
+		"empty_body":      "corps vide",
+		"multiple_values": "une seule valeur JSON permise",
+	}
+
+	var messageTests = []struct {
+		name     string
+		json     string
+		maxSize  int
+		messages map[string]string
+		expected string
+		err      error
+	}{
+		{name: "too large", json: `{"foo": "bar"}`, maxSize: 5, messages: messages, expected: "la requête dépasse 5 octets", err: ErrBodyTooLarge},
+		{name: "bad syntax", json: `{"foo": "bar",}`, messages: messages, expected: "JSON invalide"},
+		{name: "truncated", json: `{"foo": "bar"`, messages: messages, expected: "JSON invalide"},
+		{name: "wrong type", json: `{"foo": 1}`, messages: messages, expected: "type incorrect pour foo"},
+		{name: "unknown field", json: `{"fooo": "bar"}`, messages: messages, expected: "champ inconnu : fooo", err: ErrUnknownField},
+		{name: "empty body", json: ``, messages: messages, expected: "corps vide", err: ErrEmptyBody},
+		{name: "two json values", json: `{"foo": "bar"} 1`, messages: messages, expected: "une seule valeur JSON permise", err: ErrMultipleJSON},
+		{name: "not replaced", json: `{"fooo": "bar"}`, messages: map[string]string{"empty_body": "corps vide"}, expected: `body contains unknown key "fooo"`, err: ErrUnknownField},
+	}
+
+	for _, e := range messageTests {
+		testTools := Tools{MaxJSONSize: e.maxSize, JSONErrorMessages: e.messages}
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(e.json))
+		err := testTools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON)
+		if err == nil || err.Error() != e.expected {
+			t.Errorf("%s: expected the error %q, but got %v", e.name, e.expected, err)
+		}
+
+		// the error can still be told apart from the others
+		if e.err != nil && !errors.Is(err, e.err) {
+			t.Errorf("%s: expected an error wrapping %q, but got %v", e.name, e.err, err)
+		}
+	}
+}
+
+func TestTools_ReadJSON_TypeError(t *testing.T) {
+	var testTools Tools
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": 1}`))
+	rr := httptest.NewRecorder()
+
+	err := testTools.ReadJSON(rr, req, &decodedJSON)
+	if err == nil {
+		t.Fatal("error expected, but none received")
+	}
+
+	if !strings.Contains(err.Error(), `"foo"`) {
+		t.Errorf("expected the error to name the field, but got: %s", err.Error())
+	}
+
+	if !strings.Contains(err.Error(), "expected string") {
+		t.Errorf("expected the error to name the expected type, but got: %s", err.Error())
+	}
+
+	// syntax errors report where they happened
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": 1"`))
+
+	err = testTools.ReadJSON(rr, req, &decodedJSON)
+	if err == nil || !strings.Contains(err.Error(), "at character 10") {
+		t.Errorf("expected the error to give the offset, but got: %v", err)
+	}
+}
+
+func TestTools_ReadJSONPreserveBody(t *testing.T) {
+	var preserveTests = []struct {
+		name          string
+		json          string
+		tools         Tools
+		errorExpected bool
+	}{
+		{name: "valid", json: `{"foo": "bar"}`},
+		{name: "trailing space", json: "{\"foo\": \"bar\"}\n\n"},
+		{name: "multiple json allowed", json: `{"foo": "bar"}`, tools: Tools{AllowMultipleJSON: true}},
+		{name: "unknown field", json: `{"fooo": "bar", "more": "` + strings.Repeat("x", 10000) + `"}`, errorExpected: true},
+		{name: "too large", json: `{"foo": "` + strings.Repeat("x", 1000) + `"}`, tools: Tools{MaxJSONSize: 100}, errorExpected: true},
+		{name: "two json values", json: `{"foo": "bar"}{"foo": "baz"}`, errorExpected: true},
+	}
+
+	for _, e := range preserveTests {
+		testTools := e.tools
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(e.json))
+		err := testTools.ReadJSONPreserveBody(httptest.NewRecorder(), req, &decodedJSON)
+
+		if e.errorExpected && err == nil {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+		if !e.errorExpected {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", e.name, err)
+			}
+			if decodedJSON.Foo != "bar" {
+				t.Errorf("%s: expected foo to be bar, but got %q", e.name, decodedJSON.Foo)
+			}
+		}
+
+		// the whole body can be read again, whether or not it was accepted
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("%s: unable to read the body again: %s", e.name, err)
+		}
+		if string(body) != e.json {
+			t.Errorf("%s: expected the body to be preserved, but got %d of %d bytes", e.name, len(body), len(e.json))
+		}
+		_ = req.Body.Close()
+	}
+}
+
+func TestTools_ReadJSONWithContext(t *testing.T) {
+	var testTools Tools
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	body := `{"foo": "` + strings.Repeat("x", 100000) + `"}`
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	// cancel the context part of the way through the body
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req.Body = io.NopCloser(&cancelReader{r: req.Body, n: 1000, cancel: cancel})
+
+	err := testTools.ReadJSONWithContext(ctx, rr, req, &decodedJSON)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, but got %v", err)
+	}
+
+	// ReadJSON reads the whole body, whatever the context of the request
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": "bar"}`)).WithContext(ctx)
+
+	err = testTools.ReadJSON(rr, req, &decodedJSON)
+	if err != nil || decodedJSON.Foo != "bar" {
+		t.Errorf("expected ReadJSON to ignore the context of the request, but got %v", err)
+	}
+}
+
+func TestTools_ReadJSONWithContext_SlowClient(t *testing.T) {
+	var slowTests = []struct {
+		name  string
+		write func(w io.Writer, stop <-chan struct{})
+	}{
+		{name: "stalled", write: func(w io.Writer, stop <-chan struct{}) {
+			_, _ = io.WriteString(w, `{"foo": `)
+			<-stop
+		}},
+		{name: "dribbled", write: func(w io.Writer, stop <-chan struct{}) {
+			for {
+				select {
+				case <-stop:
+					return
+				case <-time.After(10 * time.Millisecond):
+					if _, err := io.WriteString(w, " "); err != nil {
+						return
+					}
+				}
+			}
+		}},
+	}
+
+	var testTools Tools
+
+	for _, e := range slowTests {
+		pr, pw := io.Pipe()
+		stop := make(chan struct{})
+		go func() {
+			e.write(pw, stop)
+			_ = pw.Close()
+		}()
+
+		req := httptest.NewRequest("POST", "/", pr)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		start := time.Now()
+		err := testTools.ReadJSONWithContext(ctx, httptest.NewRecorder(), req, &decodedJSON)
+
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s: expected context.DeadlineExceeded, but got %v", e.name, err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("%s: reading took %s, long after the deadline", e.name, elapsed)
+		}
+
+		cancel()
+		close(stop)
+		_ = pr.Close()
+	}
+}
+
+func TestTools_ReadJSON_AllowMultipleJSON(t *testing.T) {
+	testTools := Tools{AllowMultipleJSON: true, MaxJSONSize: 30}
+
+	body := `{"foo": "one"}` + "\n" + `{"foo": "two"}` + "\n" + `{"foo": "three"}` + "\n"
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	var values []string
+	for {
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		err := testTools.ReadJSON(rr, req, &decodedJSON)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error after %d values: %s", len(values), err)
+		}
+
+		values = append(values, decodedJSON.Foo)
+	}
+
+	if !reflect.DeepEqual(values, []string{"one", "two", "three"}) {
+		t.Errorf("expected one, two and three, but got %v", values)
+	}
+
+	// MaxJSONSize limits each value
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"foo": "one"}`+"\n"+`{"foo": "`+strings.Repeat("x", 100)+`"}`))
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+	if err := testTools.ReadJSON(rr, req, &decodedJSON); err != nil {
+		t.Fatalf("unexpected error for the first value: %s", err)
+	}
+	if err := testTools.ReadJSON(rr, req, &decodedJSON); err == nil || !strings.Contains(err.Error(), "larger than 30 bytes") {
+		t.Errorf("expected an error for a value larger than MaxJSONSize, but got %v", err)
+	}
+
+	// MaxJSONStreamSize limits the body as a whole, however small each value is
+	streamTools := Tools{AllowMultipleJSON: true, MaxJSONSize: 30, MaxJSONStreamSize: 40}
+	req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = streamTools.ReadJSON(rr, req, &decodedJSON)
+	}
+	if !errors.Is(err, ErrBodyTooLarge) || !strings.Contains(err.Error(), "larger than 40 bytes") {
+		t.Errorf("expected an error for a body larger than MaxJSONStreamSize, but got %v", err)
+	}
+
+	// without AllowMultipleJSON, the same body is rejected
+	testTools.AllowMultipleJSON = false
+	testTools.MaxJSONSize = 0
+	req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+
+	if err := testTools.ReadJSON(rr, req, &decodedJSON); err == nil {
+		t.Error("expected an error for more than one JSON value, but none received")
+	}
+}
+
+func TestTools_WriteJSON(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	payload := JSONResponse{
+		Error:   false,
+		Message: "foo",
+	}
+
+	headers := make(http.Header)
+	headers.Add("FOO", "BAR")
+
+	err := testTools.WriteJSON(rr, http.StatusOK, payload, headers)
+	if err != nil {
+		t.Errorf("failed to write JSON: %v", err)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status code of 200, but got %d", rr.Code)
+	}
+
+	res := rr.Result()
+	defer res.Body.Close()
+
+	if res.Header["Content-Type"][0] != "application/json" {
+		t.Error("wrong content type of ", res.Header["Content-Type"][0])
+	}
+
+	if res.Header["Foo"][0] != "BAR" {
+		t.Error("wrong header ", res.Header["Foo"][0])
+	}
+
+	var response JSONResponse
+
+	body, _ := io.ReadAll(res.Body)
+	if err := json.Unmarshal(body, &response); err != nil {
+		t.Error("unmarshal error", err)
+	}
+
+	if !reflect.DeepEqual(payload, response) {
+		t.Errorf("expected body %+v, but got %+v", payload, response)
+	}
+}
+
+func TestTools_WriteJSONN(t *testing.T) {
+	payload := JSONResponse{Error: false, Message: "foo"}
+
+	for _, indent := range []bool{false, true} {
+		testTools := Tools{IndentJSON: indent}
+
+		rr := httptest.NewRecorder()
+		n, err := testTools.WriteJSONN(rr, http.StatusOK, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != rr.Body.Len() {
+			t.Errorf("indent %v: expected %d bytes written, but got %d", indent, rr.Body.Len(), n)
+		}
+	}
+
+	// nothing is written if the data can't be marshaled
+	var testTools Tools
+	rr := httptest.NewRecorder()
+
+	n, err := testTools.WriteJSONN(rr, http.StatusOK, make(chan int))
+	if err == nil {
+		t.Error("error expected when marshaling a channel, but none received")
+	}
+	if n != 0 || rr.Body.Len() != 0 {
+		t.Errorf("expected nothing written, but got %d bytes", n)
+	}
+}
+
+var paginatedTests = []struct {
+	name          string
+	items         interface{}
+	page          int
+	pageSize      int
+	total         int
+	totalPages    int
+	errorExpected bool
+}{
+	{name: "no items", items: []string{}, page: 1, pageSize: 10, total: 0, totalPages: 0},
+	{name: "one page", items: []string{"a", "b"}, page: 1, pageSize: 10, total: 2, totalPages: 1},
+	{name: "exact pages", items: []string{"a", "b"}, page: 2, pageSize: 2, total: 6, totalPages: 3},
+	{name: "partial last page", items: []string{"a", "b"}, page: 1, pageSize: 2, total: 7, totalPages: 4},
+	{name: "one item", items: []string{"a"}, page: 1, pageSize: 1, total: 1, totalPages: 1},
+	{name: "zero page size", items: []string{}, page: 1, pageSize: 0, total: 5, errorExpected: true},
+	{name: "negative total", items: []string{}, page: 1, pageSize: 10, total: -1, errorExpected: true},
+}
+
+func TestTools_WritePaginatedJSON(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range paginatedTests {
+		rr := httptest.NewRecorder()
+
+		err := testTools.WritePaginatedJSON(rr, http.StatusOK, e.items, e.page, e.pageSize, e.total)
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+		if err != nil {
+			continue
+		}
+
+		var got struct {
+			Data       []string `json:"data"`
+			Page       int      `json:"page"`
+			PageSize   int      `json:"page_size"`
+			Total      int      `json:"total"`
+			TotalPages int      `json:"total_pages"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: the response is not valid json: %s", e.name, err)
+		}
+
+		if got.TotalPages != e.totalPages {
+			t.Errorf("%s: expected %d pages, but got %d", e.name, e.totalPages, got.TotalPages)
+		}
+		if got.Page != e.page || got.PageSize != e.pageSize || got.Total != e.total {
+			t.Errorf("%s: wrong pagination in %s", e.name, rr.Body.String())
+		}
+		if len(got.Data) != len(e.items.([]string)) {
+			t.Errorf("%s: expected %d items, but got %d", e.name, len(e.items.([]string)), len(got.Data))
+		}
+	}
+}
+
+func TestTools_DownloadJSONFile(t *testing.T) {
+	payload := JSONResponse{Error: false, Message: "foo", Data: map[string]interface{}{"count": 2.0}}
+
+	for _, indent := range []bool{false, true} {
+		testTools := Tools{IndentJSON: indent}
+
+		rr := httptest.NewRecorder()
+		if err := testTools.DownloadJSONFile(rr, "export.json", payload); err != nil {
+			t.Fatal(err)
+		}
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("indent %v: expected status code of 200, but got %d", indent, rr.Code)
+		}
+		if disposition := rr.Header().Get("Content-Disposition"); disposition != `attachment; filename="export.json"` {
+			t.Errorf("indent %v: wrong content disposition %s", indent, disposition)
+		}
+		if rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("indent %v: wrong content type %s", indent, rr.Header().Get("Content-Type"))
+		}
+		if rr.Header().Get("Content-Length") != fmt.Sprint(rr.Body.Len()) {
+			t.Errorf("indent %v: content length %s does not match the %d bytes sent", indent, rr.Header().Get("Content-Length"), rr.Body.Len())
+		}
+		if indent != strings.Contains(rr.Body.String(), "\n  ") {
+			t.Errorf("indent %v: unexpected body %s", indent, rr.Body.String())
+		}
+
+		var response JSONResponse
+		if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(payload, response) {
+			t.Errorf("indent %v: expected body %+v, but got %+v", indent, payload, response)
+		}
+	}
+
+	// nothing is sent if the data can't be encoded
+	var testTools Tools
+	rr := httptest.NewRecorder()
+	if err := testTools.DownloadJSONFile(rr, "export.json", make(chan int)); err == nil || rr.Body.Len() > 0 {
+		t.Errorf("expected an error and nothing sent, but got %v", err)
+	}
+}
+
+func TestTools_ErrorJSON(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	err := testTools.ErrorJSON(rr, errors.New("some error"), http.StatusServiceUnavailable)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var response JSONResponse
+
+	decorder := json.NewDecoder(rr.Body)
+	err = decorder.Decode(&response)
+	if err != nil {
+		t.Error("received error when decoding JSON", err)
+	}
+
+	if !response.Error {
+		t.Error("error set to false in JSON, and it should be true")
+	}
+
+	if response.Message != "some error" {
+		t.Errorf("wrong message received; expected some error, but got %s", response.Message)
+	}
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong status code returned; expected 503, but got %d", rr.Code)
+	}
+
+}
+
+func TestTools_ErrorJSONWithCode(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	err := testTools.ErrorJSONWithCode(rr, errors.New("no such user"), "user_not_found", http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var response JSONResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Error("received error when decoding JSON", err)
+	}
+
+	if !response.Error || response.Message != "no such user" || response.Code != "user_not_found" {
+		t.Errorf("wrong response: %+v", response)
+	}
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code returned; expected 404, but got %d", rr.Code)
+	}
+
+	// the code is left out when it is empty
+	rr = httptest.NewRecorder()
+	_ = testTools.ErrorJSON(rr, errors.New("some error"))
+
+	if strings.Contains(rr.Body.String(), "code") {
+		t.Errorf("expected no code in the response, but got %s", rr.Body.String())
+	}
+}
+
+var compressTests = []struct {
+	name           string
+	compress       bool
+	acceptEncoding string
+	gzipped        bool
+}{
+	{name: "gzip", compress: true, acceptEncoding: "gzip, deflate, br", gzipped: true},
+	{name: "gzip with quality", compress: true, acceptEncoding: "br;q=1.0, gzip;q=0.8", gzipped: true},
+	{name: "gzip refused", compress: true, acceptEncoding: "gzip;q=0, deflate", gzipped: false},
+	{name: "wildcard", compress: true, acceptEncoding: "*", gzipped: true},
+	{name: "wildcard refused", compress: true, acceptEncoding: "*;q=0", gzipped: false},
+	{name: "no accept encoding", compress: true, acceptEncoding: "", gzipped: false},
+	{name: "compression disabled", compress: false, acceptEncoding: "gzip", gzipped: false},
+}
+
+func TestTools_WriteJSONIndent(t *testing.T) {
+	payload := JSONResponse{Error: false, Message: "foo"}
+
+	for _, indent := range []bool{false, true} {
+		testTools := Tools{IndentJSON: indent}
+
+		rr := httptest.NewRecorder()
+		if err := testTools.WriteJSON(rr, http.StatusCreated, payload); err != nil {
+			t.Fatal(err)
+		}
+
+		if rr.Code != http.StatusCreated || rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("indent %v: unexpected status %d or content type %q", indent, rr.Code, rr.Header().Get("Content-Type"))
+		}
+
+		expected := `{"error":false,"message":"foo"}`
+		if indent {
+			expected = "{\n  \"error\": false,\n  \"message\": \"foo\"\n}"
+		}
+		if rr.Body.String() != expected {
+			t.Errorf("indent %v: expected %q, but got %q", indent, expected, rr.Body.String())
+		}
+	}
+}
+
+func TestTools_WriteJSONCompressed(t *testing.T) {
+	payload := JSONResponse{Message: strings.Repeat("a large payload ", 1000)}
+
+	for _, e := range compressTests {
+		testTools := Tools{CompressJSON: e.compress}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		if e.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", e.acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+
+		err := testTools.WriteJSONCompressed(rr, req, http.StatusOK, payload)
+		if err != nil {
+			t.Errorf("%s: failed to write JSON: %s", e.name, err)
+			continue
+		}
+
+		if rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("%s: wrong content type of %s", e.name, rr.Header().Get("Content-Type"))
+		}
+
+		var body io.Reader = rr.Body
+		if e.gzipped {
+			if rr.Header().Get("Content-Encoding") != "gzip" {
+				t.Errorf("%s: expected a Content-Encoding of gzip, but got %q", e.name, rr.Header().Get("Content-Encoding"))
+				continue
+			}
+
+			zr, err := gzip.NewReader(rr.Body)
+			if err != nil {
+				t.Errorf("%s: %s", e.name, err)
+				continue
+			}
+			body = zr
+		} else if rr.Header().Get("Content-Encoding") != "" {
+			t.Errorf("%s: expected no Content-Encoding, but got %q", e.name, rr.Header().Get("Content-Encoding"))
+		}
+
+		// the whole of the json must be there
+		var response JSONResponse
+		if err := json.NewDecoder(body).Decode(&response); err != nil {
+			t.Errorf("%s: unable to decode the response: %s", e.name, err)
+			continue
+		}
+
+		if response.Message != payload.Message {
+			t.Errorf("%s: the response was truncated", e.name)
+		}
+	}
+}
+
+type RoundTripFunc func(req *http.Request) *http.Response
+
+func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req), nil
+}
+
+func NewTestClient(fn RoundTripFunc) *http.Client {
+	return &http.Client{
+		Transport: fn,
+	}
+}
+
+func TestTools_DownloadRemoteFile(t *testing.T) {
+	dstDir := filepath.Join("testdata", "uploads", "remote")
+	defer os.RemoveAll(dstDir)
+
+	pngContent, err := os.ReadFile(filepath.Join("testdata", "img.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		status, body := http.StatusOK, pngContent
+		if req.URL.Path == "/missing.png" {
+			status, body = http.StatusNotFound, []byte("not found")
+		}
+		return &http.Response{
+			StatusCode:    status,
+			Status:        http.StatusText(status),
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Header:        make(http.Header),
+		}
+	})
+
+	var downloadTests = []struct {
+		name          string
+		uri           string
+		tools         Tools
+		expected      string
+		errorExpected bool
+	}{
+		{name: "saved", uri: "https://example.com/images/logo%20big.png?size=2", expected: filepath.Join(dstDir, "logo big.png")},
+		{name: "type permitted", uri: "https://example.com/logo.png", tools: Tools{AllowedFileType: []string{"image/png"}}, expected: filepath.Join(dstDir, "logo.png")},
+		{name: "already exists", uri: "https://example.com/other/logo.png", errorExpected: true},
+		{name: "type not permitted", uri: "https://example.com/logo.png", tools: Tools{AllowedFileType: []string{"image/jpeg"}}, errorExpected: true},
+		{name: "too big", uri: "https://example.com/logo.png", tools: Tools{MaxFileSize: 100}, errorExpected: true},
+		{name: "not found", uri: "https://example.com/missing.png", errorExpected: true},
+		{name: "no file name", uri: "https://example.com/", errorExpected: true},
+	}
+
+	for _, e := range downloadTests {
+		testTools := e.tools
+
+		saved, err := testTools.DownloadRemoteFile(e.uri, dstDir, client)
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", e.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+			continue
+		}
+
+		if saved != e.expected {
+			t.Errorf("%s: expected the file to be saved as %s, but got %s", e.name, e.expected, saved)
+		}
+
+		content, err := os.ReadFile(saved)
+		if err != nil || !bytes.Equal(content, pngContent) {
+			t.Errorf("%s: the saved file does not match the one downloaded: %v", e.name, err)
+		}
+	}
+
+	if defaultDownloadClient.Timeout == 0 {
+		t.Error("the default client has no timeout")
+	}
+}
+
+func TestTools_PushJSONToRemote(t *testing.T) {
 	client := NewTestClient(func(req *http.Request) *http.Response {
 		// Test Request Parameters
 		return &http.Response{
@@ -411,3 +4276,237 @@ func TestTools_PushJSONToRemote(t *testing.T) {
 		t.Error("failed to call remote url:", err)
 	}
 }
+
+// flakyTransport fails with err, or responds with each of statuses in turn, counting the requests
+type flakyTransport struct {
+	statuses []int
+	err      error
+	requests int
+}
+
+func (f *flakyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	f.requests++
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	status := f.statuses[len(f.statuses)-1]
+	if f.requests <= len(f.statuses) {
+		status = f.statuses[f.requests-1]
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Body:       io.NopCloser(strings.NewReader("ok")),
+		Header:     make(http.Header),
+	}, nil
+}
+
+var retryTests = []struct {
+	name             string
+	statuses         []int
+	err              error
+	maxRetries       int
+	expectedStatus   int
+	expectedRequests int
+	errorExpected    bool
+}{
+	{name: "success", statuses: []int{200}, maxRetries: 3, expectedStatus: 200, expectedRequests: 1},
+	{name: "server errors then success", statuses: []int{503, 500, 200}, maxRetries: 3, expectedStatus: 200, expectedRequests: 3},
+	{name: "server errors exhaust retries", statuses: []int{503}, maxRetries: 2, expectedStatus: 503, expectedRequests: 3},
+	{name: "client error is not retried", statuses: []int{404}, maxRetries: 3, expectedStatus: 404, expectedRequests: 1},
+	{name: "network errors are retried", err: errors.New("connection refused"), maxRetries: 2, expectedRequests: 3, errorExpected: true},
+	{name: "no retries", statuses: []int{503}, maxRetries: 0, expectedStatus: 503, expectedRequests: 1},
+}
+
+func TestTools_PushJSONToRemote_Retries(t *testing.T) {
+	for _, e := range retryTests {
+		transport := &flakyTransport{statuses: e.statuses, err: e.err}
+		testTools := Tools{MaxRetries: e.maxRetries, RetryDelay: time.Millisecond}
+
+		_, status, err := testTools.PushJSONToRemote("http://example.com/some/path", map[string]string{"foo": "bar"}, &http.Client{Transport: transport})
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+
+		if status != e.expectedStatus {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.expectedStatus, status)
+		}
+
+		if transport.requests != e.expectedRequests {
+			t.Errorf("%s: expected %d requests, but got %d", e.name, e.expectedRequests, transport.requests)
+		}
+	}
+}
+
+var retryWaitTests = []struct {
+	name     string
+	delay    time.Duration
+	attempt  int
+	expected time.Duration
+}{
+	{name: "first retry", delay: 100 * time.Millisecond, attempt: 0, expected: 100 * time.Millisecond},
+	{name: "doubled", delay: 100 * time.Millisecond, attempt: 3, expected: 800 * time.Millisecond},
+	{name: "capped", delay: 100 * time.Millisecond, attempt: 20, expected: maxRetryWait},
+	{name: "many attempts", delay: 100 * time.Millisecond, attempt: 100, expected: maxRetryWait},
+	{name: "long delay", delay: time.Hour, attempt: 70, expected: time.Hour},
+}
+
+func TestRetryWait(t *testing.T) {
+	for _, e := range retryWaitTests {
+		if wait := retryWait(e.delay, e.attempt); wait != e.expected {
+			t.Errorf("%s: expected to wait %v, but got %v", e.name, e.expected, wait)
+		}
+	}
+}
+
+func TestTools_PushJSONToRemoteContext(t *testing.T) {
+	transport := &flakyTransport{statuses: []int{503}}
+	testTools := Tools{MaxRetries: 10, RetryDelay: time.Hour}
+
+	// cancel the context while waiting to retry
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	_, _, err := testTools.PushJSONToRemoteContext(ctx, "http://example.com/some/path", "foo", &http.Client{Transport: transport})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context.DeadlineExceeded, but got %v", err)
+	}
+
+	if transport.requests != 1 {
+		t.Errorf("expected 1 request, but got %d", transport.requests)
+	}
+}
+
+func TestTools_SendJSONToRemote(t *testing.T) {
+	var sent *http.Request
+	var body []byte
+
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		sent = req
+		body, _ = io.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(strings.NewReader("ok")),
+			Header:     make(http.Header),
+		}
+	})
+
+	var testTools Tools
+
+	headers := make(http.Header)
+	headers.Set("Authorization", "Bearer secret")
+	headers.Set("X-Correlation-ID", "42")
+
+	res, status, err := testTools.SendJSONToRemote(context.Background(), "PATCH", "http://example.com/some/path", map[string]string{"foo": "bar"}, headers, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != http.StatusAccepted || res.StatusCode != http.StatusAccepted {
+		t.Errorf("expected status 202, but got %d", status)
+	}
+
+	if sent.Method != "PATCH" {
+		t.Errorf("expected a PATCH request, but got %s", sent.Method)
+	}
+
+	if sent.Header.Get("Authorization") != "Bearer secret" || sent.Header.Get("X-Correlation-ID") != "42" {
+		t.Errorf("expected the custom headers to be sent, but got %v", sent.Header)
+	}
+
+	if sent.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("expected a content type of application/json, but got %s", sent.Header.Get("Content-Type"))
+	}
+
+	if string(body) != `{"foo":"bar"}` {
+		t.Errorf("wrong body sent: %s", body)
+	}
+
+	// the method defaults to POST, and the content type can be overridden
+	headers = make(http.Header)
+	headers.Set("Content-Type", "application/merge-patch+json")
+
+	_, _, err = testTools.SendJSONToRemote(context.Background(), "", "http://example.com/some/path", "foo", headers, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sent.Method != "POST" {
+		t.Errorf("expected a POST request, but got %s", sent.Method)
+	}
+
+	if sent.Header.Get("Content-Type") != "application/merge-patch+json" {
+		t.Errorf("expected the content type to be overridden, but got %s", sent.Header.Get("Content-Type"))
+	}
+}
+
+func TestTools_PushJSONAndDecode(t *testing.T) {
+	var pushTests = []struct {
+		name          string
+		status        int
+		body          string
+		maxSize       int
+		expected      string
+		errorExpected bool
+	}{
+		{name: "ok", status: http.StatusOK, body: `{"result": "done"}`, expected: "done"},
+		{name: "error status still decoded", status: http.StatusBadRequest, body: `{"result": "bad"}`, expected: "bad"},
+		{name: "empty body", status: http.StatusOK, body: ``, errorExpected: true},
+		{name: "badly formed", status: http.StatusOK, body: `{"result": `, errorExpected: true},
+		{name: "too large", status: http.StatusOK, body: `{"result": "` + strings.Repeat("x", 100) + `"}`, maxSize: 50, errorExpected: true},
+	}
+
+	for _, e := range pushTests {
+		body := &closeRecorder{Reader: strings.NewReader(e.body)}
+		client := NewTestClient(func(req *http.Request) *http.Response {
+			return &http.Response{
+				StatusCode: e.status,
+				Body:       body,
+				Header:     make(http.Header),
+			}
+		})
+
+		testTools := Tools{MaxJSONSize: e.maxSize}
+
+		var response struct {
+			Result string `json:"result"`
+		}
+
+		status, err := testTools.PushJSONAndDecode("http://example.com/rpc", map[string]string{"foo": "bar"}, &response, client)
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: unexpected error: %s", e.name, err)
+		}
+
+		if status != e.status {
+			t.Errorf("%s: expected status %d, but got %d", e.name, e.status, status)
+		}
+
+		if response.Result != e.expected {
+			t.Errorf("%s: expected result %q, but got %q", e.name, e.expected, response.Result)
+		}
+
+		if !body.closed {
+			t.Errorf("%s: the response body was not closed", e.name)
+		}
+	}
+}
+
+// closeRecorder is a response body which records whether it has been closed
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
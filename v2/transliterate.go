@@ -0,0 +1,197 @@
+package toolkit
+
+import (
+	"strings"
+	"unicode"
+)
+
+// transliterations maps lower case groups of characters to the ASCII text which replaces each of
+// them when TransliterateUnicode is set. Every letter in the Latin-1 Supplement and Latin Extended-A
+// blocks is covered
+var transliterations = map[string]string{
+	"àáâãäåāăą":  "a",
+	"æ":          "ae",
+	"çćĉċč":      "c",
+	"ďđð":        "d",
+	"èéêëēĕėęě":  "e",
+	"ĝğġģ":       "g",
+	"ĥħ":         "h",
+	"ìíîïĩīĭįı":  "i",
+	"ĳ":          "ij",
+	"ĵ":          "j",
+	"ķĸ":         "k",
+	"ĺļľŀł":      "l",
+	"ñńņňŉ":      "n",
+	"ŋ":          "ng",
+	"òóôõöøōŏő":  "o",
+	"œ":          "oe",
+	"ŕŗř":        "r",
+	"śŝşšſ":      "s",
+	"ß":          "ss",
+	"ţťŧ":        "t",
+	"þ":          "th",
+	"ùúûüũūŭůűų": "u",
+	"ŵ":          "w",
+	"ýÿŷ":        "y",
+	"źżž":        "z",
+}
+
+// transliterationTable is the built in table used by transliterate, generated from transliterations
+var transliterationTable = func() map[rune]string {
+	table := make(map[rune]string)
+	for chars, ascii := range transliterations {
+		for _, r := range chars {
+			table[r] = ascii
+		}
+	}
+
+	// full width forms of ASCII letters and digits, as commonly found in Japanese text
+	for r := '！'; r <= '～'; r++ {
+		table[r] = string(unicode.ToLower(r - '！' + '!'))
+	}
+	table['　'] = " "
+
+	return table
+}()
+
+// kana maps each hiragana character to its romanization, in modified Hepburn. Katakana are converted
+// through the hiragana with the same sound, so that loanwords such as "コーヒー" become "kohi". The small
+// characters which change the sound of the one before them are handled by appendKana
+var kana = map[rune]string{
+	'あ': "a", 'い': "i", 'う': "u", 'え': "e", 'お': "o",
+	'か': "ka", 'き': "ki", 'く': "ku", 'け': "ke", 'こ': "ko",
+	'が': "ga", 'ぎ': "gi", 'ぐ': "gu", 'げ': "ge", 'ご': "go",
+	'さ': "sa", 'し': "shi", 'す': "su", 'せ': "se", 'そ': "so",
+	'ざ': "za", 'じ': "ji", 'ず': "zu", 'ぜ': "ze", 'ぞ': "zo",
+	'た': "ta", 'ち': "chi", 'つ': "tsu", 'て': "te", 'と': "to",
+	'だ': "da", 'ぢ': "ji", 'づ': "zu", 'で': "de", 'ど': "do",
+	'な': "na", 'に': "ni", 'ぬ': "nu", 'ね': "ne", 'の': "no",
+	'は': "ha", 'ひ': "hi", 'ふ': "fu", 'へ': "he", 'ほ': "ho",
+	'ば': "ba", 'び': "bi", 'ぶ': "bu", 'べ': "be", 'ぼ': "bo",
+	'ぱ': "pa", 'ぴ': "pi", 'ぷ': "pu", 'ぺ': "pe", 'ぽ': "po",
+	'ま': "ma", 'み': "mi", 'む': "mu", 'め': "me", 'も': "mo",
+	'や': "ya", 'ゆ': "yu", 'よ': "yo",
+	'ら': "ra", 'り': "ri", 'る': "ru", 'れ': "re", 'ろ': "ro",
+	'わ': "wa", 'ゐ': "i", 'ゑ': "e", 'を': "o", 'ん': "n",
+	'ゔ': "vu", 'ゎ': "wa", 'ゕ': "ka", 'ゖ': "ke",
+}
+
+// the kana which change the sound of the one before them, or of the one after
+var (
+	smallYa = map[rune]string{'ゃ': "a", 'ゅ': "u", 'ょ': "o"}
+	smallA  = map[rune]string{'ぁ': "a", 'ぃ': "i", 'ぅ': "u", 'ぇ': "e", 'ぉ': "o"}
+)
+
+const (
+	smallTsu = 'っ'
+	longMark = 'ー'
+)
+
+// hiragana returns the hiragana with the same sound as r, if r is a katakana, or else r itself
+func hiragana(r rune) rune {
+	if r >= 'ァ' && r <= 'ヶ' {
+		return r - ('ァ' - 'ぁ')
+	}
+	return r
+}
+
+// isKana reports whether r is a kana which appendKana can romanize
+func isKana(r rune) bool {
+	h := hiragana(r)
+	_, ok := kana[h]
+	_, ya := smallYa[h]
+	_, a := smallA[h]
+	return ok || ya || a || h == smallTsu || r == longMark
+}
+
+// kanaState is what appendKana needs to know about the kana before the one being romanized
+type kanaState struct {
+	syllable int  // the start of the romanization of the last kana syllable, or -1 if there is none
+	double   bool // whether the next syllable follows a small tsu, and so doubles its consonant
+}
+
+// appendKana appends the romanization of the kana r to out. Small ya, yu and yo combine with the
+// syllable before them, as in "kyo" and "sha", and so do the small vowels used in loanwords, as in
+// "fa" and "ti". A small tsu doubles the consonant which follows it, and long vowel marks are dropped
+func appendKana(out []byte, state *kanaState, r rune) []byte {
+	h := hiragana(r)
+	previous := ""
+	if state.syllable >= 0 {
+		previous = string(out[state.syllable:])
+	}
+
+	switch {
+	case r == longMark:
+		return out
+
+	case h == smallTsu:
+		state.double = true
+		return out
+
+	case smallYa[h] != "" && strings.HasSuffix(previous, "i") && len(previous) > 1:
+		// "ki" becomes "kya", but "shi" becomes "sha"
+		out = out[:len(out)-1]
+		if previous != "shi" && previous != "chi" && previous != "ji" {
+			out = append(out, 'y')
+		}
+		return append(out, smallYa[h]...)
+
+	case smallA[h] != "" && previous != "":
+		// "fu" becomes "fa", and "u" becomes "wa"
+		last := previous[len(previous)-1]
+		if strings.IndexByte("aiueo", last) >= 0 {
+			out = out[:len(out)-1]
+			if len(previous) == 1 && last == 'i' {
+				out = append(out, 'y')
+			} else if len(previous) == 1 {
+				out = append(out, 'w')
+			}
+		}
+		return append(out, smallA[h]...)
+	}
+
+	romaji := kana[h]
+	if romaji == "" {
+		// a small character with nothing before it to change
+		romaji = smallYa[h]
+		if romaji != "" {
+			romaji = "y" + romaji
+		} else {
+			romaji = smallA[h]
+		}
+	}
+
+	if state.double && strings.IndexByte("aiueon", romaji[0]) < 0 {
+		if strings.HasPrefix(romaji, "ch") {
+			out = append(out, 't')
+		} else {
+			out = append(out, romaji[0])
+		}
+	}
+	state.double = false
+	state.syllable = len(out)
+	return append(out, romaji...)
+}
+
+// transliterate replaces the characters of s found in TransliterationTable, or in the built in
+// table, with their ASCII equivalents, and romanizes Japanese kana. Other characters, such as kanji,
+// which can't be converted without knowing the word they are part of, are left unchanged
+func (t *Tools) transliterate(s string) string {
+	out := make([]byte, 0, len(s))
+	state := kanaState{syllable: -1}
+
+	for _, r := range s {
+		if ascii, ok := t.TransliterationTable[r]; ok {
+			out = append(out, ascii...)
+		} else if isKana(r) {
+			out = appendKana(out, &state, r)
+			continue
+		} else if ascii, ok := transliterationTable[unicode.ToLower(r)]; ok {
+			out = append(out, ascii...)
+		} else {
+			out = append(out, string(r)...)
+		}
+		state = kanaState{syllable: -1}
+	}
+	return string(out)
+}
@@ -0,0 +1,110 @@
+package toolkit
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// XMLResponse is the type used for sending XML around
+type XMLResponse struct {
+	XMLName xml.Name    `xml:"response"`
+	Error   bool        `xml:"error"`
+	Message string      `xml:"message"`
+	Data    interface{} `xml:"data,omitempty"`
+}
+
+// ReadXML tries to read the body of a request and converts from xml into a go data variable. The body
+// may be no larger than MaxXMLSize bytes, or one meg if that is not set
+func (t *Tools) ReadXML(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	maxBytes := 1024 * 1024 // one meg
+	if t.MaxXMLSize != 0 {
+		maxBytes = t.MaxXMLSize
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	dec := xml.NewDecoder(r.Body)
+
+	err := dec.Decode(data)
+	if err != nil {
+		var syntaxError *xml.SyntaxError
+
+		switch {
+		case errors.As(err, &syntaxError):
+			return fmt.Errorf("body contains badly-formed XML (at line %d)", syntaxError.Line)
+
+		case errors.Is(err, io.EOF):
+			return ErrEmptyBody
+
+		case err.Error() == "http: request body too large":
+			return fmt.Errorf("%w; it must not be larger than %d bytes", ErrBodyTooLarge, maxBytes)
+
+		default:
+			return err
+		}
+	}
+
+	// anything other than white space, comments and processing instructions after the first
+	// element is a second value
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.New("body must contain only one XML value")
+		}
+
+		switch tok := tok.(type) {
+		case xml.CharData:
+			if strings.TrimSpace(string(tok)) != "" {
+				return errors.New("body must contain only one XML value")
+			}
+		case xml.Comment, xml.ProcInst:
+		default:
+			return errors.New("body must contain only one XML value")
+		}
+	}
+}
+
+// WriteXML takes a response status code and arbitrary data and write xml to the client
+func (t *Tools) WriteXML(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
+	out, err := xml.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			w.Header()[key] = value
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, err = w.Write(append([]byte(xml.Header), out...))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// ErrorXML takes an error, and optionally a status code, and generates and send an XML error message
+func (t *Tools) ErrorXML(w http.ResponseWriter, err error, status ...int) error {
+	statusCode := http.StatusBadRequest
+
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	var payload XMLResponse
+	payload.Error = true
+	payload.Message = err.Error()
+
+	return t.WriteXML(w, statusCode, payload)
+}
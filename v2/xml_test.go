@@ -0,0 +1,126 @@
+package toolkit
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+var xmlTests = []struct {
+	name          string
+	xml           string
+	errorExpected bool
+	maxSize       int
+}{
+	{name: "good xml", xml: `<item><foo>bar</foo></item>`, errorExpected: false, maxSize: 1024},
+	{name: "with declaration", xml: `<?xml version="1.0" encoding="UTF-8"?>` + "\n" + `<item><foo>bar</foo></item>` + "\n", errorExpected: false, maxSize: 1024},
+	{name: "trailing comment", xml: `<item><foo>bar</foo></item><!-- done -->`, errorExpected: false, maxSize: 1024},
+	{name: "badly formatted xml", xml: `<item><foo>bar</item>`, errorExpected: true, maxSize: 1024},
+	{name: "two xml values", xml: `<item><foo>bar</foo></item><item><foo>baz</foo></item>`, errorExpected: true, maxSize: 1024},
+	{name: "trailing text", xml: `<item><foo>bar</foo></item>oops`, errorExpected: true, maxSize: 1024},
+	{name: "empty body", xml: ``, errorExpected: true, maxSize: 1024},
+	{name: "file too large", xml: `<item><foo>bar</foo></item>`, errorExpected: true, maxSize: 5},
+}
+
+func TestTools_ReadXML(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range xmlTests {
+		testTools.MaxXMLSize = e.maxSize
+
+		var decodedXML struct {
+			Foo string `xml:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(e.xml))
+		rr := httptest.NewRecorder()
+
+		err := testTools.ReadXML(rr, req, &decodedXML)
+
+		if err == nil && e.errorExpected {
+			t.Errorf("%s: error expected, but none received", e.name)
+		}
+
+		if err != nil && !e.errorExpected {
+			t.Errorf("%s: error not expected, but one received: %s", e.name, err.Error())
+		}
+
+		if err == nil && decodedXML.Foo != "bar" {
+			t.Errorf("%s: expected foo to be bar, but got %q", e.name, decodedXML.Foo)
+		}
+	}
+}
+
+func TestTools_WriteXML(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	payload := XMLResponse{
+		Error:   false,
+		Message: "foo",
+	}
+
+	headers := make(http.Header)
+	headers.Add("FOO", "BAR")
+
+	err := testTools.WriteXML(rr, http.StatusOK, payload, headers)
+	if err != nil {
+		t.Errorf("failed to write XML: %v", err)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status code of 200, but got %d", rr.Code)
+	}
+
+	if rr.Header().Get("Content-Type") != "application/xml" {
+		t.Error("wrong content type of ", rr.Header().Get("Content-Type"))
+	}
+
+	if rr.Header().Get("Foo") != "BAR" {
+		t.Error("wrong header ", rr.Header().Get("Foo"))
+	}
+
+	if !bytes.HasPrefix(rr.Body.Bytes(), []byte(xml.Header)) {
+		t.Error("expected the body to start with the XML header")
+	}
+
+	var response XMLResponse
+	if err := xml.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Error("unmarshal error", err)
+	}
+
+	if response.Error || response.Message != "foo" {
+		t.Errorf("expected body %+v, but got %+v", payload, response)
+	}
+}
+
+func TestTools_ErrorXML(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	err := testTools.ErrorXML(rr, errors.New("some error"), http.StatusServiceUnavailable)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var response XMLResponse
+	if err := xml.NewDecoder(rr.Body).Decode(&response); err != nil {
+		t.Error("received error when decoding XML", err)
+	}
+
+	if !response.Error {
+		t.Error("error set to false in XML, and it should be true")
+	}
+
+	if response.Message != "some error" {
+		t.Errorf("wrong message received; expected some error, but got %s", response.Message)
+	}
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong status code returned; expected 503, but got %d", rr.Code)
+	}
+}